@@ -0,0 +1,79 @@
+package pram
+
+import (
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/stevecallear/pram/proto/prampb"
+)
+
+type (
+	// Codec represents a message codec, which defines the wire format of the message envelope
+	Codec interface {
+		Marshal(m Message) ([]byte, error)
+		Unmarshal(b []byte, pm proto.Message) (Message, error)
+	}
+
+	// ProtoCodec represents a codec that encodes the message envelope as protobuf binary, which is the default
+	ProtoCodec struct {
+		Checksum bool
+	}
+
+	// JSONCodec represents a codec that encodes the message envelope as protobuf json
+	// Encoded messages are published as text rather than base64, allowing them to be read by non-pram consumers.
+	// The payload type must be linked into the subscriber binary for the message to be unmarshalled.
+	JSONCodec struct{}
+
+	// textCodec represents a codec that produces text, which does not require base64 encoding
+	textCodec interface {
+		text()
+	}
+)
+
+// Marshal marshals the specified message as protobuf binary
+func (c ProtoCodec) Marshal(m Message) ([]byte, error) {
+	wm, err := wrap(m.Payload, m.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Checksum {
+		wm.Checksum = checksum(wm.Body.GetValue())
+	}
+
+	return proto.Marshal(wm)
+}
+
+// Unmarshal unmarshals the specified protobuf binary into the message
+func (c ProtoCodec) Unmarshal(b []byte, pm proto.Message) (Message, error) {
+	wm := new(prampb.Message)
+	err := proto.Unmarshal(b, wm)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return unwrap(wm, pm)
+}
+
+// Marshal marshals the specified message as protobuf json
+func (c JSONCodec) Marshal(m Message) ([]byte, error) {
+	wm, err := wrap(m.Payload, m.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return protojson.Marshal(wm)
+}
+
+// Unmarshal unmarshals the specified protobuf json into the message
+func (c JSONCodec) Unmarshal(b []byte, pm proto.Message) (Message, error) {
+	wm := new(prampb.Message)
+	err := protojson.Unmarshal(b, wm)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return unwrap(wm, pm)
+}
+
+func (JSONCodec) text() {}
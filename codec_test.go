@@ -0,0 +1,57 @@
+package pram_test
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/stevecallear/pram"
+	"github.com/stevecallear/pram/internal/assert"
+	"github.com/stevecallear/pram/proto/testpb"
+)
+
+func TestCodec(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec pram.Codec
+	}{
+		{
+			name:  "should round trip protobuf messages",
+			codec: pram.ProtoCodec{},
+		},
+		{
+			name:  "should round trip protobuf messages with checksums",
+			codec: pram.ProtoCodec{Checksum: true},
+		},
+		{
+			name:  "should round trip json messages",
+			codec: pram.JSONCodec{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := pram.Message{
+				Payload: &testpb.Message{Value: "value"},
+				Metadata: pram.Metadata{
+					ID:            "id",
+					Type:          "pram.test.Message",
+					CorrelationID: "correlation-id",
+					Timestamp:     time.Date(2021, 7, 20, 12, 0, 0, 1000, time.UTC),
+				},
+			}
+
+			b, err := tt.codec.Marshal(in)
+			assert.ErrorExists(t, err, false)
+
+			act, err := tt.codec.Unmarshal(b, new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+
+			if !proto.Equal(act.Payload, in.Payload) {
+				t.Errorf("got %v, expected %v", act.Payload, in.Payload)
+			}
+			assert.DeepEqual(t, act.Metadata, in.Metadata)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package pram
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+type (
+	// SubscriberStats represents a snapshot of subscriber statistics
+	SubscriberStats struct {
+		Received int64 `json:"received"`
+		Handled  int64 `json:"handled"`
+		Failed   int64 `json:"failed"`
+		InFlight int64 `json:"inFlight"`
+	}
+
+	// RegistryStats represents a snapshot of registry statistics
+	RegistryStats struct {
+		CachedTopics int `json:"cachedTopics"`
+		CachedQueues int `json:"cachedQueues"`
+	}
+
+	subscriberStats struct {
+		received int64
+		handled  int64
+		failed   int64
+		inFlight int64
+	}
+)
+
+// Stats returns the subscriber statistics
+func (s *Subscriber) Stats() SubscriberStats {
+	return SubscriberStats{
+		Received: atomic.LoadInt64(&s.stats.received),
+		Handled:  atomic.LoadInt64(&s.stats.handled),
+		Failed:   atomic.LoadInt64(&s.stats.failed),
+		InFlight: atomic.LoadInt64(&s.stats.inFlight),
+	}
+}
+
+// Stats returns the registry statistics. Cache counts are only available if supported by the store.
+func (r *Registry) Stats() RegistryStats {
+	var st RegistryStats
+	if c, ok := r.store.(interface{ Count() (int, int) }); ok {
+		st.CachedTopics, st.CachedQueues = c.Count()
+	}
+
+	return st
+}
+
+// DebugHandler returns a read-only http handler that writes the subscriber and registry statistics as json.
+// Either argument can be nil if it is not in use.
+func DebugHandler(s *Subscriber, r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		v := struct {
+			Subscriber *SubscriberStats `json:"subscriber,omitempty"`
+			Registry   *RegistryStats   `json:"registry,omitempty"`
+		}{}
+
+		if s != nil {
+			st := s.Stats()
+			v.Subscriber = &st
+		}
+
+		if r != nil {
+			st := r.Stats()
+			v.Registry = &st
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+}
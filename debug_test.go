@@ -0,0 +1,68 @@
+package pram_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/stevecallear/pram"
+	"github.com/stevecallear/pram/internal/assert"
+	"github.com/stevecallear/pram/internal/store"
+	"github.com/stevecallear/pram/mocks"
+	"github.com/stevecallear/pram/proto/testpb"
+)
+
+func TestDebugHandler(t *testing.T) {
+	t.Run("should write the statistics", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(&testpb.Message{Value: "value"}), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sub := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sub.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			return nil
+		}, cancel))
+		assert.ErrorExists(t, err, false)
+
+		st := new(store.InMemoryStore)
+		st.GetOrSetTopicARN(ctx, "topic", func() (string, error) {
+			return "arn", nil
+		})
+
+		reg := pram.NewRegistry(nil, nil, pram.WithStore(st))
+
+		rec := httptest.NewRecorder()
+		pram.DebugHandler(sub, reg).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		var act struct {
+			Subscriber pram.SubscriberStats `json:"subscriber"`
+			Registry   pram.RegistryStats   `json:"registry"`
+		}
+
+		err = json.NewDecoder(rec.Body).Decode(&act)
+		assert.ErrorExists(t, err, false)
+
+		assert.DeepEqual(t, act.Subscriber, pram.SubscriberStats{Received: 1, Handled: 1})
+		assert.DeepEqual(t, act.Registry, pram.RegistryStats{CachedTopics: 1})
+	})
+}
@@ -70,7 +70,7 @@ func main() {
 				return
 			case <-t.C:
 				msg := &testpb.Message{Value: uuid.NewString()}
-				err := pub.Publish(ctx, msg)
+				_, err := pub.Publish(ctx, msg)
 				if err != nil {
 					pram.Log(err)
 				}
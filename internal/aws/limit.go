@@ -0,0 +1,194 @@
+package aws
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+type (
+	// limiter limits the number of concurrent calls
+	limiter chan struct{}
+
+	// limitedSNS wraps an sns client to limit the number of concurrent calls
+	limitedSNS struct {
+		SNS
+		limiter limiter
+	}
+
+	// limitedSQS wraps an sqs client to limit the number of concurrent calls
+	limitedSQS struct {
+		SQS
+		limiter limiter
+	}
+
+	// callTimer records the start of an aws call, and is reset once the call acquires the limiter
+	// This ensures that observed durations do not include the time spent waiting for capacity.
+	callTimer struct {
+		start time.Time
+	}
+
+	callTimerKey struct{}
+)
+
+// withCallTimer returns a context containing a new call timer, which is started immediately
+func withCallTimer(ctx context.Context) (context.Context, *callTimer) {
+	t := &callTimer{start: time.Now()}
+	return context.WithValue(ctx, callTimerKey{}, t), t
+}
+
+// acquire blocks until a call can be made or the context is done, returning the func to release it
+// Any call timer on the context is restarted once the call can be made.
+func (l limiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case l <- struct{}{}:
+		if t, ok := ctx.Value(callTimerKey{}).(*callTimer); ok {
+			t.start = time.Now()
+		}
+		return func() { <-l }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *limitedSNS) CreateTopic(ctx context.Context, params *sns.CreateTopicInput, optFns ...func(*sns.Options)) (*sns.CreateTopicOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SNS.CreateTopic(ctx, params, optFns...)
+}
+
+func (c *limitedSNS) SetTopicAttributes(ctx context.Context, params *sns.SetTopicAttributesInput, optFns ...func(*sns.Options)) (*sns.SetTopicAttributesOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SNS.SetTopicAttributes(ctx, params, optFns...)
+}
+
+func (c *limitedSNS) Subscribe(ctx context.Context, params *sns.SubscribeInput, optFns ...func(*sns.Options)) (*sns.SubscribeOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SNS.Subscribe(ctx, params, optFns...)
+}
+
+func (c *limitedSNS) SetSubscriptionAttributes(ctx context.Context, params *sns.SetSubscriptionAttributesInput, optFns ...func(*sns.Options)) (*sns.SetSubscriptionAttributesOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SNS.SetSubscriptionAttributes(ctx, params, optFns...)
+}
+
+func (c *limitedSNS) GetTopicAttributes(ctx context.Context, params *sns.GetTopicAttributesInput, optFns ...func(*sns.Options)) (*sns.GetTopicAttributesOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SNS.GetTopicAttributes(ctx, params, optFns...)
+}
+
+func (c *limitedSNS) ListTopics(ctx context.Context, params *sns.ListTopicsInput, optFns ...func(*sns.Options)) (*sns.ListTopicsOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SNS.ListTopics(ctx, params, optFns...)
+}
+
+func (c *limitedSNS) DeleteTopic(ctx context.Context, params *sns.DeleteTopicInput, optFns ...func(*sns.Options)) (*sns.DeleteTopicOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SNS.DeleteTopic(ctx, params, optFns...)
+}
+
+func (c *limitedSNS) Unsubscribe(ctx context.Context, params *sns.UnsubscribeInput, optFns ...func(*sns.Options)) (*sns.UnsubscribeOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SNS.Unsubscribe(ctx, params, optFns...)
+}
+
+func (c *limitedSQS) CreateQueue(ctx context.Context, params *sqs.CreateQueueInput, optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SQS.CreateQueue(ctx, params, optFns...)
+}
+
+func (c *limitedSQS) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SQS.GetQueueAttributes(ctx, params, optFns...)
+}
+
+func (c *limitedSQS) SetQueueAttributes(ctx context.Context, params *sqs.SetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SQS.SetQueueAttributes(ctx, params, optFns...)
+}
+
+func (c *limitedSQS) GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SQS.GetQueueUrl(ctx, params, optFns...)
+}
+
+func (c *limitedSQS) PurgeQueue(ctx context.Context, params *sqs.PurgeQueueInput, optFns ...func(*sqs.Options)) (*sqs.PurgeQueueOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SQS.PurgeQueue(ctx, params, optFns...)
+}
+
+func (c *limitedSQS) DeleteQueue(ctx context.Context, params *sqs.DeleteQueueInput, optFns ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return c.SQS.DeleteQueue(ctx, params, optFns...)
+}
@@ -2,6 +2,7 @@ package aws
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"text/template"
@@ -33,7 +34,7 @@ const (
     "Resource": "{{.TopicARN}}",
     "Condition": {
       "StringEquals": {
-        "AWS:SourceOwner": "{{.AccountID}}"
+        "AWS:SourceOwner": {{.AccountIDs}}
       }
     }
   }]
@@ -58,6 +59,24 @@ const (
   }]
 }`
 
+	kmsKeyPolicyStatementTemplateStr = `{
+  "Sid": "{{.SID}}",
+  "Effect": "Allow",
+  "Principal": {
+    "Service": "sns.amazonaws.com"
+  },
+  "Action": [
+    "kms:Decrypt",
+    "kms:GenerateDataKey"
+  ],
+  "Resource": "*"{{if .TopicARNs}},
+  "Condition": {
+    "ArnEquals": {
+      "aws:SourceArn": {{.TopicARNs}}
+    }
+  }{{end}}
+}`
+
 	redrivePolicyTemplateStr = `{
   "deadLetterTargetArn": "{{.DeadLetterTargetARN}}",
   "maxReceiveCount": "{{.MaxReceiveCount}}"
@@ -65,13 +84,21 @@ const (
 )
 
 var (
-	snsPolicyTemplate     = template.Must(template.New("snsPolicy").Parse(snsPolicyTemplateStr))
-	sqsPolicyTemplate     = template.Must(template.New("sqsPolicy").Parse(sqsPolicyTemplateStr))
-	redrivePolicyTemplate = template.Must(template.New("redrivePolicy").Parse(redrivePolicyTemplateStr))
+	snsPolicyTemplate             = template.Must(template.New("snsPolicy").Parse(snsPolicyTemplateStr))
+	sqsPolicyTemplate             = template.Must(template.New("sqsPolicy").Parse(sqsPolicyTemplateStr))
+	kmsKeyPolicyStatementTemplate = template.Must(template.New("kmsKeyPolicyStatement").Parse(kmsKeyPolicyStatementTemplateStr))
+	redrivePolicyTemplate         = template.Must(template.New("redrivePolicy").Parse(redrivePolicyTemplateStr))
 )
 
+// NewPolicyID returns a new random policy id, which is the default used for policy and statement ids
+func NewPolicyID() string {
+	return strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
 // SNSAccessPolicy returns a new sns access policy
-func SNSAccessPolicy(topicARN string) (string, error) {
+// The topic account is always permitted, with any additional source accounts permitted for cross-account publishing.
+// Policy and statement ids are generated using idFn, or NewPolicyID if it is nil.
+func SNSAccessPolicy(idFn func() string, topicARN string, sourceAccountIDs ...string) (string, error) {
 	buf := bytes.NewBuffer(nil)
 
 	aid, err := accountIDFromARN(topicARN)
@@ -79,16 +106,34 @@ func SNSAccessPolicy(topicARN string) (string, error) {
 		return "", err
 	}
 
+	aids := []string{aid}
+	for _, id := range sourceAccountIDs {
+		if id != aid {
+			aids = append(aids, id)
+		}
+	}
+
+	// a single account is rendered as a string to retain the existing policy format
+	var b []byte
+	if len(aids) == 1 {
+		b, err = json.Marshal(aid)
+	} else {
+		b, err = json.Marshal(aids)
+	}
+	if err != nil {
+		return "", err
+	}
+
 	err = snsPolicyTemplate.Execute(buf, &struct {
-		PID       string
-		SID       string
-		TopicARN  string
-		AccountID string
+		PID        string
+		SID        string
+		TopicARN   string
+		AccountIDs string
 	}{
-		PID:       strings.ReplaceAll(uuid.NewString(), "-", ""),
-		SID:       strings.ReplaceAll(uuid.NewString(), "-", ""),
-		TopicARN:  topicARN,
-		AccountID: aid,
+		PID:        policyID(idFn),
+		SID:        policyID(idFn),
+		TopicARN:   topicARN,
+		AccountIDs: string(b),
 	})
 	if err != nil {
 		return "", err
@@ -98,7 +143,8 @@ func SNSAccessPolicy(topicARN string) (string, error) {
 }
 
 // SQSAccessPolicy returns a new sqs access policy
-func SQSAccessPolicy(topicARN, queueARN string) (string, error) {
+// Policy and statement ids are generated using idFn, or NewPolicyID if it is nil.
+func SQSAccessPolicy(idFn func() string, topicARN, queueARN string) (string, error) {
 	buf := bytes.NewBuffer(nil)
 
 	err := sqsPolicyTemplate.Execute(buf, &struct {
@@ -107,8 +153,8 @@ func SQSAccessPolicy(topicARN, queueARN string) (string, error) {
 		TopicARN string
 		QueueARN string
 	}{
-		PID:      strings.ReplaceAll(uuid.NewString(), "-", ""),
-		SID:      strings.ReplaceAll(uuid.NewString(), "-", ""),
+		PID:      policyID(idFn),
+		SID:      policyID(idFn),
 		TopicARN: topicARN,
 		QueueARN: queueARN,
 	})
@@ -119,6 +165,34 @@ func SQSAccessPolicy(topicARN, queueARN string) (string, error) {
 	return buf.String(), nil
 }
 
+// KMSKeyPolicyStatement returns a new kms key policy statement that allows sns to deliver messages to encrypted queues
+// If topic arns are specified then the statement is restricted to those topics.
+func KMSKeyPolicyStatement(idFn func() string, topicARNs ...string) (string, error) {
+	var arns string
+	if len(topicARNs) > 0 {
+		b, err := json.Marshal(topicARNs)
+		if err != nil {
+			return "", err
+		}
+
+		arns = string(b)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err := kmsKeyPolicyStatementTemplate.Execute(buf, &struct {
+		SID       string
+		TopicARNs string
+	}{
+		SID:       policyID(idFn),
+		TopicARNs: arns,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
 // SQSRedrivePolicy returns a new sqs redrive policy
 func SQSRedrivePolicy(errorQueueARN string, maxReceiveCount int) (string, error) {
 	buf := bytes.NewBuffer(nil)
@@ -137,6 +211,14 @@ func SQSRedrivePolicy(errorQueueARN string, maxReceiveCount int) (string, error)
 	return buf.String(), nil
 }
 
+func policyID(fn func() string) string {
+	if fn == nil {
+		return NewPolicyID()
+	}
+
+	return fn()
+}
+
 func accountIDFromARN(arn string) (string, error) {
 	els := strings.Split(arn, ":")
 	if len(els) < 5 {
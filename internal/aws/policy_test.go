@@ -14,12 +14,12 @@ func TestSNSAccessPolicy(t *testing.T) {
 	const arn = "arn:aws:sns:eu-west-1:111122223333:stage-package-Message"
 
 	t.Run("should return an error if the arn is invalid", func(t *testing.T) {
-		_, err := aws.SNSAccessPolicy("invalid")
+		_, err := aws.SNSAccessPolicy(nil, "invalid")
 		assert.ErrorExists(t, err, true)
 	})
 
 	t.Run("should generate valid json", func(t *testing.T) {
-		p, err := aws.SNSAccessPolicy(arn)
+		p, err := aws.SNSAccessPolicy(nil, arn)
 		assert.ErrorExists(t, err, false)
 
 		err = json.Unmarshal([]byte(p), &map[string]interface{}{})
@@ -27,7 +27,7 @@ func TestSNSAccessPolicy(t *testing.T) {
 	})
 
 	t.Run("should return the policy", func(t *testing.T) {
-		p, err := aws.SNSAccessPolicy(arn)
+		p, err := aws.SNSAccessPolicy(nil, arn)
 		assert.ErrorExists(t, err, false)
 
 		if act, exp := gjson.Get(p, "Statement.0.Resource").Str, arn; act != exp {
@@ -38,6 +38,44 @@ func TestSNSAccessPolicy(t *testing.T) {
 			t.Errorf("got %s, expected %s", act, exp)
 		}
 	})
+
+	t.Run("should permit additional source accounts", func(t *testing.T) {
+		p, err := aws.SNSAccessPolicy(nil, arn, "111122223333", "444455556666")
+		assert.ErrorExists(t, err, false)
+
+		err = json.Unmarshal([]byte(p), &map[string]interface{}{})
+		assert.ErrorExists(t, err, false)
+
+		var act []string
+		gjson.Get(p, "Statement.0.Condition.StringEquals.AWS:SourceOwner").ForEach(func(_, v gjson.Result) bool {
+			act = append(act, v.Str)
+			return true
+		})
+
+		assert.DeepEqual(t, act, []string{"111122223333", "444455556666"})
+	})
+}
+
+func TestSNSAccessPolicy_IDFn(t *testing.T) {
+	t.Run("should use the id fn", func(t *testing.T) {
+		p, err := aws.SNSAccessPolicy(func() string { return "id" }, "arn:aws:sns:eu-west-1:111122223333:topic")
+		assert.ErrorExists(t, err, false)
+
+		assert.DeepEqual(t, gjson.Get(p, "Id").Str, "id")
+		assert.DeepEqual(t, gjson.Get(p, "Statement.0.Sid").Str, "id")
+	})
+
+	t.Run("should default to random ids", func(t *testing.T) {
+		p1, err := aws.SNSAccessPolicy(nil, "arn:aws:sns:eu-west-1:111122223333:topic")
+		assert.ErrorExists(t, err, false)
+
+		p2, err := aws.SNSAccessPolicy(nil, "arn:aws:sns:eu-west-1:111122223333:topic")
+		assert.ErrorExists(t, err, false)
+
+		if gjson.Get(p1, "Id").Str == gjson.Get(p2, "Id").Str {
+			t.Errorf("got equal ids, expected random ids")
+		}
+	})
 }
 
 func TestSQSAccessPolicy(t *testing.T) {
@@ -45,7 +83,7 @@ func TestSQSAccessPolicy(t *testing.T) {
 	const queueARN = "arn:aws:sqs:eu-west-1:111122223333:stage-service-package-Message"
 
 	t.Run("should generate valid json", func(t *testing.T) {
-		p, err := aws.SQSAccessPolicy(topicARN, queueARN)
+		p, err := aws.SQSAccessPolicy(nil, topicARN, queueARN)
 		assert.ErrorExists(t, err, false)
 
 		err = json.Unmarshal([]byte(p), &map[string]interface{}{})
@@ -53,7 +91,7 @@ func TestSQSAccessPolicy(t *testing.T) {
 	})
 
 	t.Run("should return the policy", func(t *testing.T) {
-		p, err := aws.SQSAccessPolicy(topicARN, queueARN)
+		p, err := aws.SQSAccessPolicy(nil, topicARN, queueARN)
 		assert.ErrorExists(t, err, false)
 
 		if act, exp := gjson.Get(p, "Statement.0.Resource").Str, queueARN; act != exp {
@@ -66,6 +104,55 @@ func TestSQSAccessPolicy(t *testing.T) {
 	})
 }
 
+func TestSQSAccessPolicy_IDFn(t *testing.T) {
+	t.Run("should use the id fn", func(t *testing.T) {
+		p, err := aws.SQSAccessPolicy(func() string { return "id" }, "arn:aws:sns:eu-west-1:111122223333:topic", "arn:aws:sqs:eu-west-1:111122223333:queue")
+		assert.ErrorExists(t, err, false)
+
+		assert.DeepEqual(t, gjson.Get(p, "Id").Str, "id")
+		assert.DeepEqual(t, gjson.Get(p, "Statement.0.Sid").Str, "id")
+	})
+}
+
+func TestKMSKeyPolicyStatement(t *testing.T) {
+	const topicARN = "arn:aws:sns:eu-west-1:111122223333:stage-package-Message"
+
+	t.Run("should allow sns to use the key", func(t *testing.T) {
+		p, err := aws.KMSKeyPolicyStatement(nil)
+		assert.ErrorExists(t, err, false)
+
+		err = json.Unmarshal([]byte(p), &map[string]interface{}{})
+		assert.ErrorExists(t, err, false)
+
+		if act, exp := gjson.Get(p, "Principal.Service").Str, "sns.amazonaws.com"; act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+
+		var act []string
+		gjson.Get(p, "Action").ForEach(func(_, v gjson.Result) bool {
+			act = append(act, v.Str)
+			return true
+		})
+		assert.DeepEqual(t, act, []string{"kms:Decrypt", "kms:GenerateDataKey"})
+
+		if gjson.Get(p, "Condition").Exists() {
+			t.Errorf("got condition, expected none")
+		}
+	})
+
+	t.Run("should restrict the statement to the topics", func(t *testing.T) {
+		p, err := aws.KMSKeyPolicyStatement(nil, topicARN)
+		assert.ErrorExists(t, err, false)
+
+		err = json.Unmarshal([]byte(p), &map[string]interface{}{})
+		assert.ErrorExists(t, err, false)
+
+		if act, exp := gjson.Get(p, "Condition.ArnEquals.aws:SourceArn.0").Str, topicARN; act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+	})
+}
+
 func TestSQSRedrivePolicy(t *testing.T) {
 	const errorQueueARN = "arn:aws:sqs:eu-west-1:111122223333:stage-service-package-Message"
 	const maxReceiveCount = 5
@@ -2,20 +2,52 @@ package aws
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 
 	awssdk "github.com/aws/aws-sdk-go-v2/aws"
 )
 
+// Operations observed when ensuring infrastructure
+const (
+	OperationCreateTopic               = "create_topic"
+	OperationSetTopicAttributes        = "set_topic_attributes"
+	OperationCreateQueue               = "create_queue"
+	OperationGetQueueAttributes        = "get_queue_attributes"
+	OperationSetQueueAttributes        = "set_queue_attributes"
+	OperationSubscribe                 = "subscribe"
+	OperationSetSubscriptionAttributes = "set_subscription_attributes"
+	OperationListTopics                = "list_topics"
+	OperationGetQueueURL               = "get_queue_url"
+	OperationGetTopicAttributes        = "get_topic_attributes"
+)
+
+// defaultPolicyID is the id of the access policy that sns applies to new topics
+const defaultPolicyID = "__default_policy_ID"
+
+// ErrNotFound is returned in lookup only mode if a topic or queue does not exist
+var ErrNotFound = errors.New("not found")
+
 type (
 	// SNS represents an sns client interface
 	SNS interface {
 		CreateTopic(ctx context.Context, params *sns.CreateTopicInput, optFns ...func(*sns.Options)) (*sns.CreateTopicOutput, error)
 		SetTopicAttributes(ctx context.Context, params *sns.SetTopicAttributesInput, optFns ...func(*sns.Options)) (*sns.SetTopicAttributesOutput, error)
 		Subscribe(ctx context.Context, params *sns.SubscribeInput, optFns ...func(*sns.Options)) (*sns.SubscribeOutput, error)
+		SetSubscriptionAttributes(ctx context.Context, params *sns.SetSubscriptionAttributesInput, optFns ...func(*sns.Options)) (*sns.SetSubscriptionAttributesOutput, error)
+		GetTopicAttributes(ctx context.Context, params *sns.GetTopicAttributesInput, optFns ...func(*sns.Options)) (*sns.GetTopicAttributesOutput, error)
+		ListTopics(ctx context.Context, params *sns.ListTopicsInput, optFns ...func(*sns.Options)) (*sns.ListTopicsOutput, error)
+		DeleteTopic(ctx context.Context, params *sns.DeleteTopicInput, optFns ...func(*sns.Options)) (*sns.DeleteTopicOutput, error)
+		Unsubscribe(ctx context.Context, params *sns.UnsubscribeInput, optFns ...func(*sns.Options)) (*sns.UnsubscribeOutput, error)
 	}
 
 	// SQS represents an sqs client interface
@@ -23,91 +55,244 @@ type (
 		CreateQueue(ctx context.Context, params *sqs.CreateQueueInput, optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error)
 		GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
 		SetQueueAttributes(ctx context.Context, params *sqs.SetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error)
+		GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error)
+		PurgeQueue(ctx context.Context, params *sqs.PurgeQueueInput, optFns ...func(*sqs.Options)) (*sqs.PurgeQueueOutput, error)
+		DeleteQueue(ctx context.Context, params *sqs.DeleteQueueInput, optFns ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error)
 	}
 
 	// Service represents an sqs/sns queue service
 	Service struct {
-		snsc  SNS
-		sqsc  SQS
-		logFn func(string, ...interface{})
+		snsc       SNS
+		sqsc       SQS
+		logFn      func(string, ...interface{})
+		observeFn  func(string, time.Duration)
+		idFn       func() string
+		lookupOnly bool
 	}
 
 	// EnsureTopicRequest represents an ensure topic request
+	// If DetectCreated is true then the topic policy is retrieved before it is set, to determine whether the topic is new.
 	EnsureTopicRequest struct {
-		TopicName string
+		TopicName        string
+		FIFO             bool
+		SourceAccountIDs []string
+		KMSKeyID         string
+		DetectCreated    bool
 	}
 
 	// EnsureTopicResponse represents an ensure topic response
 	EnsureTopicResponse struct {
 		TopicARN string
+		Created  bool
 	}
 
 	// EnsureSubscriptionRequest represents an ensure subscription request
+	// If an endpoint is specified it is subscribed directly using the protocol, which defaults to sqs.
+	// Otherwise the queue and error queue are created and subscribed.
 	EnsureSubscriptionRequest struct {
-		TopicARN        string
-		QueueName       string
-		ErrorQueueName  string
-		MaxReceiveCount int
+		TopicARN                 string
+		QueueName                string
+		ErrorQueueName           string
+		MaxReceiveCount          int
+		FIFO                     bool
+		Protocol                 string
+		Endpoint                 string
+		FilterPolicy             map[string]interface{}
+		RawDelivery              bool
+		VisibilityTimeoutSeconds int
+		KMSKeyID                 string
+		ManagedSSE               bool
+		Attributes               map[string]string
 	}
 
 	// EnsureSubscriptionResponse represents an ensure subscription response
 	EnsureSubscriptionResponse struct {
+		QueueURL        string
+		ErrorQueueURL   string
+		ErrorQueueARN   string
+		SubscriptionARN string
+	}
+
+	// GetTopicARNRequest represents a get topic arn request
+	GetTopicARNRequest struct {
+		TopicName string
+	}
+
+	// GetTopicARNResponse represents a get topic arn response
+	GetTopicARNResponse struct {
+		TopicARN string
+	}
+
+	// GetQueueURLRequest represents a get queue url request
+	GetQueueURLRequest struct {
+		QueueName string
+	}
+
+	// GetQueueURLResponse represents a get queue url response
+	GetQueueURLResponse struct {
 		QueueURL string
 	}
+
+	// PurgeQueueRequest represents a purge queue request
+	PurgeQueueRequest struct {
+		QueueName string
+	}
+
+	// DeleteTopicRequest represents a delete topic request
+	DeleteTopicRequest struct {
+		TopicName string
+	}
+
+	// DeleteQueueRequest represents a delete queue request
+	DeleteQueueRequest struct {
+		QueueName string
+	}
+
+	// UnsubscribeRequest represents an unsubscribe request
+	UnsubscribeRequest struct {
+		SubscriptionARN string
+	}
 )
 
 // NewService returns a new queue service
+// The log func is called with a message and alternating key/value fields.
 func NewService(snsc SNS, sqsc SQS, logFn func(string, ...interface{})) *Service {
 	return &Service{
 		snsc:  snsc,
 		sqsc:  sqsc,
 		logFn: logFn,
+		idFn:  NewPolicyID,
 	}
 }
 
 // EnsureTopic ensures that the specified topic exists
 func (s *Service) EnsureTopic(ctx context.Context, req EnsureTopicRequest) (EnsureTopicResponse, error) {
-	res, err := s.snsc.CreateTopic(ctx, &sns.CreateTopicInput{
+	if s.lookupOnly {
+		return s.lookupTopic(ctx, req)
+	}
+
+	in := &sns.CreateTopicInput{
 		Name: awssdk.String(req.TopicName),
-	})
+	}
+	if req.FIFO {
+		in.Attributes = map[string]string{"FifoTopic": "true"}
+	}
+
+	tctx, t := withCallTimer(ctx)
+	res, err := s.snsc.CreateTopic(tctx, in)
+	ctd := s.observe(OperationCreateTopic, t)
 	if err != nil {
 		return EnsureTopicResponse{}, err
 	}
 
-	ap, err := SNSAccessPolicy(*res.TopicArn)
+	var created bool
+	if req.DetectCreated {
+		created, err = s.isNewTopic(ctx, *res.TopicArn)
+		if err != nil {
+			return EnsureTopicResponse{}, err
+		}
+	}
+
+	ap, err := SNSAccessPolicy(s.idFn, *res.TopicArn, req.SourceAccountIDs...)
 	if err != nil {
 		return EnsureTopicResponse{}, err
 	}
 
-	_, err = s.snsc.SetTopicAttributes(ctx, &sns.SetTopicAttributesInput{
+	tctx, t = withCallTimer(ctx)
+	_, err = s.snsc.SetTopicAttributes(tctx, &sns.SetTopicAttributesInput{
 		TopicArn:       res.TopicArn,
 		AttributeName:  awssdk.String("Policy"),
 		AttributeValue: awssdk.String(ap),
 	})
+	s.observe(OperationSetTopicAttributes, t)
 	if err != nil {
 		return EnsureTopicResponse{}, err
 	}
 
-	s.log("created topic %s", *res.TopicArn)
+	// encryption is set after creation, as create fails if an existing topic has different attributes
+	if req.KMSKeyID != "" {
+		tctx, t = withCallTimer(ctx)
+		_, err = s.snsc.SetTopicAttributes(tctx, &sns.SetTopicAttributesInput{
+			TopicArn:       res.TopicArn,
+			AttributeName:  awssdk.String("KmsMasterKeyId"),
+			AttributeValue: awssdk.String(req.KMSKeyID),
+		})
+		s.observe(OperationSetTopicAttributes, t)
+		if err != nil {
+			return EnsureTopicResponse{}, err
+		}
+	}
+
+	s.log("created topic", "topic_arn", *res.TopicArn, "duration", ctd)
 
 	return EnsureTopicResponse{
 		TopicARN: *res.TopicArn,
+		Created:  created,
 	}, nil
 }
 
+// isNewTopic returns true if the topic still has the default sns access policy, which is replaced when it is ensured
+// Topics created outside of pram that retain the default policy are also reported as new.
+func (s *Service) isNewTopic(ctx context.Context, topicARN string) (bool, error) {
+	tctx, t := withCallTimer(ctx)
+	res, err := s.snsc.GetTopicAttributes(tctx, &sns.GetTopicAttributesInput{
+		TopicArn: awssdk.String(topicARN),
+	})
+	s.observe(OperationGetTopicAttributes, t)
+	if err != nil {
+		return false, err
+	}
+
+	var p struct {
+		ID string `json:"Id"`
+	}
+	if err = json.Unmarshal([]byte(res.Attributes["Policy"]), &p); err != nil {
+		return false, err
+	}
+
+	return p.ID == defaultPolicyID, nil
+}
+
 // EnsureSubscription ensures that the specified topic subscription, queue and error queue exist
 func (s *Service) EnsureSubscription(ctx context.Context, req EnsureSubscriptionRequest) (EnsureSubscriptionResponse, error) {
-	_, eqa, err := s.createQueue(ctx, req.ErrorQueueName)
+	if req.Endpoint != "" {
+		p := req.Protocol
+		if p == "" {
+			p = "sqs"
+		}
+
+		sa, err := s.subscribe(ctx, req, p, req.Endpoint)
+		if err != nil {
+			return EnsureSubscriptionResponse{}, err
+		}
+
+		return EnsureSubscriptionResponse{
+			SubscriptionARN: sa,
+		}, nil
+	}
+
+	if s.lookupOnly {
+		return s.lookupQueue(ctx, req)
+	}
+
+	equ, eqa, err := s.createQueue(ctx, req.ErrorQueueName, req.FIFO)
 	if err != nil {
 		return EnsureSubscriptionResponse{}, err
 	}
 
-	mqu, mqa, err := s.createQueue(ctx, req.QueueName)
+	if ea := queueAttributes(req); len(ea) > 0 {
+		err = s.setQueueAttributes(ctx, equ, ea)
+		if err != nil {
+			return EnsureSubscriptionResponse{}, err
+		}
+	}
+
+	mqu, mqa, err := s.createQueue(ctx, req.QueueName, req.FIFO)
 	if err != nil {
 		return EnsureSubscriptionResponse{}, err
 	}
 
-	ap, err := SQSAccessPolicy(req.TopicARN, mqa)
+	ap, err := SQSAccessPolicy(s.idFn, req.TopicARN, mqa)
 	if err != nil {
 		return EnsureSubscriptionResponse{}, err
 	}
@@ -117,57 +302,368 @@ func (s *Service) EnsureSubscription(ctx context.Context, req EnsureSubscription
 		return EnsureSubscriptionResponse{}, err
 	}
 
-	_, err = s.sqsc.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
-		QueueUrl: awssdk.String(mqu),
-		Attributes: map[string]string{
-			"Policy":        ap,
-			"RedrivePolicy": rp,
-		},
-	})
+	qa := queueAttributes(req)
+	qa["Policy"] = ap
+	qa["RedrivePolicy"] = rp
+	if req.VisibilityTimeoutSeconds > 0 {
+		qa["VisibilityTimeout"] = strconv.Itoa(req.VisibilityTimeoutSeconds)
+	}
+
+	err = s.setQueueAttributes(ctx, mqu, qa)
 	if err != nil {
 		return EnsureSubscriptionResponse{}, err
 	}
 
-	sr, err := s.snsc.Subscribe(ctx, &sns.SubscribeInput{
-		Protocol: awssdk.String("sqs"),
-		TopicArn: awssdk.String(req.TopicARN),
-		Endpoint: awssdk.String(mqa),
-	})
+	sa, err := s.subscribe(ctx, req, "sqs", mqa)
 	if err != nil {
 		return EnsureSubscriptionResponse{}, err
 	}
 
-	s.log("created subscription %s", *sr.SubscriptionArn)
-
 	return EnsureSubscriptionResponse{
-		QueueURL: mqu,
+		QueueURL:        mqu,
+		ErrorQueueURL:   equ,
+		ErrorQueueARN:   eqa,
+		SubscriptionARN: sa,
 	}, nil
 }
 
-func (s *Service) createQueue(ctx context.Context, queueName string) (string, string, error) {
+// PurgeQueue deletes all messages from the specified queue
+// AWS only allows a queue to be purged once every 60 seconds, subsequent requests will
+// return an error wrapping *types.PurgeQueueInProgress
+func (s *Service) PurgeQueue(ctx context.Context, req PurgeQueueRequest) error {
+	res, err := s.GetQueueURL(ctx, GetQueueURLRequest{
+		QueueName: req.QueueName,
+	})
+	if err != nil {
+		return err
+	}
 
-	cqr, err := s.sqsc.CreateQueue(ctx, &sqs.CreateQueueInput{
-		QueueName: awssdk.String(queueName),
+	_, err = s.sqsc.PurgeQueue(ctx, &sqs.PurgeQueueInput{
+		QueueUrl: awssdk.String(res.QueueURL),
+	})
+	if err != nil {
+		var pe *types.PurgeQueueInProgress
+		if errors.As(err, &pe) {
+			return fmt.Errorf("queue %s was purged within the last 60 seconds: %w", req.QueueName, err)
+		}
+
+		return err
+	}
+
+	s.log("purged queue", "queue_url", res.QueueURL)
+	return nil
+}
+
+// DeleteTopic deletes the specified topic and its subscriptions, returning nil if it does not exist
+func (s *Service) DeleteTopic(ctx context.Context, req DeleteTopicRequest) error {
+	res, err := s.lookupTopic(ctx, EnsureTopicRequest{
+		TopicName: req.TopicName,
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	_, err = s.snsc.DeleteTopic(ctx, &sns.DeleteTopicInput{
+		TopicArn: awssdk.String(res.TopicARN),
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	s.log("deleted topic", "topic_arn", res.TopicARN)
+	return nil
+}
+
+// DeleteQueue deletes the specified queue, returning nil if it does not exist
+func (s *Service) DeleteQueue(ctx context.Context, req DeleteQueueRequest) error {
+	res, err := s.GetQueueURL(ctx, GetQueueURLRequest{
+		QueueName: req.QueueName,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	_, err = s.sqsc.DeleteQueue(ctx, &sqs.DeleteQueueInput{
+		QueueUrl: awssdk.String(res.QueueURL),
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	s.log("deleted queue", "queue_url", res.QueueURL)
+	return nil
+}
+
+// Unsubscribe deletes the specified subscription, returning nil if it does not exist
+func (s *Service) Unsubscribe(ctx context.Context, req UnsubscribeRequest) error {
+	_, err := s.snsc.Unsubscribe(ctx, &sns.UnsubscribeInput{
+		SubscriptionArn: awssdk.String(req.SubscriptionARN),
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	s.log("deleted subscription", "subscription_arn", req.SubscriptionARN)
+	return nil
+}
+
+// GetTopicARN returns the arn of the specified topic, without creating it if it does not exist
+// An error wrapping ErrNotFound is returned if the topic does not exist.
+func (s *Service) GetTopicARN(ctx context.Context, req GetTopicARNRequest) (GetTopicARNResponse, error) {
+	res, err := s.lookupTopic(ctx, EnsureTopicRequest{
+		TopicName: req.TopicName,
+	})
+	if err != nil {
+		return GetTopicARNResponse{}, err
+	}
+
+	return GetTopicARNResponse{
+		TopicARN: res.TopicARN,
+	}, nil
+}
+
+// GetQueueURL returns the url of the specified queue, without creating it if it does not exist
+func (s *Service) GetQueueURL(ctx context.Context, req GetQueueURLRequest) (GetQueueURLResponse, error) {
+	res, err := s.sqsc.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+		QueueName: awssdk.String(req.QueueName),
+	})
+	if err != nil {
+		return GetQueueURLResponse{}, err
+	}
+
+	return GetQueueURLResponse{
+		QueueURL: *res.QueueUrl,
+	}, nil
+}
+
+func (s *Service) subscribe(ctx context.Context, req EnsureSubscriptionRequest, protocol, endpoint string) (string, error) {
+	tctx, t := withCallTimer(ctx)
+	sr, err := s.snsc.Subscribe(tctx, &sns.SubscribeInput{
+		Protocol: awssdk.String(protocol),
+		TopicArn: awssdk.String(req.TopicARN),
+		Endpoint: awssdk.String(endpoint),
+	})
+	d := s.observe(OperationSubscribe, t)
+	if err != nil {
+		return "", err
+	}
+
+	s.log("created subscription", "subscription_arn", *sr.SubscriptionArn, "duration", d)
+
+	// attributes are set after subscribing, as subscribe fails if an existing subscription has different attributes
+	if len(req.FilterPolicy) > 0 {
+		fp, err := json.Marshal(req.FilterPolicy)
+		if err != nil {
+			return "", err
+		}
+
+		err = s.setSubscriptionAttribute(ctx, *sr.SubscriptionArn, "FilterPolicy", string(fp))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if req.RawDelivery {
+		err = s.setSubscriptionAttribute(ctx, *sr.SubscriptionArn, "RawMessageDelivery", "true")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return *sr.SubscriptionArn, nil
+}
+
+func (s *Service) setSubscriptionAttribute(ctx context.Context, subscriptionARN, name, value string) error {
+	tctx, t := withCallTimer(ctx)
+	_, err := s.snsc.SetSubscriptionAttributes(tctx, &sns.SetSubscriptionAttributesInput{
+		SubscriptionArn: awssdk.String(subscriptionARN),
+		AttributeName:   awssdk.String(name),
+		AttributeValue:  awssdk.String(value),
 	})
+	s.observe(OperationSetSubscriptionAttributes, t)
+	if err != nil {
+		return err
+	}
+
+	s.log("set subscription attribute", "attribute", name, "subscription_arn", subscriptionARN)
+	return nil
+}
+
+func (s *Service) setQueueAttributes(ctx context.Context, queueURL string, attrs map[string]string) error {
+	tctx, t := withCallTimer(ctx)
+	_, err := s.sqsc.SetQueueAttributes(tctx, &sqs.SetQueueAttributesInput{
+		QueueUrl:   awssdk.String(queueURL),
+		Attributes: attrs,
+	})
+	s.observe(OperationSetQueueAttributes, t)
+	return err
+}
+
+// queueAttributes returns the request queue attributes merged with the encryption attributes
+// Attributes managed by the service are excluded so that they cannot be overridden.
+func queueAttributes(req EnsureSubscriptionRequest) map[string]string {
+	qa := make(map[string]string, len(req.Attributes))
+	for k, v := range req.Attributes {
+		switch k {
+		case "Policy", "RedrivePolicy", "FifoQueue":
+			continue
+		default:
+			qa[k] = v
+		}
+	}
+
+	for k, v := range encryptionAttributes(req) {
+		qa[k] = v
+	}
+
+	return qa
+}
+
+// encryptionAttributes returns the queue encryption attributes, which are set rather than specified on creation
+// as create fails if an existing queue has different attributes. A kms key takes precedence over sqs managed keys.
+func encryptionAttributes(req EnsureSubscriptionRequest) map[string]string {
+	switch {
+	case req.KMSKeyID != "":
+		return map[string]string{"KmsMasterKeyId": req.KMSKeyID}
+	case req.ManagedSSE:
+		return map[string]string{"SqsManagedSseEnabled": "true"}
+	default:
+		return nil
+	}
+}
+
+func (s *Service) createQueue(ctx context.Context, queueName string, fifo bool) (string, string, error) {
+	in := &sqs.CreateQueueInput{
+		QueueName: awssdk.String(queueName),
+	}
+	if fifo {
+		in.Attributes = map[string]string{"FifoQueue": "true"}
+	}
+
+	tctx, t := withCallTimer(ctx)
+	cqr, err := s.sqsc.CreateQueue(tctx, in)
+	d := s.observe(OperationCreateQueue, t)
 	if err != nil {
 		return "", "", err
 	}
 
-	qar, err := s.sqsc.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+	tctx, t = withCallTimer(ctx)
+	qar, err := s.sqsc.GetQueueAttributes(tctx, &sqs.GetQueueAttributesInput{
 		QueueUrl:       cqr.QueueUrl,
 		AttributeNames: []types.QueueAttributeName{"QueueArn"},
 	})
+	s.observe(OperationGetQueueAttributes, t)
 	if err != nil {
 		return "", "", err
 	}
 
-	s.log("created queue %s", *cqr.QueueUrl)
+	s.log("created queue", "queue_url", *cqr.QueueUrl, "duration", d)
 
 	return *cqr.QueueUrl, qar.Attributes["QueueArn"], nil
 }
 
-func (s *Service) log(format string, a ...interface{}) {
+func (s *Service) lookupTopic(ctx context.Context, req EnsureTopicRequest) (EnsureTopicResponse, error) {
+	suffix := ":" + req.TopicName
+
+	in := new(sns.ListTopicsInput)
+	for {
+		tctx, t := withCallTimer(ctx)
+		res, err := s.snsc.ListTopics(tctx, in)
+		s.observe(OperationListTopics, t)
+		if err != nil {
+			return EnsureTopicResponse{}, err
+		}
+
+		for _, t := range res.Topics {
+			if ta := awssdk.ToString(t.TopicArn); strings.HasSuffix(ta, suffix) {
+				return EnsureTopicResponse{
+					TopicARN: ta,
+				}, nil
+			}
+		}
+
+		if res.NextToken == nil {
+			return EnsureTopicResponse{}, fmt.Errorf("topic %s: %w", req.TopicName, ErrNotFound)
+		}
+
+		in.NextToken = res.NextToken
+	}
+}
+
+// lookupQueue resolves the existing queue, assuming that the subscription and error queue have been provisioned with it
+func (s *Service) lookupQueue(ctx context.Context, req EnsureSubscriptionRequest) (EnsureSubscriptionResponse, error) {
+	tctx, t := withCallTimer(ctx)
+	res, err := s.sqsc.GetQueueUrl(tctx, &sqs.GetQueueUrlInput{
+		QueueName: awssdk.String(req.QueueName),
+	})
+	s.observe(OperationGetQueueURL, t)
+	if err != nil {
+		if isNotFound(err) {
+			return EnsureSubscriptionResponse{}, fmt.Errorf("queue %s: %w", req.QueueName, ErrNotFound)
+		}
+
+		return EnsureSubscriptionResponse{}, err
+	}
+
+	return EnsureSubscriptionResponse{
+		QueueURL: *res.QueueUrl,
+	}, nil
+}
+
+// SetLookupOnly configures the service to resolve existing topics and queues without creating or modifying them
+// Topics are resolved by name using ListTopics and queues using GetQueueUrl, returning ErrNotFound if they do not exist.
+func (s *Service) SetLookupOnly(v bool) {
+	s.lookupOnly = v
+}
+
+// SetConcurrencyLimit limits the number of concurrent sns and sqs calls made by the service
+// Calls wait for capacity or until their context is done. Limits of zero or less are ignored.
+func (s *Service) SetConcurrencyLimit(snsLimit, sqsLimit int) {
+	if snsLimit > 0 {
+		s.snsc = &limitedSNS{SNS: s.snsc, limiter: make(limiter, snsLimit)}
+	}
+	if sqsLimit > 0 {
+		s.sqsc = &limitedSQS{SQS: s.sqsc, limiter: make(limiter, sqsLimit)}
+	}
+}
+
+// SetObserveFn sets the func that is called with the duration of each aws call made when ensuring infrastructure
+// Durations are observed for failed calls, which allows throttling and network issues to be diagnosed.
+func (s *Service) SetObserveFn(fn func(operation string, d time.Duration)) {
+	s.observeFn = fn
+}
+
+// SetPolicyIDFn sets the func used to generate access policy and statement ids, which defaults to NewPolicyID
+// This allows deterministic policies to be generated, so that they remain stable each time infrastructure is ensured.
+func (s *Service) SetPolicyIDFn(fn func() string) {
+	s.idFn = fn
+}
+
+func (s *Service) observe(operation string, t *callTimer) time.Duration {
+	d := time.Since(t.start)
+	if s.observeFn != nil {
+		s.observeFn(operation, d)
+	}
+
+	return d
+}
+
+func (s *Service) log(msg string, keyvals ...interface{}) {
 	if s.logFn != nil {
-		s.logFn(format, a...)
+		s.logFn(msg, keyvals...)
 	}
 }
+
+func isNotFound(err error) bool {
+	var te *snstypes.NotFoundException
+	var qe *types.QueueDoesNotExist
+	return errors.As(err, &te) || errors.As(err, &qe)
+}
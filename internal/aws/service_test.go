@@ -3,10 +3,14 @@ package aws_test
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/golang/mock/gomock"
 
 	"github.com/stevecallear/pram/internal/assert"
@@ -94,6 +98,138 @@ func TestService_EnsureTopic(t *testing.T) {
 				TopicARN: topicARN,
 			},
 		},
+		{
+			name: "should create fifo topics",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.CreateTopic(gomock.Any(), &sns.CreateTopicInput{
+					Name:       awssdk.String(topicName + ".fifo"),
+					Attributes: map[string]string{"FifoTopic": "true"},
+				}).Return(&sns.CreateTopicOutput{
+					TopicArn: awssdk.String(topicARN + ".fifo"),
+				}, nil).Times(1)
+
+				m.SetTopicAttributes(gomock.Any(), gomock.Any()).
+					Return(new(sns.SetTopicAttributesOutput), nil).Times(1)
+			},
+			input: aws.EnsureTopicRequest{
+				TopicName: topicName + ".fifo",
+				FIFO:      true,
+			},
+			exp: aws.EnsureTopicResponse{
+				TopicARN: topicARN + ".fifo",
+			},
+		},
+		{
+			name: "should return an error if the topic attributes cannot be retrieved",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				gomock.InOrder(
+					m.CreateTopic(gomock.Any(), gomock.Any()).Return(&sns.CreateTopicOutput{
+						TopicArn: awssdk.String(topicARN),
+					}, nil).Times(1),
+					m.GetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1),
+				)
+			},
+			input: aws.EnsureTopicRequest{
+				TopicName:     topicName,
+				DetectCreated: true,
+			},
+			err: true,
+		},
+		{
+			name: "should detect new topics",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				gomock.InOrder(
+					m.CreateTopic(gomock.Any(), gomock.Any()).Return(&sns.CreateTopicOutput{
+						TopicArn: awssdk.String(topicARN),
+					}, nil).Times(1),
+					m.GetTopicAttributes(gomock.Any(), &sns.GetTopicAttributesInput{
+						TopicArn: awssdk.String(topicARN),
+					}).Return(&sns.GetTopicAttributesOutput{
+						Attributes: map[string]string{"Policy": `{"Id":"__default_policy_ID"}`},
+					}, nil).Times(1),
+					m.SetTopicAttributes(gomock.Any(), gomock.Any()).
+						Return(new(sns.SetTopicAttributesOutput), nil).Times(1),
+				)
+			},
+			input: aws.EnsureTopicRequest{
+				TopicName:     topicName,
+				DetectCreated: true,
+			},
+			exp: aws.EnsureTopicResponse{
+				TopicARN: topicARN,
+				Created:  true,
+			},
+		},
+		{
+			name: "should detect existing topics",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				gomock.InOrder(
+					m.CreateTopic(gomock.Any(), gomock.Any()).Return(&sns.CreateTopicOutput{
+						TopicArn: awssdk.String(topicARN),
+					}, nil).Times(1),
+					m.GetTopicAttributes(gomock.Any(), &sns.GetTopicAttributesInput{
+						TopicArn: awssdk.String(topicARN),
+					}).Return(&sns.GetTopicAttributesOutput{
+						Attributes: map[string]string{"Policy": `{"Id":"policyid"}`},
+					}, nil).Times(1),
+					m.SetTopicAttributes(gomock.Any(), gomock.Any()).
+						Return(new(sns.SetTopicAttributesOutput), nil).Times(1),
+				)
+			},
+			input: aws.EnsureTopicRequest{
+				TopicName:     topicName,
+				DetectCreated: true,
+			},
+			exp: aws.EnsureTopicResponse{
+				TopicARN: topicARN,
+				Created:  false,
+			},
+		},
+		{
+			name: "should return an error if the kms key cannot be set",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				gomock.InOrder(
+					m.CreateTopic(gomock.Any(), gomock.Any()).Return(&sns.CreateTopicOutput{
+						TopicArn: awssdk.String(topicARN),
+					}, nil).Times(1),
+					m.SetTopicAttributes(gomock.Any(), gomock.Any()).
+						Return(new(sns.SetTopicAttributesOutput), nil).Times(1),
+					m.SetTopicAttributes(gomock.Any(), gomock.Any()).
+						Return(nil, errors.New("error")).Times(1),
+				)
+			},
+			input: aws.EnsureTopicRequest{
+				TopicName: topicName,
+				KMSKeyID:  "alias/key",
+			},
+			err: true,
+		},
+		{
+			name: "should set the kms key",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				gomock.InOrder(
+					m.CreateTopic(gomock.Any(), &sns.CreateTopicInput{
+						Name: awssdk.String(topicName),
+					}).Return(&sns.CreateTopicOutput{
+						TopicArn: awssdk.String(topicARN),
+					}, nil).Times(1),
+					m.SetTopicAttributes(gomock.Any(), gomock.Any()).
+						Return(new(sns.SetTopicAttributesOutput), nil).Times(1),
+					m.SetTopicAttributes(gomock.Any(), &sns.SetTopicAttributesInput{
+						TopicArn:       awssdk.String(topicARN),
+						AttributeName:  awssdk.String("KmsMasterKeyId"),
+						AttributeValue: awssdk.String("alias/key"),
+					}).Return(new(sns.SetTopicAttributesOutput), nil).Times(1),
+				)
+			},
+			input: aws.EnsureTopicRequest{
+				TopicName: topicName,
+				KMSKeyID:  "alias/key",
+			},
+			exp: aws.EnsureTopicResponse{
+				TopicARN: topicARN,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -113,6 +249,51 @@ func TestService_EnsureTopic(t *testing.T) {
 	}
 }
 
+func TestService_SetObserveFn(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSNSMockRecorder)
+		exp   []string
+	}{
+		{
+			name: "should observe failed operations",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.CreateTopic(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			exp: []string{aws.OperationCreateTopic},
+		},
+		{
+			name: "should observe each operation",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.CreateTopic(gomock.Any(), gomock.Any()).Return(&sns.CreateTopicOutput{
+					TopicArn: awssdk.String(topicARN),
+				}, nil).Times(1)
+				m.SetTopicAttributes(gomock.Any(), gomock.Any()).Return(&sns.SetTopicAttributesOutput{}, nil).Times(1)
+			},
+			exp: []string{aws.OperationCreateTopic, aws.OperationSetTopicAttributes},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			tt.setup(snsc.EXPECT())
+
+			var act []string
+			sut := aws.NewService(snsc, nil, nil)
+			sut.SetObserveFn(func(operation string, _ time.Duration) {
+				act = append(act, operation)
+			})
+
+			sut.EnsureTopic(context.Background(), aws.EnsureTopicRequest{TopicName: topicName})
+			assert.DeepEqual(t, act, tt.exp)
+		})
+	}
+}
+
 func TestService_EnsureSubscription(t *testing.T) {
 	input := aws.EnsureSubscriptionRequest{
 		TopicARN:        topicARN,
@@ -275,7 +456,365 @@ func TestService_EnsureSubscription(t *testing.T) {
 			},
 			input: input,
 			exp: aws.EnsureSubscriptionResponse{
-				QueueURL: queueURL,
+				QueueURL:        queueURL,
+				ErrorQueueURL:   errorQueueURL,
+				ErrorQueueARN:   errorQueueARN,
+				SubscriptionARN: "arn",
+			},
+		},
+		{
+			name: "should create fifo queues",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					sqsc.CreateQueue(gomock.Any(), &sqs.CreateQueueInput{
+						QueueName:  awssdk.String(errorQueueName + ".fifo"),
+						Attributes: map[string]string{"FifoQueue": "true"},
+					}).Return(&sqs.CreateQueueOutput{
+						QueueUrl: awssdk.String(errorQueueURL + ".fifo"),
+					}, nil).Times(1),
+
+					sqsc.GetQueueAttributes(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueAttributesOutput{
+						Attributes: map[string]string{
+							"QueueArn": errorQueueARN + ".fifo",
+						},
+					}, nil).Times(1),
+
+					sqsc.CreateQueue(gomock.Any(), &sqs.CreateQueueInput{
+						QueueName:  awssdk.String(queueName + ".fifo"),
+						Attributes: map[string]string{"FifoQueue": "true"},
+					}).Return(&sqs.CreateQueueOutput{
+						QueueUrl: awssdk.String(queueURL + ".fifo"),
+					}, nil).Times(1),
+
+					sqsc.GetQueueAttributes(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueAttributesOutput{
+						Attributes: map[string]string{
+							"QueueArn": queueARN + ".fifo",
+						},
+					}, nil).Times(1),
+
+					sqsc.SetQueueAttributes(gomock.Any(), gomock.Any()).
+						Return(new(sqs.SetQueueAttributesOutput), nil).Times(1),
+
+					snsc.Subscribe(gomock.Any(), gomock.Any()).Return(&sns.SubscribeOutput{
+						SubscriptionArn: awssdk.String("arn"),
+					}, nil).Times(1),
+				)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN:        topicARN + ".fifo",
+				QueueName:       queueName + ".fifo",
+				ErrorQueueName:  errorQueueName + ".fifo",
+				MaxReceiveCount: 5,
+				FIFO:            true,
+			},
+			exp: aws.EnsureSubscriptionResponse{
+				QueueURL:        queueURL + ".fifo",
+				ErrorQueueURL:   errorQueueURL + ".fifo",
+				ErrorQueueARN:   errorQueueARN + ".fifo",
+				SubscriptionARN: "arn",
+			},
+		},
+		{
+			name: "should set the queue visibility timeout",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				sqsc.CreateQueue(gomock.Any(), gomock.Any()).Return(&sqs.CreateQueueOutput{
+					QueueUrl: awssdk.String(queueURL),
+				}, nil).Times(2)
+
+				sqsc.GetQueueAttributes(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueAttributesOutput{
+					Attributes: map[string]string{
+						"QueueArn": queueARN,
+					},
+				}, nil).Times(2)
+
+				sqsc.SetQueueAttributes(gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, in *sqs.SetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+						if act, exp := in.Attributes["VisibilityTimeout"], "60"; act != exp {
+							t.Errorf("got %s, expected %s", act, exp)
+						}
+						return new(sqs.SetQueueAttributesOutput), nil
+					}).Times(1)
+
+				snsc.Subscribe(gomock.Any(), gomock.Any()).Return(&sns.SubscribeOutput{
+					SubscriptionArn: awssdk.String("arn"),
+				}, nil).Times(1)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN:                 topicARN,
+				QueueName:                queueName,
+				ErrorQueueName:           errorQueueName,
+				MaxReceiveCount:          5,
+				VisibilityTimeoutSeconds: 60,
+			},
+			exp: aws.EnsureSubscriptionResponse{
+				QueueURL:        queueURL,
+				ErrorQueueURL:   queueURL,
+				ErrorQueueARN:   queueARN,
+				SubscriptionARN: "arn",
+			},
+		},
+		{
+			name: "should encrypt the queues using the kms key",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				sqsc.CreateQueue(gomock.Any(), gomock.Any()).Return(&sqs.CreateQueueOutput{
+					QueueUrl: awssdk.String(queueURL),
+				}, nil).Times(2)
+
+				sqsc.GetQueueAttributes(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueAttributesOutput{
+					Attributes: map[string]string{
+						"QueueArn": queueARN,
+					},
+				}, nil).Times(2)
+
+				sqsc.SetQueueAttributes(gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, in *sqs.SetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+						if act, exp := in.Attributes["KmsMasterKeyId"], "alias/key"; act != exp {
+							t.Errorf("got %s, expected %s", act, exp)
+						}
+						return new(sqs.SetQueueAttributesOutput), nil
+					}).Times(2)
+
+				snsc.Subscribe(gomock.Any(), gomock.Any()).Return(&sns.SubscribeOutput{
+					SubscriptionArn: awssdk.String("arn"),
+				}, nil).Times(1)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN:        topicARN,
+				QueueName:       queueName,
+				ErrorQueueName:  errorQueueName,
+				MaxReceiveCount: 5,
+				KMSKeyID:        "alias/key",
+			},
+			exp: aws.EnsureSubscriptionResponse{
+				QueueURL:        queueURL,
+				ErrorQueueURL:   queueURL,
+				ErrorQueueARN:   queueARN,
+				SubscriptionARN: "arn",
+			},
+		},
+		{
+			name: "should encrypt the queues using sqs managed keys",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				sqsc.CreateQueue(gomock.Any(), gomock.Any()).Return(&sqs.CreateQueueOutput{
+					QueueUrl: awssdk.String(queueURL),
+				}, nil).Times(2)
+
+				sqsc.GetQueueAttributes(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueAttributesOutput{
+					Attributes: map[string]string{
+						"QueueArn": queueARN,
+					},
+				}, nil).Times(2)
+
+				sqsc.SetQueueAttributes(gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, in *sqs.SetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+						if act, exp := in.Attributes["SqsManagedSseEnabled"], "true"; act != exp {
+							t.Errorf("got %s, expected %s", act, exp)
+						}
+						return new(sqs.SetQueueAttributesOutput), nil
+					}).Times(2)
+
+				snsc.Subscribe(gomock.Any(), gomock.Any()).Return(&sns.SubscribeOutput{
+					SubscriptionArn: awssdk.String("arn"),
+				}, nil).Times(1)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN:        topicARN,
+				QueueName:       queueName,
+				ErrorQueueName:  errorQueueName,
+				MaxReceiveCount: 5,
+				ManagedSSE:      true,
+			},
+			exp: aws.EnsureSubscriptionResponse{
+				QueueURL:        queueURL,
+				ErrorQueueURL:   queueURL,
+				ErrorQueueARN:   queueARN,
+				SubscriptionARN: "arn",
+			},
+		},
+		{
+			name: "should merge the queue attributes",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				sqsc.CreateQueue(gomock.Any(), gomock.Any()).Return(&sqs.CreateQueueOutput{
+					QueueUrl: awssdk.String(queueURL),
+				}, nil).Times(2)
+
+				sqsc.GetQueueAttributes(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueAttributesOutput{
+					Attributes: map[string]string{
+						"QueueArn": queueARN,
+					},
+				}, nil).Times(2)
+
+				gomock.InOrder(
+					sqsc.SetQueueAttributes(gomock.Any(), gomock.Any()).
+						DoAndReturn(func(_ context.Context, in *sqs.SetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+							exp := map[string]string{
+								"MessageRetentionPeriod": "86400",
+								"DelaySeconds":           "5",
+								"VisibilityTimeout":      "30",
+								"KmsMasterKeyId":         "alias/key",
+							}
+							assert.DeepEqual(t, in.Attributes, exp)
+							return new(sqs.SetQueueAttributesOutput), nil
+						}).Times(1),
+					sqsc.SetQueueAttributes(gomock.Any(), gomock.Any()).
+						DoAndReturn(func(_ context.Context, in *sqs.SetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+							for k, exp := range map[string]string{
+								"MessageRetentionPeriod": "86400",
+								"DelaySeconds":           "5",
+								"KmsMasterKeyId":         "alias/key",
+								"VisibilityTimeout":      "60",
+							} {
+								if act := in.Attributes[k]; act != exp {
+									t.Errorf("got %s, expected %s", act, exp)
+								}
+							}
+							if act := in.Attributes["Policy"]; act == "policy" {
+								t.Errorf("got %s, expected managed policy", act)
+							}
+							if act := in.Attributes["RedrivePolicy"]; act == "redrive" {
+								t.Errorf("got %s, expected managed redrive policy", act)
+							}
+							if _, ok := in.Attributes["FifoQueue"]; ok {
+								t.Error("got FifoQueue, expected none")
+							}
+							return new(sqs.SetQueueAttributesOutput), nil
+						}).Times(1),
+				)
+
+				snsc.Subscribe(gomock.Any(), gomock.Any()).Return(&sns.SubscribeOutput{
+					SubscriptionArn: awssdk.String("arn"),
+				}, nil).Times(1)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN:                 topicARN,
+				QueueName:                queueName,
+				ErrorQueueName:           errorQueueName,
+				MaxReceiveCount:          5,
+				VisibilityTimeoutSeconds: 60,
+				KMSKeyID:                 "alias/key",
+				Attributes: map[string]string{
+					"MessageRetentionPeriod": "86400",
+					"DelaySeconds":           "5",
+					"VisibilityTimeout":      "30",
+					"Policy":                 "policy",
+					"RedrivePolicy":          "redrive",
+					"FifoQueue":              "true",
+				},
+			},
+			exp: aws.EnsureSubscriptionResponse{
+				QueueURL:        queueURL,
+				ErrorQueueURL:   queueURL,
+				ErrorQueueARN:   queueARN,
+				SubscriptionARN: "arn",
+			},
+		},
+		{
+			name: "should return an error if the endpoint cannot be subscribed",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				snsc.Subscribe(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN: topicARN,
+				Protocol: "lambda",
+				Endpoint: "arn:aws:lambda:eu-west-1:111122223333:function:handler",
+			},
+			err: true,
+		},
+		{
+			name: "should subscribe the endpoint for non-sqs protocols",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				snsc.Subscribe(gomock.Any(), &sns.SubscribeInput{
+					Protocol: awssdk.String("lambda"),
+					TopicArn: awssdk.String(topicARN),
+					Endpoint: awssdk.String("arn:aws:lambda:eu-west-1:111122223333:function:handler"),
+				}).Return(&sns.SubscribeOutput{
+					SubscriptionArn: awssdk.String("arn"),
+				}, nil).Times(1)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN: topicARN,
+				Protocol: "lambda",
+				Endpoint: "arn:aws:lambda:eu-west-1:111122223333:function:handler",
+			},
+			exp: aws.EnsureSubscriptionResponse{
+				SubscriptionARN: "arn",
+			},
+		},
+		{
+			name: "should return an error if the filter policy cannot be set",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				snsc.Subscribe(gomock.Any(), gomock.Any()).Return(&sns.SubscribeOutput{
+					SubscriptionArn: awssdk.String("arn"),
+				}, nil).Times(1)
+				snsc.SetSubscriptionAttributes(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN:     topicARN,
+				Protocol:     "lambda",
+				Endpoint:     "arn:aws:lambda:eu-west-1:111122223333:function:handler",
+				FilterPolicy: map[string]interface{}{"region": []string{"eu-west-1"}},
+			},
+			err: true,
+		},
+		{
+			name: "should set the filter policy",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				snsc.Subscribe(gomock.Any(), gomock.Any()).Return(&sns.SubscribeOutput{
+					SubscriptionArn: awssdk.String("arn"),
+				}, nil).Times(1)
+				snsc.SetSubscriptionAttributes(gomock.Any(), &sns.SetSubscriptionAttributesInput{
+					SubscriptionArn: awssdk.String("arn"),
+					AttributeName:   awssdk.String("FilterPolicy"),
+					AttributeValue:  awssdk.String(`{"region":["eu-west-1"]}`),
+				}).Return(&sns.SetSubscriptionAttributesOutput{}, nil).Times(1)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN:     topicARN,
+				Protocol:     "lambda",
+				Endpoint:     "arn:aws:lambda:eu-west-1:111122223333:function:handler",
+				FilterPolicy: map[string]interface{}{"region": []string{"eu-west-1"}},
+			},
+			exp: aws.EnsureSubscriptionResponse{
+				SubscriptionARN: "arn",
+			},
+		},
+		{
+			name: "should enable raw delivery",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				snsc.Subscribe(gomock.Any(), gomock.Any()).Return(&sns.SubscribeOutput{
+					SubscriptionArn: awssdk.String("arn"),
+				}, nil).Times(1)
+				snsc.SetSubscriptionAttributes(gomock.Any(), &sns.SetSubscriptionAttributesInput{
+					SubscriptionArn: awssdk.String("arn"),
+					AttributeName:   awssdk.String("RawMessageDelivery"),
+					AttributeValue:  awssdk.String("true"),
+				}).Return(&sns.SetSubscriptionAttributesOutput{}, nil).Times(1)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN:    topicARN,
+				Endpoint:    "arn:aws:sqs:eu-west-1:111122223333:queue",
+				RawDelivery: true,
+			},
+			exp: aws.EnsureSubscriptionResponse{
+				SubscriptionARN: "arn",
+			},
+		},
+		{
+			name: "should not set the filter policy if it is empty",
+			setup: func(snsc *mocks.MockSNSMockRecorder, sqsc *mocks.MockSQSMockRecorder) {
+				snsc.Subscribe(gomock.Any(), gomock.Any()).Return(&sns.SubscribeOutput{
+					SubscriptionArn: awssdk.String("arn"),
+				}, nil).Times(1)
+				snsc.SetSubscriptionAttributes(gomock.Any(), gomock.Any()).Times(0)
+			},
+			input: aws.EnsureSubscriptionRequest{
+				TopicARN:     topicARN,
+				Protocol:     "lambda",
+				Endpoint:     "arn:aws:lambda:eu-west-1:111122223333:function:handler",
+				FilterPolicy: map[string]interface{}{},
+			},
+			exp: aws.EnsureSubscriptionResponse{
+				SubscriptionARN: "arn",
 			},
 		},
 	}
@@ -297,3 +836,623 @@ func TestService_EnsureSubscription(t *testing.T) {
 		})
 	}
 }
+
+func TestService_SetConcurrencyLimit(t *testing.T) {
+	t.Run("should limit concurrent calls", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var mu sync.Mutex
+		var active, max int
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().GetQueueUrl(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(context.Context, *sqs.GetQueueUrlInput, ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+				mu.Lock()
+				active++
+				if active > max {
+					max = active
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				active--
+				mu.Unlock()
+
+				return &sqs.GetQueueUrlOutput{QueueUrl: awssdk.String(queueURL)}, nil
+			}).Times(5)
+
+		sut := aws.NewService(nil, sqsc, nil)
+		sut.SetConcurrencyLimit(0, 2)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				_, err := sut.GetQueueURL(context.Background(), aws.GetQueueURLRequest{QueueName: queueName})
+				assert.ErrorExists(t, err, false)
+			}()
+		}
+		wg.Wait()
+
+		if max > 2 {
+			t.Errorf("got %d concurrent calls, expected at most 2", max)
+		}
+	})
+
+	t.Run("should not observe the time spent waiting", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		const d = 20 * time.Millisecond
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(context.Context, *sns.CreateTopicInput, ...func(*sns.Options)) (*sns.CreateTopicOutput, error) {
+				time.Sleep(d)
+				return nil, errors.New("error")
+			}).Times(3)
+
+		var mu sync.Mutex
+		var act []time.Duration
+
+		sut := aws.NewService(snsc, nil, nil)
+		sut.SetConcurrencyLimit(1, 0)
+		sut.SetObserveFn(func(_ string, d time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			act = append(act, d)
+		})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sut.EnsureTopic(context.Background(), aws.EnsureTopicRequest{TopicName: topicName})
+			}()
+		}
+		wg.Wait()
+
+		for _, v := range act {
+			if v >= 2*d {
+				t.Errorf("got %v, expected less than %v", v, 2*d)
+			}
+		}
+	})
+
+	t.Run("should return an error if the context is done while waiting", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(context.Context, *sns.CreateTopicInput, ...func(*sns.Options)) (*sns.CreateTopicOutput, error) {
+				close(started)
+				<-release
+				return nil, errors.New("error")
+			}).Times(1)
+
+		sut := aws.NewService(snsc, nil, nil)
+		sut.SetConcurrencyLimit(1, 0)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sut.EnsureTopic(context.Background(), aws.EnsureTopicRequest{TopicName: topicName})
+		}()
+		<-started
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := sut.EnsureTopic(ctx, aws.EnsureTopicRequest{TopicName: topicName})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, expected %v", err, context.Canceled)
+		}
+
+		close(release)
+		<-done
+	})
+}
+
+func TestService_SetLookupOnly(t *testing.T) {
+	t.Run("topics", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			setup func(*mocks.MockSNSMockRecorder)
+			exp   aws.EnsureTopicResponse
+			err   error
+		}{
+			{
+				name: "should return an error if the topics cannot be listed",
+				setup: func(m *mocks.MockSNSMockRecorder) {
+					m.ListTopics(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+				},
+				err: errors.New("error"),
+			},
+			{
+				name: "should return an error if the topic does not exist",
+				setup: func(m *mocks.MockSNSMockRecorder) {
+					m.ListTopics(gomock.Any(), gomock.Any()).Return(&sns.ListTopicsOutput{
+						Topics: []snstypes.Topic{{TopicArn: awssdk.String(topicARN + "-other")}},
+					}, nil).Times(1)
+				},
+				err: aws.ErrNotFound,
+			},
+			{
+				name: "should resolve the topic across pages",
+				setup: func(m *mocks.MockSNSMockRecorder) {
+					gomock.InOrder(
+						m.ListTopics(gomock.Any(), &sns.ListTopicsInput{}).Return(&sns.ListTopicsOutput{
+							Topics:    []snstypes.Topic{{TopicArn: awssdk.String(topicARN + "-other")}},
+							NextToken: awssdk.String("token"),
+						}, nil).Times(1),
+						m.ListTopics(gomock.Any(), &sns.ListTopicsInput{NextToken: awssdk.String("token")}).Return(&sns.ListTopicsOutput{
+							Topics: []snstypes.Topic{{TopicArn: awssdk.String(topicARN)}},
+						}, nil).Times(1),
+					)
+				},
+				exp: aws.EnsureTopicResponse{
+					TopicARN: topicARN,
+				},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				snsc := mocks.NewMockSNS(ctrl)
+				tt.setup(snsc.EXPECT())
+
+				sut := aws.NewService(snsc, nil, nil)
+				sut.SetLookupOnly(true)
+
+				act, err := sut.EnsureTopic(context.Background(), aws.EnsureTopicRequest{TopicName: topicName})
+				assert.ErrorExists(t, err, tt.err != nil)
+				if tt.err == aws.ErrNotFound && !errors.Is(err, aws.ErrNotFound) {
+					t.Errorf("got %v, expected %v", err, aws.ErrNotFound)
+				}
+
+				assert.DeepEqual(t, act, tt.exp)
+			})
+		}
+	})
+
+	t.Run("queues", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			setup func(*mocks.MockSQSMockRecorder)
+			exp   aws.EnsureSubscriptionResponse
+			err   error
+		}{
+			{
+				name: "should return an error if the queue url cannot be retrieved",
+				setup: func(m *mocks.MockSQSMockRecorder) {
+					m.GetQueueUrl(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+				},
+				err: errors.New("error"),
+			},
+			{
+				name: "should return an error if the queue does not exist",
+				setup: func(m *mocks.MockSQSMockRecorder) {
+					m.GetQueueUrl(gomock.Any(), gomock.Any()).Return(nil, &types.QueueDoesNotExist{}).Times(1)
+				},
+				err: aws.ErrNotFound,
+			},
+			{
+				name: "should resolve the queue",
+				setup: func(m *mocks.MockSQSMockRecorder) {
+					m.GetQueueUrl(gomock.Any(), &sqs.GetQueueUrlInput{
+						QueueName: awssdk.String(queueName),
+					}).Return(&sqs.GetQueueUrlOutput{
+						QueueUrl: awssdk.String(queueURL),
+					}, nil).Times(1)
+				},
+				exp: aws.EnsureSubscriptionResponse{
+					QueueURL: queueURL,
+				},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				sqsc := mocks.NewMockSQS(ctrl)
+				tt.setup(sqsc.EXPECT())
+
+				sut := aws.NewService(nil, sqsc, nil)
+				sut.SetLookupOnly(true)
+
+				act, err := sut.EnsureSubscription(context.Background(), aws.EnsureSubscriptionRequest{
+					TopicARN:       topicARN,
+					QueueName:      queueName,
+					ErrorQueueName: errorQueueName,
+				})
+				assert.ErrorExists(t, err, tt.err != nil)
+				if tt.err == aws.ErrNotFound && !errors.Is(err, aws.ErrNotFound) {
+					t.Errorf("got %v, expected %v", err, aws.ErrNotFound)
+				}
+
+				assert.DeepEqual(t, act, tt.exp)
+			})
+		}
+	})
+}
+
+func TestService_DeleteTopic(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSNSMockRecorder)
+		err   bool
+	}{
+		{
+			name: "should return an error if the topics cannot be listed",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.ListTopics(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			err: true,
+		},
+		{
+			name: "should ignore topics that do not exist",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.ListTopics(gomock.Any(), gomock.Any()).Return(new(sns.ListTopicsOutput), nil).Times(1)
+			},
+		},
+		{
+			name: "should return an error if the topic cannot be deleted",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				gomock.InOrder(
+					m.ListTopics(gomock.Any(), gomock.Any()).Return(&sns.ListTopicsOutput{
+						Topics: []snstypes.Topic{{TopicArn: awssdk.String(topicARN)}},
+					}, nil).Times(1),
+					m.DeleteTopic(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1),
+				)
+			},
+			err: true,
+		},
+		{
+			name: "should ignore topics that have already been deleted",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				gomock.InOrder(
+					m.ListTopics(gomock.Any(), gomock.Any()).Return(&sns.ListTopicsOutput{
+						Topics: []snstypes.Topic{{TopicArn: awssdk.String(topicARN)}},
+					}, nil).Times(1),
+					m.DeleteTopic(gomock.Any(), gomock.Any()).Return(nil, &snstypes.NotFoundException{}).Times(1),
+				)
+			},
+		},
+		{
+			name: "should delete the topic",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				gomock.InOrder(
+					m.ListTopics(gomock.Any(), gomock.Any()).Return(&sns.ListTopicsOutput{
+						Topics: []snstypes.Topic{{TopicArn: awssdk.String(topicARN)}},
+					}, nil).Times(1),
+					m.DeleteTopic(gomock.Any(), &sns.DeleteTopicInput{
+						TopicArn: awssdk.String(topicARN),
+					}).Return(new(sns.DeleteTopicOutput), nil).Times(1),
+				)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			tt.setup(snsc.EXPECT())
+
+			sut := aws.NewService(snsc, nil, nil)
+			err := sut.DeleteTopic(context.Background(), aws.DeleteTopicRequest{TopicName: topicName})
+
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+}
+
+func TestService_DeleteQueue(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSQSMockRecorder)
+		err   bool
+	}{
+		{
+			name: "should return an error if the queue url cannot be retrieved",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.GetQueueUrl(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			err: true,
+		},
+		{
+			name: "should ignore queues that do not exist",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.GetQueueUrl(gomock.Any(), gomock.Any()).Return(nil, &types.QueueDoesNotExist{}).Times(1)
+			},
+		},
+		{
+			name: "should return an error if the queue cannot be deleted",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					m.GetQueueUrl(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueUrlOutput{
+						QueueUrl: awssdk.String(queueURL),
+					}, nil).Times(1),
+					m.DeleteQueue(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1),
+				)
+			},
+			err: true,
+		},
+		{
+			name: "should delete the queue",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					m.GetQueueUrl(gomock.Any(), &sqs.GetQueueUrlInput{
+						QueueName: awssdk.String(queueName),
+					}).Return(&sqs.GetQueueUrlOutput{
+						QueueUrl: awssdk.String(queueURL),
+					}, nil).Times(1),
+					m.DeleteQueue(gomock.Any(), &sqs.DeleteQueueInput{
+						QueueUrl: awssdk.String(queueURL),
+					}).Return(new(sqs.DeleteQueueOutput), nil).Times(1),
+				)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			tt.setup(sqsc.EXPECT())
+
+			sut := aws.NewService(nil, sqsc, nil)
+			err := sut.DeleteQueue(context.Background(), aws.DeleteQueueRequest{QueueName: queueName})
+
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+}
+
+func TestService_Unsubscribe(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSNSMockRecorder)
+		err   bool
+	}{
+		{
+			name: "should return an error if the subscription cannot be deleted",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.Unsubscribe(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			err: true,
+		},
+		{
+			name: "should ignore subscriptions that do not exist",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.Unsubscribe(gomock.Any(), gomock.Any()).Return(nil, &snstypes.NotFoundException{}).Times(1)
+			},
+		},
+		{
+			name: "should delete the subscription",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.Unsubscribe(gomock.Any(), &sns.UnsubscribeInput{
+					SubscriptionArn: awssdk.String("arn"),
+				}).Return(new(sns.UnsubscribeOutput), nil).Times(1)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			tt.setup(snsc.EXPECT())
+
+			sut := aws.NewService(snsc, nil, nil)
+			err := sut.Unsubscribe(context.Background(), aws.UnsubscribeRequest{SubscriptionARN: "arn"})
+
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+}
+
+func TestService_PurgeQueue(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSQSMockRecorder)
+		input aws.PurgeQueueRequest
+		err   bool
+	}{
+		{
+			name: "should return an error if the queue url cannot be retrieved",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.GetQueueUrl(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			input: aws.PurgeQueueRequest{
+				QueueName: queueName,
+			},
+			err: true,
+		},
+		{
+			name: "should return an error if the queue cannot be purged",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					m.GetQueueUrl(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueUrlOutput{
+						QueueUrl: awssdk.String(queueURL),
+					}, nil).Times(1),
+
+					m.PurgeQueue(gomock.Any(), gomock.Any()).Return(nil, &types.PurgeQueueInProgress{}).Times(1),
+				)
+			},
+			input: aws.PurgeQueueRequest{
+				QueueName: queueName,
+			},
+			err: true,
+		},
+		{
+			name: "should purge the queue",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					m.GetQueueUrl(gomock.Any(), &sqs.GetQueueUrlInput{
+						QueueName: awssdk.String(queueName),
+					}).Return(&sqs.GetQueueUrlOutput{
+						QueueUrl: awssdk.String(queueURL),
+					}, nil).Times(1),
+
+					m.PurgeQueue(gomock.Any(), &sqs.PurgeQueueInput{
+						QueueUrl: awssdk.String(queueURL),
+					}).Return(new(sqs.PurgeQueueOutput), nil).Times(1),
+				)
+			},
+			input: aws.PurgeQueueRequest{
+				QueueName: queueName,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			tt.setup(sqsc.EXPECT())
+
+			sut := aws.NewService(nil, sqsc, nil)
+			err := sut.PurgeQueue(context.Background(), tt.input)
+
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+}
+
+func TestService_GetTopicARN(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSNSMockRecorder)
+		input aws.GetTopicARNRequest
+		exp   aws.GetTopicARNResponse
+		err   bool
+	}{
+		{
+			name: "should return an error if the topics cannot be listed",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.ListTopics(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			input: aws.GetTopicARNRequest{
+				TopicName: topicName,
+			},
+			err: true,
+		},
+		{
+			name: "should return an error if the topic does not exist",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.ListTopics(gomock.Any(), gomock.Any()).Return(new(sns.ListTopicsOutput), nil).Times(1)
+			},
+			input: aws.GetTopicARNRequest{
+				TopicName: topicName,
+			},
+			err: true,
+		},
+		{
+			name: "should return the topic arn",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.ListTopics(gomock.Any(), gomock.Any()).Return(&sns.ListTopicsOutput{
+					Topics: []snstypes.Topic{{TopicArn: awssdk.String(topicARN)}},
+				}, nil).Times(1)
+			},
+			input: aws.GetTopicARNRequest{
+				TopicName: topicName,
+			},
+			exp: aws.GetTopicARNResponse{
+				TopicARN: topicARN,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			tt.setup(snsc.EXPECT())
+
+			sut := aws.NewService(snsc, nil, nil)
+			act, err := sut.GetTopicARN(context.Background(), tt.input)
+
+			assert.ErrorExists(t, err, tt.err)
+			assert.DeepEqual(t, act, tt.exp)
+		})
+	}
+}
+
+func TestService_GetQueueURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSQSMockRecorder)
+		input aws.GetQueueURLRequest
+		exp   aws.GetQueueURLResponse
+		err   bool
+	}{
+		{
+			name: "should return an error if the queue url cannot be retrieved",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.GetQueueUrl(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			input: aws.GetQueueURLRequest{
+				QueueName: errorQueueName,
+			},
+			err: true,
+		},
+		{
+			name: "should return the queue url",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.GetQueueUrl(gomock.Any(), &sqs.GetQueueUrlInput{
+					QueueName: awssdk.String(errorQueueName),
+				}).Return(&sqs.GetQueueUrlOutput{
+					QueueUrl: awssdk.String(errorQueueURL),
+				}, nil).Times(1)
+			},
+			input: aws.GetQueueURLRequest{
+				QueueName: errorQueueName,
+			},
+			exp: aws.GetQueueURLResponse{
+				QueueURL: errorQueueURL,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			tt.setup(sqsc.EXPECT())
+
+			sut := aws.NewService(nil, sqsc, nil)
+			act, err := sut.GetQueueURL(context.Background(), tt.input)
+
+			assert.ErrorExists(t, err, tt.err)
+			assert.DeepEqual(t, act, tt.exp)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// Store represents a key value store
+	Store interface {
+		GetOrSetTopicARN(ctx context.Context, topicName string, fn func() (string, error)) (string, error)
+		GetOrSetQueueURL(ctx context.Context, queueName string, fn func() (string, error)) (string, error)
+	}
+
+	// CachedStore represents a store that caches values from a remote store in memory
+	CachedStore struct {
+		remote Store
+		ttl    time.Duration
+		items  map[string]cachedItem
+		mu     sync.Mutex
+	}
+
+	cachedItem struct {
+		value   string
+		expires time.Time
+	}
+)
+
+// Cached returns a new store that caches values from the remote store in memory for the specified ttl.
+// The remote store is only consulted on a cache miss, and new values are written through to it.
+// Values are cached indefinitely if ttl is zero or less.
+func Cached(remote Store, ttl time.Duration) *CachedStore {
+	return &CachedStore{
+		remote: remote,
+		ttl:    ttl,
+		items:  map[string]cachedItem{},
+	}
+}
+
+// GetOrSetTopicARN returns the requested topic arn, or sets it if it does not exist
+func (s *CachedStore) GetOrSetTopicARN(ctx context.Context, topicName string, fn func() (string, error)) (string, error) {
+	return s.getOrSet("topic:"+topicName, func() (string, error) {
+		return s.remote.GetOrSetTopicARN(ctx, topicName, fn)
+	})
+}
+
+// GetOrSetQueueURL returns the requested queue url, or sets it if it does not exist
+func (s *CachedStore) GetOrSetQueueURL(ctx context.Context, queueName string, fn func() (string, error)) (string, error) {
+	return s.getOrSet("queue:"+queueName, func() (string, error) {
+		return s.remote.GetOrSetQueueURL(ctx, queueName, fn)
+	})
+}
+
+// Invalidate removes the cached value for the specified key, and from the remote store if it supports invalidation
+func (s *CachedStore) Invalidate(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.items, key)
+	s.mu.Unlock()
+
+	if r, ok := s.remote.(interface {
+		Invalidate(context.Context, string) error
+	}); ok {
+		return r.Invalidate(ctx, key)
+	}
+
+	return nil
+}
+
+func (s *CachedStore) getOrSet(key string, remoteFn func() (string, error)) (string, error) {
+	s.mu.Lock()
+	i, ok := s.items[key]
+	s.mu.Unlock()
+
+	if ok && (i.expires.IsZero() || time.Now().Before(i.expires)) {
+		return i.value, nil
+	}
+
+	v, err := remoteFn()
+	if err != nil {
+		return "", err
+	}
+
+	i = cachedItem{value: v}
+	if s.ttl > 0 {
+		i.expires = time.Now().Add(s.ttl)
+	}
+
+	s.mu.Lock()
+	s.items[key] = i
+	s.mu.Unlock()
+
+	return v, nil
+}
@@ -0,0 +1,123 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stevecallear/pram/internal/assert"
+	"github.com/stevecallear/pram/internal/store"
+)
+
+func TestCachedStore_GetOrSetTopicARN(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		wait    time.Duration
+		valueFn func() (string, error)
+		exp     string
+		calls   int
+		err     bool
+	}{
+		{
+			name: "should return remote errors",
+			valueFn: func() (string, error) {
+				return "", errors.New("error")
+			},
+			calls: 2,
+			err:   true,
+		},
+		{
+			name: "should cache remote values",
+			valueFn: func() (string, error) {
+				return "arn", nil
+			},
+			exp:   "arn",
+			calls: 1,
+		},
+		{
+			name: "should consult the remote once the ttl has expired",
+			ttl:  10 * time.Millisecond,
+			wait: 20 * time.Millisecond,
+			valueFn: func() (string, error) {
+				return "arn", nil
+			},
+			exp:   "arn",
+			calls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := &countingStore{Store: store.NewInMemoryStore(0)}
+			sut := store.Cached(remote, tt.ttl)
+
+			var act string
+			var err error
+			for i := 0; i < 2; i++ {
+				act, err = sut.GetOrSetTopicARN(context.Background(), "topic-name", tt.valueFn)
+				time.Sleep(tt.wait)
+			}
+
+			assert.ErrorExists(t, err, tt.err)
+			assert.DeepEqual(t, act, tt.exp)
+			assert.DeepEqual(t, remote.calls, tt.calls)
+		})
+	}
+}
+
+func TestCachedStore_GetOrSetQueueURL(t *testing.T) {
+	t.Run("should write values through to the remote", func(t *testing.T) {
+		remote := store.NewInMemoryStore(0)
+		sut := store.Cached(remote, 0)
+
+		_, err := sut.GetOrSetQueueURL(context.Background(), "queue-name", func() (string, error) {
+			return "url", nil
+		})
+		assert.ErrorExists(t, err, false)
+
+		act, err := remote.GetOrSetQueueURL(context.Background(), "queue-name", func() (string, error) {
+			return "", errors.New("error")
+		})
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, "url")
+	})
+}
+
+func TestCachedStore_Invalidate(t *testing.T) {
+	t.Run("should invalidate cached and remote values", func(t *testing.T) {
+		remote := &countingStore{Store: store.NewInMemoryStore(0)}
+		sut := store.Cached(remote, 0)
+
+		calls := 0
+		fn := func() (string, error) {
+			calls++
+			return "arn", nil
+		}
+
+		sut.GetOrSetTopicARN(context.Background(), "topic-name", fn)
+		err := sut.Invalidate(context.Background(), "topic:topic-name")
+		assert.ErrorExists(t, err, false)
+		sut.GetOrSetTopicARN(context.Background(), "topic-name", fn)
+
+		assert.DeepEqual(t, remote.calls, 2)
+		assert.DeepEqual(t, calls, 2)
+	})
+}
+
+type countingStore struct {
+	store.Store
+	calls int
+}
+
+func (s *countingStore) Invalidate(ctx context.Context, key string) error {
+	return s.Store.(interface {
+		Invalidate(context.Context, string) error
+	}).Invalidate(ctx, key)
+}
+
+func (s *countingStore) GetOrSetTopicARN(ctx context.Context, topicName string, fn func() (string, error)) (string, error) {
+	s.calls++
+	return s.Store.GetOrSetTopicARN(ctx, topicName, fn)
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// RedisClient represents a redis client
+	// Get must return false if the key does not exist, and SetNX must only set the value if the key does not exist.
+	// DelIfEqual must only delete the key if it holds the specified value, for example using a Lua script.
+	// Values must not expire if ttl is zero or less.
+	RedisClient interface {
+		Get(ctx context.Context, key string) (string, bool, error)
+		Set(ctx context.Context, key, value string, ttl time.Duration) error
+		SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+		Del(ctx context.Context, key string) error
+		DelIfEqual(ctx context.Context, key, value string) (bool, error)
+	}
+
+	// RedisStore represents a redis store
+	RedisStore struct {
+		client       RedisClient
+		prefix       string
+		ttl          time.Duration
+		lockTTL      time.Duration
+		pollInterval time.Duration
+	}
+)
+
+const (
+	// redisLockTTL is the maximum duration that a value fn can hold the key lock
+	redisLockTTL = 30 * time.Second
+
+	// redisPollInterval is the interval at which callers waiting for the key lock check for the value
+	redisPollInterval = 100 * time.Millisecond
+)
+
+// NewRedisStore returns a new redis store that prefixes all keys with the specified prefix
+// Values expire after the specified ttl, or never expire if ttl is zero or less.
+func NewRedisStore(client RedisClient, prefix string, ttl time.Duration) *RedisStore {
+	return &RedisStore{
+		client:       client,
+		prefix:       prefix,
+		ttl:          ttl,
+		lockTTL:      redisLockTTL,
+		pollInterval: redisPollInterval,
+	}
+}
+
+// GetOrSetTopicARN returns the requested topic arn, or sets it if it does not exist
+func (s *RedisStore) GetOrSetTopicARN(ctx context.Context, topicName string, fn func() (string, error)) (string, error) {
+	return s.getOrSet(ctx, s.prefix+"topic:"+topicName, fn)
+}
+
+// GetOrSetQueueURL returns the requested queue url, or sets it if it does not exist
+func (s *RedisStore) GetOrSetQueueURL(ctx context.Context, queueName string, fn func() (string, error)) (string, error) {
+	return s.getOrSet(ctx, s.prefix+"queue:"+queueName, fn)
+}
+
+// Invalidate removes the value for the specified key, so that it is set again on the next request
+// Keys are the topic or queue name prefixed with "topic:" or "queue:" respectively.
+func (s *RedisStore) Invalidate(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.prefix+key)
+}
+
+func (s *RedisStore) getOrSet(ctx context.Context, key string, fn func() (string, error)) (string, error) {
+	v, ok, err := s.client.Get(ctx, key)
+	if err != nil || ok {
+		return v, err
+	}
+
+	// a lock key is set so that callers in other processes wait for the first value fn to complete
+	// rather than invoking it again. This is best effort, as the lock expires if the fn is slow.
+	// The lock holds a token that is unique to this caller, so that a lock that has expired and been
+	// acquired by another caller is not released.
+	lk, tok := key+":lock", uuid.NewString()
+	for {
+		ok, err = s.client.SetNX(ctx, lk, tok, s.lockTTL)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(s.pollInterval):
+		}
+
+		v, ok, err = s.client.Get(ctx, key)
+		if err != nil || ok {
+			return v, err
+		}
+	}
+
+	defer s.client.DelIfEqual(ctx, lk, tok)
+
+	// the value may have been set by the previous lock holder before the lock was acquired
+	v, ok, err = s.client.Get(ctx, key)
+	if err != nil || ok {
+		return v, err
+	}
+
+	v, err = fn()
+	if err != nil {
+		return "", err
+	}
+
+	if err = s.client.Set(ctx, key, v, s.ttl); err != nil {
+		return "", err
+	}
+
+	return v, nil
+}
@@ -0,0 +1,228 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stevecallear/pram/internal/assert"
+	"github.com/stevecallear/pram/internal/store"
+)
+
+func TestRedisStore_GetOrSetTopicARN(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*redisClient)
+		valueFn func() (string, error)
+		exp     string
+		expTTL  time.Duration
+		err     bool
+	}{
+		{
+			name: "should return client errors",
+			setup: func(c *redisClient) {
+				c.err = errors.New("error")
+			},
+			valueFn: func() (string, error) {
+				return "not expected", nil
+			},
+			err: true,
+		},
+		{
+			name: "should return the value if the key exists",
+			setup: func(c *redisClient) {
+				c.values["prefix:topic:topic-name"] = "expected"
+			},
+			valueFn: func() (string, error) {
+				return "not expected", nil
+			},
+			exp: "expected",
+		},
+		{
+			name:  "should return value fn errors",
+			setup: func(*redisClient) {},
+			valueFn: func() (string, error) {
+				return "", errors.New("error")
+			},
+			err: true,
+		},
+		{
+			name:  "should set the value with the ttl if the key does not exist",
+			setup: func(*redisClient) {},
+			valueFn: func() (string, error) {
+				return "expected", nil
+			},
+			exp:    "expected",
+			expTTL: time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newRedisClient()
+			tt.setup(c)
+
+			sut := store.NewRedisStore(c, "prefix:", time.Hour)
+
+			act, err := sut.GetOrSetTopicARN(context.Background(), "topic-name", tt.valueFn)
+			assert.ErrorExists(t, err, tt.err)
+			assert.DeepEqual(t, act, tt.exp)
+			assert.DeepEqual(t, c.ttls["prefix:topic:topic-name"], tt.expTTL)
+
+			if _, ok := c.values["prefix:topic:topic-name:lock"]; ok {
+				t.Error("got lock, expected it to be released")
+			}
+		})
+	}
+}
+
+func TestRedisStore_GetOrSetQueueURL(t *testing.T) {
+	t.Run("should set the value if the key does not exist", func(t *testing.T) {
+		c := newRedisClient()
+		sut := store.NewRedisStore(c, "prefix:", 0)
+
+		act, err := sut.GetOrSetQueueURL(context.Background(), "queue-name", func() (string, error) {
+			return "expected", nil
+		})
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, "expected")
+		assert.DeepEqual(t, c.values["prefix:queue:queue-name"], "expected")
+	})
+}
+
+func TestRedisStore_Invalidate(t *testing.T) {
+	t.Run("should delete the prefixed key", func(t *testing.T) {
+		c := newRedisClient()
+		c.values["prefix:topic:topic-name"] = "value"
+		c.values["prefix:queue:queue-name"] = "value"
+
+		sut := store.NewRedisStore(c, "prefix:", 0)
+		err := sut.Invalidate(context.Background(), "topic:topic-name")
+		assert.ErrorExists(t, err, false)
+
+		assert.DeepEqual(t, c.values, map[string]string{"prefix:queue:queue-name": "value"})
+	})
+
+	t.Run("should return client errors", func(t *testing.T) {
+		c := newRedisClient()
+		c.err = errors.New("error")
+
+		sut := store.NewRedisStore(c, "prefix:", 0)
+		err := sut.Invalidate(context.Background(), "topic:topic-name")
+		assert.ErrorExists(t, err, true)
+	})
+}
+
+func TestRedisStore_Concurrency(t *testing.T) {
+	t.Run("should only invoke the value fn once for concurrent callers", func(t *testing.T) {
+		c := newRedisClient()
+
+		var n int32
+		fn := func() (string, error) {
+			atomic.AddInt32(&n, 1)
+			time.Sleep(50 * time.Millisecond)
+			return "value", nil
+		}
+
+		wg := new(sync.WaitGroup)
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// separate stores simulate callers in separate processes
+				sut := store.NewRedisStore(c, "", 0)
+				act, err := sut.GetOrSetTopicARN(context.Background(), "topic-name", fn)
+				assert.ErrorExists(t, err, false)
+				assert.DeepEqual(t, act, "value")
+			}()
+		}
+
+		wg.Wait()
+
+		if act := atomic.LoadInt32(&n); act != 1 {
+			t.Errorf("got %d, expected 1", act)
+		}
+	})
+
+	t.Run("should not release a lock acquired by another caller", func(t *testing.T) {
+		c := newRedisClient()
+		sut := store.NewRedisStore(c, "", 0)
+
+		act, err := sut.GetOrSetTopicARN(context.Background(), "topic-name", func() (string, error) {
+			// simulate the lock expiring and being acquired by another caller
+			c.Del(context.Background(), "topic:topic-name:lock")
+			c.SetNX(context.Background(), "topic:topic-name:lock", "other", 0)
+			return "value", nil
+		})
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, "value")
+		assert.DeepEqual(t, c.values["topic:topic-name:lock"], "other")
+	})
+}
+
+type redisClient struct {
+	mu     sync.Mutex
+	values map[string]string
+	ttls   map[string]time.Duration
+	err    error
+}
+
+func newRedisClient() *redisClient {
+	return &redisClient{
+		values: map[string]string{},
+		ttls:   map[string]time.Duration{},
+	}
+}
+
+func (c *redisClient) Get(_ context.Context, key string) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[key]
+	return v, ok, c.err
+}
+
+func (c *redisClient) Set(_ context.Context, key, value string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] = value
+	c.ttls[key] = ttl
+	return c.err
+}
+
+func (c *redisClient) SetNX(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.values[key]; ok {
+		return false, c.err
+	}
+
+	c.values[key] = value
+	return true, c.err
+}
+
+func (c *redisClient) Del(_ context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.values, key)
+	return c.err
+}
+
+func (c *redisClient) DelIfEqual(_ context.Context, key, value string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if v, ok := c.values[key]; !ok || v != value {
+		return false, c.err
+	}
+
+	delete(c.values, key)
+	return true, c.err
+}
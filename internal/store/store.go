@@ -1,14 +1,66 @@
 package store
 
 import (
+	"container/list"
 	"context"
+	"encoding/json"
+	"io"
+	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type (
+	// InMemoryStore represents an in-memory store
+	InMemoryStore struct {
+		maxSize int
+		ttl     time.Duration
+		items   map[string]*list.Element
+		order   *list.List
+		group   singleflight.Group
+		mu      sync.Mutex
+	}
+
+	// InMemoryStoreOptions represents a set of in-memory store options
+	InMemoryStoreOptions struct {
+		TTL time.Duration
+	}
+
+	entry struct {
+		key     string
+		value   string
+		expires time.Time
+	}
+
+	snapshotEntry struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
 )
 
-// InMemoryStore represents an in-memory store
-type InMemoryStore struct {
-	items map[string]string
-	mu    sync.RWMutex
+// NewInMemoryStore returns a new in-memory store that holds at most maxSize items,
+// evicting the least recently used item once the limit is reached.
+// The store is unbounded if maxSize is zero or less.
+func NewInMemoryStore(maxSize int, optFns ...func(*InMemoryStoreOptions)) *InMemoryStore {
+	var o InMemoryStoreOptions
+	for _, fn := range optFns {
+		fn(&o)
+	}
+
+	return &InMemoryStore{
+		maxSize: maxSize,
+		ttl:     o.TTL,
+	}
+}
+
+// WithTTL configures the store to expire values after the specified duration, so that they are ensured again
+// This allows topics and queues that are deleted out-of-band to be recreated. Values never expire if ttl is zero or less.
+func WithTTL(ttl time.Duration) func(*InMemoryStoreOptions) {
+	return func(o *InMemoryStoreOptions) {
+		o.TTL = ttl
+	}
 }
 
 // GetOrSetTopicARN returns the requested topic arn, or sets it if it does not exist
@@ -21,31 +73,133 @@ func (s *InMemoryStore) GetOrSetQueueURL(ctx context.Context, queueName string,
 	return s.getOrSet("queue:"+queueName, fn)
 }
 
+// GetOrSetMessageID returns the message id for the specified idempotency key, or sets it if it does not exist
+func (s *InMemoryStore) GetOrSetMessageID(ctx context.Context, key string, fn func() (string, error)) (string, error) {
+	return s.getOrSet("message:"+key, fn)
+}
+
+// Count returns the number of stored topics and queues
+func (s *InMemoryStore) Count() (topics int, queues int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range s.items {
+		if e.Value.(*entry).expired(now) {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(k, "topic:"):
+			topics++
+		case strings.HasPrefix(k, "queue:"):
+			queues++
+		}
+	}
+
+	return topics, queues
+}
+
+// Snapshot writes the stored topics and queues to the specified writer, allowing them to be restored on startup
+// Message ids are not included, as idempotency keys are only relevant to the current process.
+func (s *InMemoryStore) Snapshot(w io.Writer) error {
+	s.mu.Lock()
+
+	// entries are written from least to most recently used, so that restoring preserves the eviction order
+	es := []snapshotEntry{}
+	if s.order != nil {
+		now := time.Now()
+		for e := s.order.Back(); e != nil; e = e.Prev() {
+			v := e.Value.(*entry)
+			if v.expired(now) {
+				continue
+			}
+
+			if strings.HasPrefix(v.key, "topic:") || strings.HasPrefix(v.key, "queue:") {
+				es = append(es, snapshotEntry{Key: v.key, Value: v.value})
+			}
+		}
+	}
+
+	s.mu.Unlock()
+
+	return json.NewEncoder(w).Encode(es)
+}
+
+// Restore reads topics and queues from a snapshot written by Snapshot, replacing any existing values
+func (s *InMemoryStore) Restore(r io.Reader) error {
+	var es []snapshotEntry
+	if err := json.NewDecoder(r).Decode(&es); err != nil {
+		return err
+	}
+
+	for _, e := range es {
+		s.set(e.Key, e.Value)
+	}
+
+	return nil
+}
+
+// Invalidate removes the value for the specified key, so that it is set again on the next request
+// Keys are the topic or queue name prefixed with "topic:" or "queue:" respectively.
+func (s *InMemoryStore) Invalidate(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		s.order.Remove(e)
+		delete(s.items, key)
+	}
+
+	return nil
+}
+
 func (s *InMemoryStore) getOrSet(key string, fn func() (string, error)) (string, error) {
 	v, ok := s.get(key)
 	if ok {
 		return v, nil
 	}
 
-	v, err := fn()
+	// concurrent callers for the same key share the result of the first value fn rather than invoking it again
+	// the result is returned directly, so it does not depend on the value remaining in the store
+	r, err, _ := s.group.Do(key, func() (interface{}, error) {
+		// a previous call may have set the value since the initial check
+		if v, ok := s.get(key); ok {
+			return v, nil
+		}
+
+		v, err := fn()
+		if err != nil {
+			return "", err
+		}
+
+		s.set(key, v)
+		return v, nil
+	})
 	if err != nil {
 		return "", err
 	}
 
-	s.set(key, v)
-	return v, nil
+	return r.(string), nil
 }
 
 func (s *InMemoryStore) get(key string) (string, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if s.items == nil {
+	e, ok := s.items[key]
+	if !ok {
+		return "", false
+	}
+
+	if e.Value.(*entry).expired(time.Now()) {
+		s.order.Remove(e)
+		delete(s.items, key)
 		return "", false
 	}
 
-	v, ok := s.items[key]
-	return v, ok
+	s.order.MoveToFront(e)
+	return e.Value.(*entry).value, true
 }
 
 func (s *InMemoryStore) set(key, value string) {
@@ -53,8 +207,31 @@ func (s *InMemoryStore) set(key, value string) {
 	defer s.mu.Unlock()
 
 	if s.items == nil {
-		s.items = make(map[string]string)
+		s.items = make(map[string]*list.Element)
+		s.order = list.New()
 	}
 
-	s.items[key] = value
+	var exp time.Time
+	if s.ttl > 0 {
+		exp = time.Now().Add(s.ttl)
+	}
+
+	if e, ok := s.items[key]; ok {
+		v := e.Value.(*entry)
+		v.value, v.expires = value, exp
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.items[key] = s.order.PushFront(&entry{key: key, value: value, expires: exp})
+
+	if s.maxSize > 0 && s.order.Len() > s.maxSize {
+		e := s.order.Back()
+		s.order.Remove(e)
+		delete(s.items, e.Value.(*entry).key)
+	}
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
 }
@@ -1,9 +1,14 @@
 package store_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stevecallear/pram/internal/assert"
 	"github.com/stevecallear/pram/internal/store"
@@ -122,3 +127,327 @@ func TestInMemoryStore_GetOrSetQueueURL(t *testing.T) {
 		})
 	}
 }
+
+func TestInMemoryStore_GetOrSetMessageID(t *testing.T) {
+	t.Run("should return the value if the key exists", func(t *testing.T) {
+		sut := new(store.InMemoryStore)
+		sut.GetOrSetMessageID(context.Background(), "key", func() (string, error) {
+			return "expected", nil
+		})
+
+		act, err := sut.GetOrSetMessageID(context.Background(), "key", func() (string, error) {
+			return "not expected", nil
+		})
+		assert.ErrorExists(t, err, false)
+
+		if exp := "expected"; act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+	})
+
+	t.Run("should not collide with topic keys", func(t *testing.T) {
+		sut := new(store.InMemoryStore)
+		sut.GetOrSetTopicARN(context.Background(), "key", func() (string, error) {
+			return "not expected", nil
+		})
+
+		act, err := sut.GetOrSetMessageID(context.Background(), "key", func() (string, error) {
+			return "expected", nil
+		})
+		assert.ErrorExists(t, err, false)
+
+		if exp := "expected"; act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+	})
+}
+
+func TestInMemoryStore_Count(t *testing.T) {
+	t.Run("should return the topic and queue counts", func(t *testing.T) {
+		fn := func() (string, error) {
+			return "value", nil
+		}
+
+		sut := new(store.InMemoryStore)
+		sut.GetOrSetTopicARN(context.Background(), "topic-a", fn)
+		sut.GetOrSetTopicARN(context.Background(), "topic-b", fn)
+		sut.GetOrSetQueueURL(context.Background(), "queue-a", fn)
+
+		topics, queues := sut.Count()
+		if topics != 2 || queues != 1 {
+			t.Errorf("got %d/%d, expected 2/1", topics, queues)
+		}
+	})
+}
+
+func TestInMemoryStore_Concurrency(t *testing.T) {
+	t.Run("should invoke the value fn once per key", func(t *testing.T) {
+		const n = 10
+
+		sut := new(store.InMemoryStore)
+
+		var calls int32
+		fn := func() (string, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(10 * time.Millisecond)
+			return "value", nil
+		}
+
+		wg := new(sync.WaitGroup)
+		wg.Add(n)
+
+		for i := 0; i < n; i++ {
+			go func() {
+				defer wg.Done()
+
+				act, err := sut.GetOrSetTopicARN(context.Background(), "topic-name", fn)
+				assert.ErrorExists(t, err, false)
+
+				if act != "value" {
+					t.Errorf("got %s, expected value", act)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if act := atomic.LoadInt32(&calls); act != 1 {
+			t.Errorf("got %d, expected 1", act)
+		}
+	})
+
+	t.Run("should return the value to waiting callers if it expires before they resume", func(t *testing.T) {
+		const n = 10
+
+		sut := store.NewInMemoryStore(0, store.WithTTL(time.Nanosecond))
+
+		var calls int32
+		fn := func() (string, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(10 * time.Millisecond)
+			return "value", nil
+		}
+
+		wg := new(sync.WaitGroup)
+		wg.Add(n)
+
+		for i := 0; i < n; i++ {
+			go func() {
+				defer wg.Done()
+
+				act, err := sut.GetOrSetTopicARN(context.Background(), "topic-name", fn)
+				assert.ErrorExists(t, err, false)
+
+				if act != "value" {
+					t.Errorf("got %s, expected value", act)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if act := atomic.LoadInt32(&calls); act != 1 {
+			t.Errorf("got %d, expected 1", act)
+		}
+	})
+
+	t.Run("should invoke the value fn again after an error", func(t *testing.T) {
+		sut := new(store.InMemoryStore)
+
+		_, err := sut.GetOrSetTopicARN(context.Background(), "topic-name", func() (string, error) {
+			return "", errors.New("error")
+		})
+		assert.ErrorExists(t, err, true)
+
+		act, err := sut.GetOrSetTopicARN(context.Background(), "topic-name", func() (string, error) {
+			return "value", nil
+		})
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, "value")
+	})
+}
+
+func TestInMemoryStore_MaxSize(t *testing.T) {
+	t.Run("should evict the least recently used item", func(t *testing.T) {
+		sut := store.NewInMemoryStore(2)
+
+		for _, k := range []string{"a", "b", "a", "c"} {
+			sut.GetOrSetTopicARN(context.Background(), k, func() (string, error) {
+				return k, nil
+			})
+		}
+
+		var calls []string
+		for _, k := range []string{"c", "a", "b"} {
+			k := k
+			sut.GetOrSetTopicARN(context.Background(), k, func() (string, error) {
+				calls = append(calls, k)
+				return k, nil
+			})
+		}
+
+		// b was evicted when c was set, as a had been used more recently
+		assert.DeepEqual(t, calls, []string{"b"})
+
+		topics, _ := sut.Count()
+		if topics != 2 {
+			t.Errorf("got %d, expected 2", topics)
+		}
+	})
+}
+
+func TestInMemoryStore_Snapshot(t *testing.T) {
+	t.Run("should restore topics and queues", func(t *testing.T) {
+		src := new(store.InMemoryStore)
+		src.GetOrSetTopicARN(context.Background(), "topic-name", func() (string, error) {
+			return "topic-arn", nil
+		})
+		src.GetOrSetQueueURL(context.Background(), "queue-name", func() (string, error) {
+			return "queue-url", nil
+		})
+		src.GetOrSetMessageID(context.Background(), "key", func() (string, error) {
+			return "message-id", nil
+		})
+
+		buf := new(bytes.Buffer)
+		err := src.Snapshot(buf)
+		assert.ErrorExists(t, err, false)
+
+		sut := new(store.InMemoryStore)
+		err = sut.Restore(buf)
+		assert.ErrorExists(t, err, false)
+
+		fn := func() (string, error) {
+			return "", errors.New("not restored")
+		}
+
+		ta, err := sut.GetOrSetTopicARN(context.Background(), "topic-name", fn)
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, ta, "topic-arn")
+
+		qu, err := sut.GetOrSetQueueURL(context.Background(), "queue-name", fn)
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, qu, "queue-url")
+
+		_, err = sut.GetOrSetMessageID(context.Background(), "key", fn)
+		assert.ErrorExists(t, err, true)
+	})
+
+	t.Run("should preserve the eviction order", func(t *testing.T) {
+		src := new(store.InMemoryStore)
+		for _, k := range []string{"a", "b", "a"} {
+			src.GetOrSetTopicARN(context.Background(), k, func() (string, error) {
+				return k, nil
+			})
+		}
+
+		buf := new(bytes.Buffer)
+		err := src.Snapshot(buf)
+		assert.ErrorExists(t, err, false)
+
+		sut := store.NewInMemoryStore(2)
+		err = sut.Restore(buf)
+		assert.ErrorExists(t, err, false)
+
+		sut.GetOrSetTopicARN(context.Background(), "c", func() (string, error) {
+			return "c", nil
+		})
+
+		var calls []string
+		for _, k := range []string{"a", "b"} {
+			k := k
+			sut.GetOrSetTopicARN(context.Background(), k, func() (string, error) {
+				calls = append(calls, k)
+				return k, nil
+			})
+		}
+
+		// b was least recently used in the source store, so is evicted when c is set
+		assert.DeepEqual(t, calls, []string{"b"})
+	})
+
+	t.Run("should return an error if the snapshot is invalid", func(t *testing.T) {
+		sut := new(store.InMemoryStore)
+		err := sut.Restore(strings.NewReader("invalid"))
+		assert.ErrorExists(t, err, true)
+	})
+}
+
+func TestInMemoryStore_TTL(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		wait  time.Duration
+		calls int
+	}{
+		{
+			name:  "should not expire values if the ttl is zero",
+			wait:  20 * time.Millisecond,
+			calls: 1,
+		},
+		{
+			name:  "should not expire values before the ttl",
+			ttl:   time.Hour,
+			calls: 1,
+		},
+		{
+			name:  "should expire values after the ttl",
+			ttl:   10 * time.Millisecond,
+			wait:  20 * time.Millisecond,
+			calls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sut := store.NewInMemoryStore(0, store.WithTTL(tt.ttl))
+
+			calls := 0
+			for i := 0; i < 2; i++ {
+				act, err := sut.GetOrSetQueueURL(context.Background(), "queue-name", func() (string, error) {
+					calls++
+					return "queue-url", nil
+				})
+				assert.ErrorExists(t, err, false)
+				assert.DeepEqual(t, act, "queue-url")
+
+				time.Sleep(tt.wait)
+			}
+
+			assert.DeepEqual(t, calls, tt.calls)
+		})
+	}
+
+	t.Run("should exclude expired values from the count", func(t *testing.T) {
+		sut := store.NewInMemoryStore(0, store.WithTTL(10*time.Millisecond))
+		sut.GetOrSetTopicARN(context.Background(), "topic-name", func() (string, error) {
+			return "topic-arn", nil
+		})
+
+		time.Sleep(20 * time.Millisecond)
+
+		topics, _ := sut.Count()
+		assert.DeepEqual(t, topics, 0)
+	})
+}
+
+func TestInMemoryStore_Invalidate(t *testing.T) {
+	t.Run("should set the value again once invalidated", func(t *testing.T) {
+		sut := new(store.InMemoryStore)
+		sut.GetOrSetTopicARN(context.Background(), "topic-name", func() (string, error) {
+			return "stale", nil
+		})
+
+		assert.ErrorExists(t, sut.Invalidate(context.Background(), "topic:topic-name"), false)
+		assert.ErrorExists(t, sut.Invalidate(context.Background(), "topic:unknown"), false)
+
+		act, err := sut.GetOrSetTopicARN(context.Background(), "topic-name", func() (string, error) {
+			return "expected", nil
+		})
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, "expected")
+
+		topics, _ := sut.Count()
+		assert.DeepEqual(t, topics, 1)
+	})
+}
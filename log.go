@@ -1,5 +1,10 @@
 package pram
 
+import (
+	"fmt"
+	"strings"
+)
+
 type (
 	// Logger represents a logger
 	Logger interface {
@@ -7,10 +12,19 @@ type (
 		Printf(format string, a ...interface{})
 	}
 
+	// StructuredLogger represents a logger that accepts a message with alternating key/value fields
+	// *slog.Logger satisfies the interface.
+	StructuredLogger interface {
+		Info(msg string, args ...interface{})
+	}
+
 	noopLogger struct{}
 )
 
-var logger Logger = new(noopLogger)
+var (
+	logger           Logger = new(noopLogger)
+	structuredLogger StructuredLogger
+)
 
 // SetLogger sets the logger
 func SetLogger(l Logger) {
@@ -20,6 +34,13 @@ func SetLogger(l Logger) {
 	logger = l
 }
 
+// SetStructuredLogger sets the structured logger
+// Once set, library logs are written to the structured logger instead of the logger specified using SetLogger.
+// A nil logger restores the default.
+func SetStructuredLogger(l StructuredLogger) {
+	structuredLogger = l
+}
+
 // Log logs the input to the configured logger
 func Log(v ...interface{}) {
 	logger.Print(v...)
@@ -30,6 +51,23 @@ func Logf(format string, a ...interface{}) {
 	logger.Printf(format, a...)
 }
 
+// logw logs the message and key/value fields to the configured structured logger
+// If no structured logger is configured, the fields are appended to the message and written using Logf.
+func logw(msg string, keyvals ...interface{}) {
+	if structuredLogger != nil {
+		structuredLogger.Info(msg, keyvals...)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+
+	Logf("%s", b.String())
+}
+
 func (l *noopLogger) Print(v ...interface{}) {}
 
 func (l *noopLogger) Printf(format string, a ...interface{}) {}
@@ -2,10 +2,19 @@ package pram_test
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/protobuf/proto"
+
 	"github.com/stevecallear/pram"
+	"github.com/stevecallear/pram/internal/assert"
+	"github.com/stevecallear/pram/mocks"
+	"github.com/stevecallear/pram/proto/testpb"
 )
 
 func TestLog(t *testing.T) {
@@ -45,3 +54,112 @@ func TestLogf(t *testing.T) {
 		}
 	})
 }
+
+func TestSetStructuredLogger(t *testing.T) {
+	t.Run("should not panic if a nil logger is used", func(t *testing.T) {
+		pram.SetStructuredLogger(nil)
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{MessageId: aws.String("messageid")}, nil).Times(1)
+
+		p := pram.NewPublisher(snsc, withTestTopicARN)
+		_, err := p.Publish(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+	})
+
+	t.Run("should log the message fields", func(t *testing.T) {
+		l := new(structuredLogger)
+		pram.SetStructuredLogger(l)
+		defer pram.SetStructuredLogger(nil)
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{MessageId: aws.String("messageid")}, nil).Times(1)
+
+		p := pram.NewPublisher(snsc, withTestTopicARN)
+		_, err := p.Publish(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		assert.DeepEqual(t, l.entries, []structuredEntry{{
+			msg: "published message",
+			fields: map[string]interface{}{
+				"message_id":   "messageid",
+				"message_type": "pram.test.Message",
+				"topic_arn":    "topic",
+			},
+		}})
+	})
+
+	t.Run("should write fields to the logger if no structured logger is set", func(t *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		pram.SetLogger(log.New(buf, "", 0))
+		defer pram.SetLogger(nil)
+		pram.SetStructuredLogger(nil)
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{MessageId: aws.String("messageid")}, nil).Times(1)
+
+		p := pram.NewPublisher(snsc, withTestTopicARN)
+		_, err := p.Publish(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		exp := "published message message_id=messageid message_type=pram.test.Message topic_arn=topic\n"
+		if act := buf.String(); act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+	})
+
+	t.Run("should not write to the logger if a structured logger is set", func(t *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		pram.SetLogger(log.New(buf, "", 0))
+		defer pram.SetLogger(nil)
+
+		pram.SetStructuredLogger(new(structuredLogger))
+		defer pram.SetStructuredLogger(nil)
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{MessageId: aws.String("messageid")}, nil).Times(1)
+
+		p := pram.NewPublisher(snsc, withTestTopicARN)
+		_, err := p.Publish(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, buf.String(), "")
+	})
+}
+
+type (
+	structuredLogger struct {
+		entries []structuredEntry
+	}
+
+	structuredEntry struct {
+		msg    string
+		fields map[string]interface{}
+	}
+)
+
+func (l *structuredLogger) Info(msg string, args ...interface{}) {
+	e := structuredEntry{msg: msg, fields: map[string]interface{}{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		e.fields[args[i].(string)] = args[i+1]
+	}
+
+	l.entries = append(l.entries, e)
+}
+
+func withTestTopicARN(o *pram.PublisherOptions) {
+	o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+		return "topic", nil
+	}
+}
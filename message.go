@@ -1,7 +1,14 @@
 package pram
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,10 +22,23 @@ import (
 type (
 	// Metadata represents message metadata
 	Metadata struct {
-		ID            string
-		Type          string
-		CorrelationID string
-		Timestamp     time.Time
+		ID                     string
+		Type                   string
+		CorrelationID          string
+		Timestamp              time.Time
+		Headers                map[string]string
+		Attributes             map[string]Attribute
+		MessageGroupID         string
+		MessageDeduplicationID string
+		ReceiveCount           int
+		TraceContext           map[string]string
+	}
+
+	// Attribute represents a typed message attribute
+	Attribute struct {
+		DataType    string
+		StringValue string
+		BinaryValue []byte
 	}
 
 	// Message represents a message
@@ -26,33 +46,95 @@ type (
 		Payload proto.Message
 		Metadata
 	}
+
+	// correlationIDKey is the context key for the correlation id
+	correlationIDKey struct{}
 )
 
+// ErrChecksumMismatch is returned if a message payload does not match the checksum in the envelope
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// crcTable is the crc32 table used for payload checksums
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// idGenerator and clock hold the funcs set by SetIDGenerator and SetClock, and are empty until either is called
+var idGenerator, clock atomic.Value
+
+// SetIDGenerator sets the func used to generate message ids, which defaults to a random uuid
+// This allows deterministic ids to be generated in tests. A nil func restores the default.
+// It is safe to call concurrently with publishes, but applies to the whole package, so tests that
+// set it should not run in parallel with other tests that generate messages.
+func SetIDGenerator(fn func() string) {
+	if fn == nil {
+		fn = uuid.NewString
+	}
+	idGenerator.Store(fn)
+}
+
+// SetClock sets the func used to generate message timestamps, which defaults to the current time
+// This allows deterministic timestamps to be generated in tests. A nil func restores the default.
+// It is safe to call concurrently with publishes, but applies to the whole package, so tests that
+// set it should not run in parallel with other tests that generate messages.
+func SetClock(fn func() time.Time) {
+	if fn == nil {
+		fn = time.Now
+	}
+	clock.Store(fn)
+}
+
+func newMessageID() string {
+	if fn, ok := idGenerator.Load().(func() string); ok {
+		return fn()
+	}
+
+	return uuid.NewString()
+}
+
+func messageTime() time.Time {
+	if fn, ok := clock.Load().(func() time.Time); ok {
+		return fn()
+	}
+
+	return time.Now()
+}
+
+// Number returns the attribute value as a number
+func (a Attribute) Number() (float64, error) {
+	return strconv.ParseFloat(a.StringValue, 64)
+}
+
 // MessageName returns the message name with hyphen separation,
 // e.g. my.package.MessageName -> my-package-MessageName
 func MessageName(m proto.Message) string {
 	return strings.ReplaceAll(string(m.ProtoReflect().Descriptor().FullName()), ".", "-")
 }
 
-// Marshal marshals the specified message
+// Marshal marshals the specified message using the default protobuf codec
 func Marshal(m proto.Message, optFns ...func(*Metadata)) ([]byte, error) {
-	wm, err := wrap(m, optFns)
-	if err != nil {
-		return nil, err
-	}
-
-	return proto.Marshal(wm)
+	return ProtoCodec{}.Marshal(Message{
+		Payload:  m,
+		Metadata: newMetadata(m, optFns),
+	})
 }
 
-// Unmarshal unmarshals the specified message
+// Unmarshal unmarshals the specified message using the default protobuf codec
 func Unmarshal(b []byte, m proto.Message) (Message, error) {
-	wm := new(prampb.Message)
-	err := proto.Unmarshal(b, wm)
-	if err != nil {
-		return Message{}, err
+	return ProtoCodec{}.Unmarshal(b, m)
+}
+
+// WithID sets the message id, which is otherwise generated
+// This allows a known id to be used for deduplication or replay.
+func WithID(id string) func(*Metadata) {
+	return func(md *Metadata) {
+		md.ID = id
 	}
+}
 
-	return unwrap(wm, m)
+// WithTimestamp sets the message timestamp, which otherwise defaults to the current time
+func WithTimestamp(t time.Time) func(*Metadata) {
+	return func(md *Metadata) {
+		md.Timestamp = t
+	}
 }
 
 // WithCorrelationID sets the message correlation id
@@ -62,41 +144,160 @@ func WithCorrelationID(id string) func(*Metadata) {
 	}
 }
 
-func wrap(m proto.Message, optFns []func(*Metadata)) (*prampb.Message, error) {
-	any, err := anypb.New(m)
-	if err != nil {
-		return nil, err
+// ContextWithCorrelationID returns a copy of the context with the specified correlation id
+// Publishers use the context correlation id unless one is set using WithCorrelationID, and subscribers
+// add the incoming correlation id to the handler context, so ids are propagated across services.
+func ContextWithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationIDFromContext returns the correlation id from the context, if present
+func CorrelationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(string)
+	return id, ok
+}
+
+// WithMessageAttribute sets a string sns message attribute, which can be used in subscription filter policies
+func WithMessageAttribute(key, value string) func(*Metadata) {
+	return func(md *Metadata) {
+		setAttribute(md, key, value, Attribute{DataType: "String", StringValue: value})
 	}
+}
+
+// WithMessageGroupID sets the message group id, which is required when publishing to fifo topics
+// The message id is used as the deduplication id unless one is set using WithMessageDeduplicationID.
+func WithMessageGroupID(id string) func(*Metadata) {
+	return func(md *Metadata) {
+		md.MessageGroupID = id
+	}
+}
+
+// WithMessageDeduplicationID sets the message deduplication id used when publishing to fifo topics
+func WithMessageDeduplicationID(id string) func(*Metadata) {
+	return func(md *Metadata) {
+		md.MessageDeduplicationID = id
+	}
+}
+
+// WithMetadata sets the message metadata, replacing the generated id and timestamp
+// The type is always derived from the message and the receive count is not retained. This allows a received
+// message to be published again with the same id and correlation id, see Publisher.Republish.
+func WithMetadata(in Metadata) func(*Metadata) {
+	return func(md *Metadata) {
+		t := md.Type
+
+		*md = in
+		md.Type = t
+		md.ReceiveCount = 0
+		md.Headers = copyStringMap(in.Headers)
+		md.TraceContext = copyStringMap(in.TraceContext)
+
+		if in.Attributes != nil {
+			md.Attributes = make(map[string]Attribute, len(in.Attributes))
+			for k, v := range in.Attributes {
+				md.Attributes[k] = v
+			}
+		}
+	}
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
 
+func messageType(m proto.Message) string {
+	return string(m.ProtoReflect().Descriptor().FullName())
+}
+
+// newMetadata returns the metadata for the specified message
+// The generated id and timestamp are available to options, and are generated again if an option clears them.
+func newMetadata(m proto.Message, optFns []func(*Metadata)) Metadata {
 	md := Metadata{
-		ID:        uuid.NewString(),
-		Type:      string(m.ProtoReflect().Descriptor().FullName()),
-		Timestamp: time.Now().UTC(),
+		ID:        newMessageID(),
+		Type:      messageType(m),
+		Timestamp: messageTime().UTC(),
 	}
 
 	for _, opt := range optFns {
 		opt(&md)
 	}
 
+	if md.ID == "" {
+		md.ID = newMessageID()
+	}
+	if md.Timestamp.IsZero() {
+		md.Timestamp = messageTime().UTC()
+	}
+
+	return md
+}
+
+func wrap(m proto.Message, md Metadata) (*prampb.Message, error) {
+	any, err := anypb.New(m)
+	if err != nil {
+		return nil, err
+	}
+
 	return &prampb.Message{
 		Id:            md.ID,
 		Type:          md.Type,
 		CorrelationId: md.CorrelationID,
 		Timestamp:     timestamppb.New(md.Timestamp),
 		Body:          any,
+		TraceContext:  md.TraceContext,
 	}, nil
 }
 
+// checksum returns the big-endian crc32c checksum of the specified payload
+func checksum(b []byte) []byte {
+	c := make([]byte, 4)
+	binary.BigEndian.PutUint32(c, crc32.Checksum(b, crcTable))
+	return c
+}
+
+// unwrap tolerates missing envelope fields, allowing messages from other pram versions to be decoded
+// Unknown fields are ignored by proto.Unmarshal, so envelope fields can be added without breaking older subscribers.
 func unwrap(wrapped *prampb.Message, m proto.Message) (Message, error) {
+	if wrapped.GetBody() == nil {
+		return Message{}, errors.New("message body is empty")
+	}
+
+	// checksums are optional, so messages without one are not verified
+	if c := wrapped.GetChecksum(); len(c) > 0 && !bytes.Equal(c, checksum(wrapped.Body.GetValue())) {
+		return Message{}, ErrChecksumMismatch
+	}
+
 	md := Metadata{
 		ID:            wrapped.GetId(),
 		Type:          wrapped.GetType(),
 		CorrelationID: wrapped.GetCorrelationId(),
-		Timestamp:     wrapped.GetTimestamp().AsTime(),
+		TraceContext:  wrapped.GetTraceContext(),
+	}
+	// raw handlers receive the body as-is, so the type is derived from the body if not present in the envelope
+	a, raw := m.(*anypb.Any)
+	if md.Type == "" {
+		md.Type = messageType(m)
+		if raw {
+			md.Type = string(wrapped.Body.MessageName())
+		}
+	}
+	if wrapped.GetTimestamp() != nil {
+		md.Timestamp = wrapped.GetTimestamp().AsTime()
 	}
 
-	err := wrapped.Body.UnmarshalTo(m)
-	if err != nil {
+	if raw {
+		proto.Reset(a)
+		proto.Merge(a, wrapped.Body)
+	} else if err := wrapped.Body.UnmarshalTo(m); err != nil {
 		return Message{}, err
 	}
 
@@ -1,12 +1,21 @@
 package pram_test
 
 import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync"
 	"testing"
+	"time"
 
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/stevecallear/pram"
 	"github.com/stevecallear/pram/internal/assert"
+	"github.com/stevecallear/pram/proto/prampb"
 	"github.com/stevecallear/pram/proto/testpb"
 )
 
@@ -53,6 +62,146 @@ func TestMarshalUnmarshal(t *testing.T) {
 	}
 }
 
+func TestUnmarshalCompatibility(t *testing.T) {
+	ts := time.Date(2021, 7, 20, 12, 0, 0, 0, time.UTC)
+
+	body, err := anypb.New(&testpb.Message{Value: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		input func() []byte
+		exp   pram.Metadata
+		err   bool
+	}{
+		{
+			name: "should ignore envelope fields added by newer versions",
+			input: func() []byte {
+				b := marshalEnvelope(t, &prampb.Message{
+					Id:            "id",
+					Type:          "pram.test.Message",
+					CorrelationId: "correlationid",
+					Timestamp:     timestamppb.New(ts),
+					Body:          body,
+				})
+
+				b = protowire.AppendTag(b, 100, protowire.BytesType)
+				b = protowire.AppendString(b, "application/protobuf")
+				b = protowire.AppendTag(b, 101, protowire.VarintType)
+				return protowire.AppendVarint(b, 2)
+			},
+			exp: pram.Metadata{
+				ID:            "id",
+				Type:          "pram.test.Message",
+				CorrelationID: "correlationid",
+				Timestamp:     ts,
+			},
+		},
+		{
+			name: "should tolerate envelope fields missing from older versions",
+			input: func() []byte {
+				return marshalEnvelope(t, &prampb.Message{
+					Id:   "id",
+					Body: body,
+				})
+			},
+			exp: pram.Metadata{
+				ID:   "id",
+				Type: "pram.test.Message",
+			},
+		},
+		{
+			name: "should return an error if the body is missing",
+			input: func() []byte {
+				return marshalEnvelope(t, &prampb.Message{
+					Id: "id",
+				})
+			},
+			err: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			act, err := pram.Unmarshal(tt.input(), new(testpb.Message))
+			assert.ErrorExists(t, err, tt.err)
+			if tt.err {
+				return
+			}
+
+			assert.DeepEqual(t, act.Metadata, tt.exp)
+			assert.DeepEqual(t, act.Payload.(*testpb.Message).Value, "value")
+		})
+	}
+}
+
+func TestUnmarshalAny(t *testing.T) {
+	t.Run("should unmarshal the body and derive the type if it is missing", func(t *testing.T) {
+		body, err := anypb.New(&testpb.Message{Value: "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		act, err := pram.Unmarshal(marshalEnvelope(t, &prampb.Message{Id: "id", Body: body}), new(anypb.Any))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act.Metadata, pram.Metadata{ID: "id", Type: "pram.test.Message"})
+
+		if !proto.Equal(act.Payload, body) {
+			t.Errorf("got %v, expected %v", act.Payload, body)
+		}
+	})
+}
+
+func TestUnmarshalChecksum(t *testing.T) {
+	body, err := anypb.New(&testpb.Message{Value: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crc := func(b []byte) []byte {
+		c := make([]byte, 4)
+		binary.BigEndian.PutUint32(c, crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		checksum []byte
+		err      error
+	}{
+		{
+			name:     "should not verify messages without a checksum",
+			checksum: nil,
+		},
+		{
+			name:     "should verify the checksum",
+			checksum: crc(body.Value),
+		},
+		{
+			name:     "should return an error if the checksum does not match",
+			checksum: crc([]byte("corrupted")),
+			err:      pram.ErrChecksumMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := marshalEnvelope(t, &prampb.Message{
+				Id:       "id",
+				Body:     body,
+				Checksum: tt.checksum,
+			})
+
+			_, err := pram.Unmarshal(b, new(testpb.Message))
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, expected %v", err, tt.err)
+			}
+		})
+	}
+}
+
 func TestWithCorrelationID(t *testing.T) {
 	t.Run("should set the correlation id", func(t *testing.T) {
 		const exp = "expected"
@@ -65,3 +214,217 @@ func TestWithCorrelationID(t *testing.T) {
 		}
 	})
 }
+
+func TestWithMetadata(t *testing.T) {
+	t.Run("should retain the metadata", func(t *testing.T) {
+		ts := time.Date(2021, 7, 20, 12, 0, 0, 0, time.UTC)
+		in := pram.Metadata{
+			ID:            "id",
+			Type:          "other",
+			CorrelationID: "correlationid",
+			Timestamp:     ts,
+			ReceiveCount:  5,
+		}
+
+		b, err := pram.Marshal(new(testpb.Message), pram.WithMetadata(in))
+		assert.ErrorExists(t, err, false)
+
+		act, err := pram.Unmarshal(b, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		assert.DeepEqual(t, act.Metadata, pram.Metadata{
+			ID:            "id",
+			Type:          "pram.test.Message",
+			CorrelationID: "correlationid",
+			Timestamp:     ts,
+		})
+	})
+}
+
+func TestWithID(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		exp   func(string) bool
+	}{
+		{
+			name:  "should set the id",
+			input: "id",
+			exp: func(id string) bool {
+				return id == "id"
+			},
+		},
+		{
+			name:  "should generate the id if it is empty",
+			input: "",
+			exp: func(id string) bool {
+				return id != ""
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := pram.Marshal(new(testpb.Message), pram.WithID(tt.input))
+			assert.ErrorExists(t, err, false)
+
+			act, err := pram.Unmarshal(b, new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+
+			if !tt.exp(act.ID) {
+				t.Errorf("got %s, expected a valid id", act.ID)
+			}
+		})
+	}
+}
+
+func TestWithTimestamp(t *testing.T) {
+	tests := []struct {
+		name  string
+		input time.Time
+		exp   func(time.Time) bool
+	}{
+		{
+			name:  "should set the timestamp",
+			input: time.Date(2021, 7, 20, 12, 0, 0, 0, time.UTC),
+			exp: func(ts time.Time) bool {
+				return ts.Equal(time.Date(2021, 7, 20, 12, 0, 0, 0, time.UTC))
+			},
+		},
+		{
+			name: "should use the current time if the timestamp is zero",
+			exp: func(ts time.Time) bool {
+				return time.Since(ts) < time.Minute
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := pram.Marshal(new(testpb.Message), pram.WithTimestamp(tt.input))
+			assert.ErrorExists(t, err, false)
+
+			act, err := pram.Unmarshal(b, new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+
+			if !tt.exp(act.Timestamp) {
+				t.Errorf("got %s, expected a valid timestamp", act.Timestamp)
+			}
+		})
+	}
+}
+
+func TestMarshal_Defaults(t *testing.T) {
+	t.Run("should generate a unique id and timestamp", func(t *testing.T) {
+		st := time.Now()
+
+		var ids []string
+		for i := 0; i < 2; i++ {
+			b, err := pram.Marshal(new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+
+			act, err := pram.Unmarshal(b, new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+
+			if act.Timestamp.Before(st.Add(-time.Second)) || act.Timestamp.After(time.Now()) {
+				t.Errorf("got %s, expected the current time", act.Timestamp)
+			}
+			ids = append(ids, act.ID)
+		}
+
+		if ids[0] == "" || ids[0] == ids[1] {
+			t.Errorf("got %v, expected unique ids", ids)
+		}
+	})
+}
+
+func TestSetIDGeneratorSetClock(t *testing.T) {
+	t.Run("should use the specified generator and clock", func(t *testing.T) {
+		ts := time.Date(2021, 7, 20, 12, 0, 0, 0, time.UTC)
+
+		pram.SetIDGenerator(func() string { return "id" })
+		pram.SetClock(func() time.Time { return ts })
+		defer func() {
+			pram.SetIDGenerator(nil)
+			pram.SetClock(nil)
+		}()
+
+		b, err := pram.Marshal(&testpb.Message{Value: "value"})
+		assert.ErrorExists(t, err, false)
+
+		act, err := pram.Unmarshal(b, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		assert.DeepEqual(t, act.Metadata, pram.Metadata{
+			ID:        "id",
+			Type:      "pram.test.Message",
+			Timestamp: ts,
+		})
+
+		body, err := anypb.New(&testpb.Message{Value: "value"})
+		assert.ErrorExists(t, err, false)
+
+		exp, err := proto.Marshal(&prampb.Message{
+			Id:        "id",
+			Type:      "pram.test.Message",
+			Timestamp: timestamppb.New(ts),
+			Body:      body,
+		})
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, b, exp)
+	})
+
+	t.Run("should be safe to call concurrently with marshal", func(t *testing.T) {
+		defer func() {
+			pram.SetIDGenerator(nil)
+			pram.SetClock(nil)
+		}()
+
+		wg := new(sync.WaitGroup)
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				pram.SetIDGenerator(func() string { return "id" })
+				pram.SetClock(time.Now)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, err := pram.Marshal(new(testpb.Message))
+				assert.ErrorExists(t, err, false)
+			}
+		}()
+
+		wg.Wait()
+	})
+
+	t.Run("should restore the defaults", func(t *testing.T) {
+		pram.SetIDGenerator(func() string { return "id" })
+		pram.SetClock(func() time.Time { return time.Time{} })
+		pram.SetIDGenerator(nil)
+		pram.SetClock(nil)
+
+		b, err := pram.Marshal(new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		act, err := pram.Unmarshal(b, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		if act.ID == "id" || time.Since(act.Timestamp) > time.Minute {
+			t.Errorf("got %s at %s, expected a generated id and the current time", act.ID, act.Timestamp)
+		}
+	})
+}
+
+func marshalEnvelope(t *testing.T, m *prampb.Message) []byte {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
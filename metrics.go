@@ -0,0 +1,50 @@
+package pram
+
+import "time"
+
+type (
+	// Metrics represents a metrics sink
+	Metrics interface {
+		IncPublished(messageType string)
+		ObservePublishedSize(messageType string, size int)
+	}
+
+	// PublishErrorMetrics represents an optional metrics sink for publish failures
+	// It is used if the configured Metrics implementation also implements the interface.
+	PublishErrorMetrics interface {
+		IncPublishError(messageType string)
+	}
+
+	// SubscriberMetrics represents a subscriber metrics sink
+	// Received messages are counted once decoded. Each handler call is timed, with errors counted separately.
+	SubscriberMetrics interface {
+		IncReceived(messageType string)
+		IncHandleError(messageType string)
+		ObserveHandleDuration(messageType string, d time.Duration)
+	}
+
+	// ThrottleMetrics represents an optional metrics sink for publish rate limiting
+	// It is used if the configured Metrics implementation also implements the interface.
+	ThrottleMetrics interface {
+		IncThrottled(messageType string)
+	}
+
+	// EnsureMetrics represents a metrics sink for infrastructure provisioning
+	// Durations are observed for each aws call, labelled by operation: create_topic, set_topic_attributes,
+	// create_queue, get_queue_attributes, set_queue_attributes, subscribe or set_subscription_attributes.
+	EnsureMetrics interface {
+		ObserveEnsureDuration(operation string, d time.Duration)
+	}
+
+	noopMetrics struct{}
+)
+
+func (m *noopMetrics) IncPublished(messageType string) {}
+
+func (m *noopMetrics) ObservePublishedSize(messageType string, size int) {}
+
+func (m *noopMetrics) IncReceived(messageType string) {}
+
+func (m *noopMetrics) IncHandleError(messageType string) {}
+
+func (m *noopMetrics) ObserveHandleDuration(messageType string, d time.Duration) {}
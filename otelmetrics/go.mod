@@ -0,0 +1,34 @@
+module github.com/stevecallear/pram/otelmetrics
+
+// go 1.20 is the minimum version supported by the opentelemetry v1.21 modules, while the
+// parent module continues to support go 1.16 as it does not depend on the metrics sdk
+go 1.20
+
+require (
+	github.com/stevecallear/pram v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.21.0
+	go.opentelemetry.io/otel/metric v1.21.0
+	go.opentelemetry.io/otel/sdk/metric v1.21.0
+)
+
+require (
+	github.com/aws/aws-sdk-go-v2 v1.7.1 // indirect
+	github.com/aws/aws-sdk-go-v2/service/sns v1.7.0 // indirect
+	github.com/aws/aws-sdk-go-v2/service/sqs v1.7.0 // indirect
+	github.com/aws/smithy-go v1.6.0 // indirect
+	github.com/go-logr/logr v1.3.0 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/tidwall/gjson v1.8.1 // indirect
+	github.com/tidwall/match v1.0.3 // indirect
+	github.com/tidwall/pretty v1.1.0 // indirect
+	go.opentelemetry.io/otel/sdk v1.21.0 // indirect
+	go.opentelemetry.io/otel/trace v1.21.0 // indirect
+	golang.org/x/sync v0.0.0-20220907140024-f12130a52804 // indirect
+	golang.org/x/sys v0.14.0 // indirect
+	golang.org/x/time v0.0.0-20210611083556-38a9dc6acbc6 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
+)
+
+// the parent module is built from the same commit, so that unreleased metrics interfaces are available
+replace github.com/stevecallear/pram => ../
@@ -0,0 +1,162 @@
+// Package otelmetrics records pram metrics using OpenTelemetry instruments
+// It is a separate module, so that the OpenTelemetry metrics dependencies are only required if it is used.
+package otelmetrics
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// instrumentationName is the name of the meter used to create the instruments
+const instrumentationName = "github.com/stevecallear/pram"
+
+// Attribute keys recorded with each measurement
+const (
+	MessageTypeKey = attribute.Key("messaging.message.type")
+	OutcomeKey     = attribute.Key("outcome")
+	OperationKey   = attribute.Key("operation")
+)
+
+// Outcome values recorded with published messages
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+// Metrics records publisher, subscriber and registry metrics using OpenTelemetry instruments
+// It implements pram.Metrics, pram.PublishErrorMetrics, pram.ThrottleMetrics, pram.SubscriberMetrics
+// and pram.EnsureMetrics.
+type Metrics struct {
+	published      metric.Int64Counter
+	publishedSize  metric.Int64Histogram
+	throttled      metric.Int64Counter
+	received       metric.Int64Counter
+	handleErrors   metric.Int64Counter
+	handleDuration metric.Float64Histogram
+	ensureDuration metric.Float64Histogram
+}
+
+// New returns new metrics using the specified meter provider, or the global provider if it is nil
+func New(mp metric.MeterProvider) (*Metrics, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+
+	m := mp.Meter(instrumentationName)
+
+	var err error
+	var ms Metrics
+
+	ms.published, err = m.Int64Counter("pram.publish.messages",
+		metric.WithDescription("The number of messages published, by outcome"),
+		metric.WithUnit("{message}"))
+	if err != nil {
+		return nil, err
+	}
+
+	ms.publishedSize, err = m.Int64Histogram("pram.publish.size",
+		metric.WithDescription("The size of encoded published message bodies"),
+		metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+
+	ms.throttled, err = m.Int64Counter("pram.publish.throttled",
+		metric.WithDescription("The number of publishes delayed by rate limiting"),
+		metric.WithUnit("{message}"))
+	if err != nil {
+		return nil, err
+	}
+
+	ms.received, err = m.Int64Counter("pram.receive.messages",
+		metric.WithDescription("The number of messages received and decoded"),
+		metric.WithUnit("{message}"))
+	if err != nil {
+		return nil, err
+	}
+
+	ms.handleErrors, err = m.Int64Counter("pram.handle.errors",
+		metric.WithDescription("The number of handler calls that returned an error"),
+		metric.WithUnit("{message}"))
+	if err != nil {
+		return nil, err
+	}
+
+	ms.handleDuration, err = m.Float64Histogram("pram.handle.duration",
+		metric.WithDescription("The duration of each handler call"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+
+	ms.ensureDuration, err = m.Float64Histogram("pram.ensure.duration",
+		metric.WithDescription("The duration of each aws call made when ensuring infrastructure"),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ms, nil
+}
+
+// IncPublished increments the published message count with a success outcome
+func (m *Metrics) IncPublished(messageType string) {
+	m.published.Add(context.Background(), 1, metric.WithAttributes(
+		MessageTypeKey.String(messageType),
+		OutcomeKey.String(OutcomeSuccess),
+	))
+}
+
+// IncPublishError increments the published message count with an error outcome
+func (m *Metrics) IncPublishError(messageType string) {
+	m.published.Add(context.Background(), 1, metric.WithAttributes(
+		MessageTypeKey.String(messageType),
+		OutcomeKey.String(OutcomeError),
+	))
+}
+
+// ObservePublishedSize records the size of the encoded message body
+func (m *Metrics) ObservePublishedSize(messageType string, size int) {
+	m.publishedSize.Record(context.Background(), int64(size), metric.WithAttributes(
+		MessageTypeKey.String(messageType),
+	))
+}
+
+// IncThrottled increments the throttled publish count
+func (m *Metrics) IncThrottled(messageType string) {
+	m.throttled.Add(context.Background(), 1, metric.WithAttributes(
+		MessageTypeKey.String(messageType),
+	))
+}
+
+// IncReceived increments the received message count
+func (m *Metrics) IncReceived(messageType string) {
+	m.received.Add(context.Background(), 1, metric.WithAttributes(
+		MessageTypeKey.String(messageType),
+	))
+}
+
+// IncHandleError increments the handler error count
+func (m *Metrics) IncHandleError(messageType string) {
+	m.handleErrors.Add(context.Background(), 1, metric.WithAttributes(
+		MessageTypeKey.String(messageType),
+	))
+}
+
+// ObserveHandleDuration records the handler call duration in seconds
+func (m *Metrics) ObserveHandleDuration(messageType string, d time.Duration) {
+	m.handleDuration.Record(context.Background(), d.Seconds(), metric.WithAttributes(
+		MessageTypeKey.String(messageType),
+	))
+}
+
+// ObserveEnsureDuration records the aws call duration in seconds
+func (m *Metrics) ObserveEnsureDuration(operation string, d time.Duration) {
+	m.ensureDuration.Record(context.Background(), d.Seconds(), metric.WithAttributes(
+		OperationKey.String(operation),
+	))
+}
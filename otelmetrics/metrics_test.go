@@ -0,0 +1,178 @@
+package otelmetrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/stevecallear/pram"
+	"github.com/stevecallear/pram/otelmetrics"
+)
+
+var (
+	_ pram.Metrics             = (*otelmetrics.Metrics)(nil)
+	_ pram.PublishErrorMetrics = (*otelmetrics.Metrics)(nil)
+	_ pram.ThrottleMetrics     = (*otelmetrics.Metrics)(nil)
+	_ pram.SubscriberMetrics   = (*otelmetrics.Metrics)(nil)
+	_ pram.EnsureMetrics       = (*otelmetrics.Metrics)(nil)
+)
+
+const messageType = "pram.test.Message"
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		fn     func(*otelmetrics.Metrics)
+		metric string
+		attrs  attribute.Set
+		exp    float64
+	}{
+		{
+			name: "should count published messages",
+			fn: func(m *otelmetrics.Metrics) {
+				m.IncPublished(messageType)
+			},
+			metric: "pram.publish.messages",
+			attrs:  attribute.NewSet(otelmetrics.MessageTypeKey.String(messageType), otelmetrics.OutcomeKey.String(otelmetrics.OutcomeSuccess)),
+			exp:    1,
+		},
+		{
+			name: "should count publish errors",
+			fn: func(m *otelmetrics.Metrics) {
+				m.IncPublishError(messageType)
+			},
+			metric: "pram.publish.messages",
+			attrs:  attribute.NewSet(otelmetrics.MessageTypeKey.String(messageType), otelmetrics.OutcomeKey.String(otelmetrics.OutcomeError)),
+			exp:    1,
+		},
+		{
+			name: "should record the published size",
+			fn: func(m *otelmetrics.Metrics) {
+				m.ObservePublishedSize(messageType, 128)
+			},
+			metric: "pram.publish.size",
+			attrs:  attribute.NewSet(otelmetrics.MessageTypeKey.String(messageType)),
+			exp:    128,
+		},
+		{
+			name: "should count throttled publishes",
+			fn: func(m *otelmetrics.Metrics) {
+				m.IncThrottled(messageType)
+			},
+			metric: "pram.publish.throttled",
+			attrs:  attribute.NewSet(otelmetrics.MessageTypeKey.String(messageType)),
+			exp:    1,
+		},
+		{
+			name: "should count received messages",
+			fn: func(m *otelmetrics.Metrics) {
+				m.IncReceived(messageType)
+				m.IncReceived(messageType)
+			},
+			metric: "pram.receive.messages",
+			attrs:  attribute.NewSet(otelmetrics.MessageTypeKey.String(messageType)),
+			exp:    2,
+		},
+		{
+			name: "should count handler errors",
+			fn: func(m *otelmetrics.Metrics) {
+				m.IncHandleError(messageType)
+			},
+			metric: "pram.handle.errors",
+			attrs:  attribute.NewSet(otelmetrics.MessageTypeKey.String(messageType)),
+			exp:    1,
+		},
+		{
+			name: "should record the handle duration",
+			fn: func(m *otelmetrics.Metrics) {
+				m.ObserveHandleDuration(messageType, 1500*time.Millisecond)
+			},
+			metric: "pram.handle.duration",
+			attrs:  attribute.NewSet(otelmetrics.MessageTypeKey.String(messageType)),
+			exp:    1.5,
+		},
+		{
+			name: "should record the ensure duration",
+			fn: func(m *otelmetrics.Metrics) {
+				m.ObserveEnsureDuration("create_topic", 250*time.Millisecond)
+			},
+			metric: "pram.ensure.duration",
+			attrs:  attribute.NewSet(otelmetrics.OperationKey.String("create_topic")),
+			exp:    0.25,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := sdkmetric.NewManualReader()
+			sut, err := otelmetrics.New(sdkmetric.NewMeterProvider(sdkmetric.WithReader(r)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.fn(sut)
+
+			var rm metricdata.ResourceMetrics
+			if err = r.Collect(context.Background(), &rm); err != nil {
+				t.Fatal(err)
+			}
+
+			act, ok := find(rm, tt.metric, tt.attrs)
+			if !ok {
+				t.Fatalf("got no %s data point, expected one", tt.metric)
+			}
+			if act != tt.exp {
+				t.Errorf("got %v, expected %v", act, tt.exp)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Run("should use the global meter provider", func(t *testing.T) {
+		sut, err := otelmetrics.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sut.IncPublished(messageType)
+	})
+}
+
+// find returns the sum of the data point with the specified attributes, or the histogram sum
+func find(rm metricdata.ResourceMetrics, name string, attrs attribute.Set) (float64, bool) {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+
+			switch d := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range d.DataPoints {
+					if dp.Attributes.Equals(&attrs) {
+						return float64(dp.Value), true
+					}
+				}
+			case metricdata.Histogram[int64]:
+				for _, dp := range d.DataPoints {
+					if dp.Attributes.Equals(&attrs) {
+						return float64(dp.Sum), true
+					}
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range d.DataPoints {
+					if dp.Attributes.Equals(&attrs) {
+						return dp.Sum, true
+					}
+				}
+			}
+		}
+	}
+
+	return 0, false
+}
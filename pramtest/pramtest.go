@@ -0,0 +1,27 @@
+// Package pramtest provides helpers for testing code that uses pram
+package pramtest
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/stevecallear/pram"
+)
+
+// DecodeSNSPublishInput decodes the message captured from a publish call into the specified target
+// It reverses the encoding applied by the publisher, so assumes the default base64 encoding.
+func DecodeSNSPublishInput(in *sns.PublishInput, m proto.Message) (pram.Message, error) {
+	if in == nil || in.Message == nil {
+		return pram.Message{}, errors.New("publish input message is nil")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(*in.Message)
+	if err != nil {
+		return pram.Message{}, err
+	}
+
+	return pram.Unmarshal(b, m)
+}
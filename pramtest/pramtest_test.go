@@ -0,0 +1,77 @@
+package pramtest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/golang/mock/gomock"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/stevecallear/pram"
+	"github.com/stevecallear/pram/internal/assert"
+	"github.com/stevecallear/pram/mocks"
+	"github.com/stevecallear/pram/pramtest"
+	"github.com/stevecallear/pram/proto/testpb"
+)
+
+func TestDecodeSNSPublishInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		input *sns.PublishInput
+		err   bool
+	}{
+		{
+			name:  "should return an error if the input is nil",
+			input: nil,
+			err:   true,
+		},
+		{
+			name:  "should return an error if the message is nil",
+			input: new(sns.PublishInput),
+			err:   true,
+		},
+		{
+			name:  "should return an error if the message is not base64 encoded",
+			input: &sns.PublishInput{Message: aws.String("invalid!")},
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pramtest.DecodeSNSPublishInput(tt.input, new(testpb.Message))
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+
+	t.Run("should decode the published message", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var in *sns.PublishInput
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, i *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+				in = i
+				return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+			}).Times(1)
+
+		p := pram.NewPublisher(snsc, func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		_, err := p.Publish(context.Background(), &testpb.Message{Value: "value"}, pram.WithCorrelationID("correlationid"))
+		assert.ErrorExists(t, err, false)
+
+		act, err := pramtest.DecodeSNSPublishInput(in, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		assert.DeepEqual(t, act.Payload.(*testpb.Message).Value, "value")
+		assert.DeepEqual(t, act.Type, "pram.test.Message")
+		assert.DeepEqual(t, act.CorrelationID, "correlationid")
+	})
+}
@@ -7,6 +7,7 @@
 package testpb
 
 import (
+	_ "github.com/stevecallear/pram/proto/prampb"
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
 	reflect "reflect"
@@ -67,17 +68,70 @@ func (x *Message) GetValue() string {
 	return ""
 }
 
+type NamedMessage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Value string `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (x *NamedMessage) Reset() {
+	*x = NamedMessage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_testpb_test_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *NamedMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NamedMessage) ProtoMessage() {}
+
+func (x *NamedMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_testpb_test_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NamedMessage.ProtoReflect.Descriptor instead.
+func (*NamedMessage) Descriptor() ([]byte, []int) {
+	return file_proto_testpb_test_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *NamedMessage) GetValue() string {
+	if x != nil {
+		return x.Value
+	}
+	return ""
+}
+
 var File_proto_testpb_test_proto protoreflect.FileDescriptor
 
 var file_proto_testpb_test_proto_rawDesc = []byte{
 	0x0a, 0x17, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x74, 0x65, 0x73, 0x74, 0x70, 0x62, 0x2f, 0x74,
 	0x65, 0x73, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x09, 0x70, 0x72, 0x61, 0x6d, 0x2e,
-	0x74, 0x65, 0x73, 0x74, 0x22, 0x1f, 0x0a, 0x07, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12,
-	0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
-	0x76, 0x61, 0x6c, 0x75, 0x65, 0x42, 0x2b, 0x5a, 0x29, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e,
-	0x63, 0x6f, 0x6d, 0x2f, 0x73, 0x74, 0x65, 0x76, 0x65, 0x63, 0x61, 0x6c, 0x6c, 0x65, 0x61, 0x72,
-	0x2f, 0x70, 0x72, 0x61, 0x6d, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x74, 0x65, 0x73, 0x74,
-	0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x74, 0x65, 0x73, 0x74, 0x1a, 0x1a, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x70, 0x72, 0x61, 0x6d,
+	0x70, 0x62, 0x2f, 0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x22, 0x1f, 0x0a, 0x07, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x76,
+	0x61, 0x6c, 0x75, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75,
+	0x65, 0x22, 0x44, 0x0a, 0x0c, 0x4e, 0x61, 0x6d, 0x65, 0x64, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67,
+	0x65, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x1e, 0x82, 0xb5, 0x18, 0x0b, 0x6e, 0x61, 0x6d,
+	0x65, 0x64, 0x2d, 0x74, 0x6f, 0x70, 0x69, 0x63, 0x8a, 0xb5, 0x18, 0x0b, 0x6e, 0x61, 0x6d, 0x65,
+	0x64, 0x2d, 0x71, 0x75, 0x65, 0x75, 0x65, 0x42, 0x2b, 0x5a, 0x29, 0x67, 0x69, 0x74, 0x68, 0x75,
+	0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x73, 0x74, 0x65, 0x76, 0x65, 0x63, 0x61, 0x6c, 0x6c, 0x65,
+	0x61, 0x72, 0x2f, 0x70, 0x72, 0x61, 0x6d, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x74, 0x65,
+	0x73, 0x74, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -92,9 +146,10 @@ func file_proto_testpb_test_proto_rawDescGZIP() []byte {
 	return file_proto_testpb_test_proto_rawDescData
 }
 
-var file_proto_testpb_test_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_proto_testpb_test_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
 var file_proto_testpb_test_proto_goTypes = []interface{}{
-	(*Message)(nil), // 0: pram.test.Message
+	(*Message)(nil),      // 0: pram.test.Message
+	(*NamedMessage)(nil), // 1: pram.test.NamedMessage
 }
 var file_proto_testpb_test_proto_depIdxs = []int32{
 	0, // [0:0] is the sub-list for method output_type
@@ -122,6 +177,18 @@ func file_proto_testpb_test_proto_init() {
 				return nil
 			}
 		}
+		file_proto_testpb_test_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*NamedMessage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -129,7 +196,7 @@ func file_proto_testpb_test_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_proto_testpb_test_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   1,
+			NumMessages:   2,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
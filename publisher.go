@@ -4,71 +4,502 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/proto"
+
+	"github.com/stevecallear/pram/internal/store"
 )
 
 type (
+	// PublishFunc represents a func that publishes a message with the specified metadata
+	PublishFunc func(ctx context.Context, m proto.Message, md *Metadata) error
+
+	// PublishMiddleware represents a func that wraps a publish func
+	PublishMiddleware func(PublishFunc) PublishFunc
+
+	// IdempotencyStore represents a store of published message ids
+	IdempotencyStore interface {
+		GetOrSetMessageID(ctx context.Context, key string, fn func() (string, error)) (string, error)
+	}
+
 	// Publisher represents a publisher
 	Publisher struct {
-		client     SNS
-		topicARNFn func(context.Context, proto.Message) (string, error)
+		client           SNS
+		topicARNFn       func(context.Context, proto.Message) (string, error)
+		topicLookupFn    func(context.Context, proto.Message) (string, error)
+		metrics          Metrics
+		idempotencyStore IdempotencyStore
+		encoding         *base64.Encoding
+		codec            Codec
+		middleware       []PublishMiddleware
+		rateLimiter      *rate.Limiter
+		typeAttribute    string
+		propagator       propagation.TextMapPropagator
+	}
+
+	// DryRunResult represents the result of a dry run publish
+	DryRunResult struct {
+		Metadata Metadata
+		TopicARN string
+		Size     int
 	}
 
 	// PublisherOptions represents a set of publisher options
 	PublisherOptions struct {
-		TopicARNFn func(context.Context, proto.Message) (string, error)
+		TopicARNFn        func(context.Context, proto.Message) (string, error)
+		TopicLookupFn     func(context.Context, proto.Message) (string, error)
+		TopicARNOverrides map[string]string
+		Metrics           Metrics
+		IdempotencyStore  IdempotencyStore
+		IdempotencyTTL    time.Duration
+		Encoding          *base64.Encoding
+		Codec             Codec
+		Middleware        []PublishMiddleware
+		RateLimiter       *rate.Limiter
+		Checksum          bool
+		TypeAttribute     string
+		Propagator        propagation.TextMapPropagator
 	}
 )
 
+// maxMessageSize is the maximum sns message size in bytes
+const maxMessageSize = 256 * 1024
+
+// maxIdempotencyKeys is the maximum number of keys held by the default idempotency store
+const maxIdempotencyKeys = 100000
+
 // NewPublisher returns a new publisher
 func NewPublisher(client SNS, optFns ...func(*PublisherOptions)) *Publisher {
 	o := PublisherOptions{
 		TopicARNFn: func(context.Context, proto.Message) (string, error) {
 			return "", errors.New("topic not found")
 		},
+		Encoding:       base64.StdEncoding,
+		TypeAttribute:  "pram.type",
+		IdempotencyTTL: time.Hour,
 	}
 
 	for _, fn := range optFns {
 		fn(&o)
 	}
 
+	if o.Metrics == nil {
+		o.Metrics = new(noopMetrics)
+	}
+
+	// the default store is bounded, so that keys are not retained for the lifetime of the process
+	if o.IdempotencyStore == nil {
+		o.IdempotencyStore = store.NewInMemoryStore(maxIdempotencyKeys, store.WithTTL(o.IdempotencyTTL))
+	}
+
+	if o.Codec == nil {
+		o.Codec = ProtoCodec{Checksum: o.Checksum}
+	}
+
+	// topics are resolved using the topic arn func if no lookup func is configured
+	if o.TopicLookupFn == nil {
+		o.TopicLookupFn = o.TopicARNFn
+	}
+
+	// overrides are applied once all options have been configured, so they overlay any topic resolution
+	if len(o.TopicARNOverrides) > 0 {
+		o.TopicARNFn = overrideTopicARN(o.TopicARNFn, o.TopicARNOverrides)
+		o.TopicLookupFn = overrideTopicARN(o.TopicLookupFn, o.TopicARNOverrides)
+	}
+
 	return &Publisher{
-		client:     client,
-		topicARNFn: o.TopicARNFn,
+		client:           client,
+		topicARNFn:       o.TopicARNFn,
+		topicLookupFn:    o.TopicLookupFn,
+		metrics:          o.Metrics,
+		idempotencyStore: o.IdempotencyStore,
+		encoding:         o.Encoding,
+		codec:            o.Codec,
+		middleware:       o.Middleware,
+		rateLimiter:      o.RateLimiter,
+		typeAttribute:    o.TypeAttribute,
+		propagator:       o.Propagator,
 	}
 }
 
-// Publish publishes the specified message
-func (p *Publisher) Publish(ctx context.Context, m proto.Message, opts ...func(*Metadata)) error {
-	b, err := Marshal(m, opts...)
+// Publish publishes the specified message, returning the sns message id
+func (p *Publisher) Publish(ctx context.Context, m proto.Message, opts ...func(*Metadata)) (string, error) {
+	return p.publish(ctx, m, opts)
+}
+
+// PublishIdempotent publishes the specified message, unless a message has already been
+// published successfully with the same idempotency key. The sns message id is returned, which
+// is the id of the first publish if the key has already been used.
+func (p *Publisher) PublishIdempotent(ctx context.Context, key string, m proto.Message, opts ...func(*Metadata)) (string, error) {
+	if key == "" {
+		return "", errors.New("idempotency key is empty")
+	}
+
+	return p.idempotencyStore.GetOrSetMessageID(ctx, key, func() (string, error) {
+		return p.publish(ctx, m, opts)
+	})
+}
+
+// Forward publishes a message derived from the specified incoming message metadata
+// The idempotency key is derived from the incoming message id and outgoing message type,
+// ensuring that redelivery of the incoming message does not result in duplicate publishes. Keys are retained for the
+// idempotency ttl, which should exceed the period over which the incoming message can be redelivered.
+// The incoming correlation id is propagated, falling back to the incoming message id. The sns message id is returned
+// as per PublishIdempotent.
+func (p *Publisher) Forward(ctx context.Context, in Metadata, m proto.Message, opts ...func(*Metadata)) (string, error) {
+	if in.ID == "" {
+		return "", errors.New("incoming message id is empty")
+	}
+
+	cid := in.CorrelationID
+	if cid == "" {
+		cid = in.ID
+	}
+
+	opts = append([]func(*Metadata){WithCorrelationID(cid)}, opts...)
+	return p.PublishIdempotent(ctx, in.ID+":"+messageType(m), m, opts...)
+}
+
+// Republish publishes the specified message again, for example once a message from an error queue can be handled
+// The message metadata is reused, preserving the id, correlation id and timestamp, so that idempotency keys derived
+// from them remain stable. Fifo messages retain their deduplication id, so are dropped by sns if republished within
+// the deduplication interval.
+func (p *Publisher) Republish(ctx context.Context, m Message) error {
+	if m.Payload == nil {
+		return errors.New("message payload is nil")
+	}
+	if m.ID == "" {
+		return errors.New("message id is empty")
+	}
+
+	_, err := p.publish(ctx, m.Payload, []func(*Metadata){WithMetadata(m.Metadata)})
+	return err
+}
+
+// DryRun validates that the specified message can be published without publishing it
+// The message is passed through the publish middleware and marshalled, and the topic is resolved without being created.
+// The result contains the metadata and encoded size of the message that would have been published.
+func (p *Publisher) DryRun(ctx context.Context, m proto.Message, opts ...func(*Metadata)) (DryRunResult, error) {
+	var res DryRunResult
+	err := p.run(ctx, m, opts, func(ctx context.Context, m proto.Message, md *Metadata) (err error) {
+		res, err = p.dryRun(ctx, m, *md)
+		return err
+	})
 	if err != nil {
+		return DryRunResult{}, err
+	}
+
+	return res, nil
+}
+
+func (p *Publisher) publish(ctx context.Context, m proto.Message, opts []func(*Metadata)) (string, error) {
+	var id string
+	err := p.run(ctx, m, opts, func(ctx context.Context, m proto.Message, md *Metadata) (err error) {
+		id, err = p.send(ctx, m, *md)
 		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// run populates the message metadata and calls the specified func, wrapped with the publish middleware
+func (p *Publisher) run(ctx context.Context, m proto.Message, opts []func(*Metadata), fn PublishFunc) error {
+	// middleware is applied in order, with the first middleware outermost
+	for i := len(p.middleware) - 1; i >= 0; i-- {
+		fn = p.middleware[i](fn)
+	}
+
+	md := newMetadata(m, withContextCorrelationID(ctx, opts))
+	return fn(ctx, m, &md)
+}
+
+func (p *Publisher) dryRun(ctx context.Context, m proto.Message, md Metadata) (DryRunResult, error) {
+	if p.propagator != nil {
+		injectTraceContext(ctx, p.propagator, &md)
+	}
+
+	body, err := p.encode(m, md)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+
+	arn, err := p.topicLookupFn(ctx, m)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+
+	n := len(body)
+	if n > maxMessageSize {
+		return DryRunResult{}, fmt.Errorf("message size %d exceeds the maximum of %d bytes", n, maxMessageSize)
+	}
+
+	return DryRunResult{
+		Metadata: md,
+		TopicARN: arn,
+		Size:     n,
+	}, nil
+}
+
+func (p *Publisher) send(ctx context.Context, m proto.Message, md Metadata) (string, error) {
+	if p.propagator != nil {
+		injectTraceContext(ctx, p.propagator, &md)
+	}
+
+	body, err := p.encode(m, md)
+	if err != nil {
+		return "", err
 	}
 
 	arn, err := p.topicARNFn(ctx, m)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	res, err := p.client.Publish(ctx, &sns.PublishInput{
-		TopicArn: aws.String(arn),
-		Message:  aws.String(base64.StdEncoding.EncodeToString(b)),
-	})
+	in := &sns.PublishInput{
+		TopicArn:          aws.String(arn),
+		Message:           aws.String(body),
+		MessageAttributes: p.messageAttributes(md),
+	}
+	if md.MessageGroupID != "" {
+		did := md.MessageDeduplicationID
+		if did == "" {
+			did = md.ID
+		}
+
+		in.MessageGroupId = aws.String(md.MessageGroupID)
+		in.MessageDeduplicationId = aws.String(did)
+	}
+
+	mt := messageType(m)
+	if err = p.wait(ctx, mt); err != nil {
+		return "", err
+	}
+
+	res, err := p.client.Publish(ctx, in)
 	if err != nil {
-		return err
+		if em, ok := p.metrics.(PublishErrorMetrics); ok {
+			em.IncPublishError(mt)
+		}
+		return "", err
+	}
+
+	p.metrics.IncPublished(mt)
+	p.metrics.ObservePublishedSize(mt, len(body))
+
+	logw("published message", "message_id", *res.MessageId, "message_type", mt, "topic_arn", arn)
+	return *res.MessageId, nil
+}
+
+// messageAttributes returns the sns message attributes for the specified metadata
+// The message type is mirrored as an attribute unless disabled, allowing subscriptions to filter by type.
+func (p *Publisher) messageAttributes(md Metadata) map[string]types.MessageAttributeValue {
+	if len(md.Attributes) == 0 && p.typeAttribute == "" {
+		return nil
+	}
+
+	as := make(map[string]types.MessageAttributeValue, len(md.Attributes)+1)
+	if p.typeAttribute != "" {
+		as[p.typeAttribute] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(md.Type),
+		}
+	}
+
+	for k, a := range md.Attributes {
+		v := types.MessageAttributeValue{
+			DataType:    aws.String(a.DataType),
+			BinaryValue: a.BinaryValue,
+		}
+		if a.BinaryValue == nil {
+			v.StringValue = aws.String(a.StringValue)
+		}
+
+		as[k] = v
+	}
+
+	return as
+}
+
+// withContextCorrelationID prepends the context correlation id to the options, so that explicit options take precedence
+func withContextCorrelationID(ctx context.Context, opts []func(*Metadata)) []func(*Metadata) {
+	id, ok := CorrelationIDFromContext(ctx)
+	if !ok {
+		return opts
 	}
 
-	Logf("published %s to %s", *res.MessageId, arn)
-	return nil
+	return append([]func(*Metadata){WithCorrelationID(id)}, opts...)
+}
+
+func overrideTopicARN(fn func(context.Context, proto.Message) (string, error), overrides map[string]string) func(context.Context, proto.Message) (string, error) {
+	return func(ctx context.Context, m proto.Message) (string, error) {
+		if arn, ok := overrides[messageType(m)]; ok {
+			return arn, nil
+		}
+
+		if arn, ok := overrides["*"]; ok {
+			return arn, nil
+		}
+
+		return fn(ctx, m)
+	}
+}
+
+// encode marshals the message using the configured codec, base64 encoding the result unless the codec produces text
+func (p *Publisher) encode(m proto.Message, md Metadata) (string, error) {
+	b, err := p.codec.Marshal(Message{Payload: m, Metadata: md})
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := p.codec.(textCodec); ok {
+		return string(b), nil
+	}
+
+	return p.encoding.EncodeToString(b), nil
+}
+
+func (p *Publisher) wait(ctx context.Context, messageType string) error {
+	if p.rateLimiter == nil {
+		return nil
+	}
+
+	// a reservation is used rather than Wait, as only publishes that are delayed are recorded as throttled
+	r := p.rateLimiter.Reserve()
+	if !r.OK() {
+		return errors.New("publish exceeds the rate limiter burst")
+	}
+
+	d := r.Delay()
+	if d <= 0 {
+		return nil
+	}
+
+	if tm, ok := p.metrics.(ThrottleMetrics); ok {
+		tm.IncThrottled(messageType)
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
 }
 
 // WithTopicRegistry configures the subscriber to use the specified registry
-// to resolve topics, creating them if they do not exist
+// to resolve topics, creating them if they do not exist. Dry runs resolve existing topics without creating them.
 func WithTopicRegistry(r *Registry) func(*PublisherOptions) {
 	return func(o *PublisherOptions) {
 		o.TopicARNFn = r.TopicARN
+		o.TopicLookupFn = r.LookupTopicARN
+	}
+}
+
+// WithTopicARNOverride configures the publisher to publish the specified message types to static topic arns,
+// bypassing the configured topic resolution. Overrides are keyed by full message type name, e.g. package.Message,
+// and the "*" key overrides all other types. This is intended for local development, for example with LocalStack.
+func WithTopicARNOverride(overrides map[string]string) func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		if o.TopicARNOverrides == nil {
+			o.TopicARNOverrides = map[string]string{}
+		}
+
+		for k, v := range overrides {
+			o.TopicARNOverrides[k] = v
+		}
+	}
+}
+
+// WithPublisherMetrics configures the publisher to record metrics using the specified sink.
+// The recorded size is that of the encoded message body sent to SNS.
+func WithPublisherMetrics(m Metrics) func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		o.Metrics = m
+	}
+}
+
+// WithPublisherEncoding configures the publisher to use the specified base64 encoding for message bodies.
+// Subscribers must be configured with the same encoding using WithSubscriberEncoding.
+func WithPublisherEncoding(enc *base64.Encoding) func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		o.Encoding = enc
+	}
+}
+
+// WithPublisherCodec configures the publisher to use the specified codec for the message envelope.
+// Subscribers must be configured with the same codec using WithSubscriberCodec. The checksum option only
+// applies to the default codec.
+func WithPublisherCodec(c Codec) func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		o.Codec = c
+	}
+}
+
+// WithPublisherTracing configures the publisher to inject the span context into the message envelope using the
+// specified propagator, for example propagation.TraceContext{}. Subscribers extract the span context using
+// WithSubscriberTracing, allowing traces to span publish and subscribe.
+func WithPublisherTracing(p propagation.TextMapPropagator) func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		o.Propagator = p
+	}
+}
+
+// WithPublisherMiddleware configures the publisher to wrap publishes with the specified middleware
+// Middleware is applied in order, with the first middleware outermost. It is called once the message metadata
+// has been populated, but before the message is marshalled, allowing the metadata to be modified.
+func WithPublisherMiddleware(mw ...PublishMiddleware) func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		o.Middleware = append(o.Middleware, mw...)
+	}
+}
+
+// WithPublishRateLimit configures the publisher to limit publishes to the specified rate per second, allowing bursts
+// of up to the specified size. Publishes block until they are permitted or the context is cancelled. Delayed publishes
+// are recorded if the configured metrics implement ThrottleMetrics. Set PublisherOptions.RateLimiter directly to share
+// a limiter between publishers.
+func WithPublishRateLimit(r rate.Limit, burst int) func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		o.RateLimiter = rate.NewLimiter(r, burst)
+	}
+}
+
+// WithPublisherChecksum configures the publisher to include a crc32c checksum of the payload in the message envelope.
+// Subscribers verify the checksum if it is present, returning ErrChecksumMismatch if the payload has been corrupted.
+func WithPublisherChecksum() func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		o.Checksum = true
+	}
+}
+
+// WithIdempotencyStore configures the publisher to use the specified store to record idempotent publishes.
+// An in-memory store is used by default, which only prevents duplicates within a single process. The default store
+// retains keys for the idempotency ttl, evicting the least recently used keys once 100,000 are held. Key retention
+// is the responsibility of the specified store.
+func WithIdempotencyStore(s IdempotencyStore) func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		o.IdempotencyStore = s
+	}
+}
+
+// WithIdempotencyTTL configures the duration that the default idempotency store retains keys, which defaults to
+// one hour. Publishes with an expired key are treated as new. Keys are retained until they are evicted if ttl is
+// zero or less. This has no effect if a store is specified.
+func WithIdempotencyTTL(ttl time.Duration) func(*PublisherOptions) {
+	return func(o *PublisherOptions) {
+		o.IdempotencyTTL = ttl
 	}
 }
@@ -2,18 +2,26 @@ package pram_test
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/golang/mock/gomock"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/stevecallear/pram"
 	"github.com/stevecallear/pram/internal/assert"
+	"github.com/stevecallear/pram/internal/store"
 	"github.com/stevecallear/pram/mocks"
+	"github.com/stevecallear/pram/pramtest"
+	"github.com/stevecallear/pram/proto/prampb"
 	"github.com/stevecallear/pram/proto/testpb"
 )
 
@@ -23,6 +31,7 @@ func TestPublisher_Publish(t *testing.T) {
 		optFn func(*pram.PublisherOptions)
 		setup func(*mocks.MockSNSMockRecorder)
 		input proto.Message
+		exp   string
 		err   bool
 	}{
 		{
@@ -57,6 +66,7 @@ func TestPublisher_Publish(t *testing.T) {
 				}, nil).Times(1)
 			},
 			input: new(testpb.Message),
+			exp:   "messageid",
 		},
 	}
 
@@ -74,8 +84,9 @@ func TestPublisher_Publish(t *testing.T) {
 
 			sut := pram.NewPublisher(snsc, tt.optFn)
 
-			err := sut.Publish(context.Background(), tt.input)
+			act, err := sut.Publish(context.Background(), tt.input)
 			assert.ErrorExists(t, err, tt.err)
+			assert.DeepEqual(t, act, tt.exp)
 		})
 	}
 }
@@ -95,3 +106,994 @@ func TestWithTopicRegistry(t *testing.T) {
 		}
 	})
 }
+
+func TestWithTopicARNOverride(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		input     proto.Message
+		exp       string
+	}{
+		{
+			name:      "should use the override for the message type",
+			overrides: map[string]string{"pram.test.Message": "override"},
+			input:     new(testpb.Message),
+			exp:       "override",
+		},
+		{
+			name:      "should use the wildcard override",
+			overrides: map[string]string{"*": "wildcard"},
+			input:     new(testpb.Message),
+			exp:       "wildcard",
+		},
+		{
+			name:      "should prefer the type override to the wildcard",
+			overrides: map[string]string{"*": "wildcard", "pram.test.Message": "override"},
+			input:     new(testpb.Message),
+			exp:       "override",
+		},
+		{
+			name:      "should resolve types without an override",
+			overrides: map[string]string{"pram.test.Message": "override"},
+			input:     new(testpb.NamedMessage),
+			exp:       "registry",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, in *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+					assert.DeepEqual(t, *in.TopicArn, tt.exp)
+					return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+				}).Times(1)
+
+			sut := pram.NewPublisher(snsc, pram.WithTopicARNOverride(tt.overrides), func(o *pram.PublisherOptions) {
+				o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+					return "registry", nil
+				}
+			})
+
+			_, err := sut.Publish(context.Background(), tt.input)
+			assert.ErrorExists(t, err, false)
+		})
+	}
+}
+
+func TestPublisher_PublishIdempotent(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSNSMockRecorder)
+		key   string
+		exp   string
+		err   bool
+	}{
+		{
+			name:  "should return an error if the key is empty",
+			setup: func(*mocks.MockSNSMockRecorder) {},
+			err:   true,
+		},
+		{
+			name: "should publish again if the previous publish failed",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				gomock.InOrder(
+					m.Publish(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1),
+					m.Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{
+						MessageId: aws.String("messageid"),
+					}, nil).Times(1),
+				)
+			},
+			key: "key",
+			exp: "messageid",
+		},
+		{
+			name: "should publish the message once and return the first message id",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{
+					MessageId: aws.String("messageid"),
+				}, nil).Times(1)
+			},
+			key: "key",
+			exp: "messageid",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			tt.setup(snsc.EXPECT())
+
+			sut := pram.NewPublisher(snsc, func(o *pram.PublisherOptions) {
+				o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+					return "topic", nil
+				}
+			})
+
+			var act string
+			var err error
+			for i := 0; i < 2; i++ {
+				act, err = sut.PublishIdempotent(context.Background(), tt.key, new(testpb.Message))
+			}
+
+			assert.ErrorExists(t, err, tt.err)
+			assert.DeepEqual(t, act, tt.exp)
+		})
+	}
+}
+
+func TestPublisher_Forward(t *testing.T) {
+	tests := []struct {
+		name  string
+		input pram.Metadata
+		exp   string
+		err   bool
+	}{
+		{
+			name:  "should return an error if the incoming id is empty",
+			input: pram.Metadata{CorrelationID: "correlationid"},
+			err:   true,
+		},
+		{
+			name:  "should use the incoming id as the correlation id",
+			input: pram.Metadata{ID: "incomingid"},
+			exp:   "incomingid",
+		},
+		{
+			name:  "should propagate the incoming correlation id",
+			input: pram.Metadata{ID: "incomingid", CorrelationID: "correlationid"},
+			exp:   "correlationid",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			var act string
+			snsc := mocks.NewMockSNS(ctrl)
+			if !tt.err {
+				snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, in *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+						b, err := base64.StdEncoding.DecodeString(*in.Message)
+						if err != nil {
+							return nil, err
+						}
+
+						m, err := pram.Unmarshal(b, new(testpb.Message))
+						if err != nil {
+							return nil, err
+						}
+
+						act = m.CorrelationID
+						return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+					}).Times(1)
+			}
+
+			sut := pram.NewPublisher(snsc, func(o *pram.PublisherOptions) {
+				o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+					return "topic", nil
+				}
+			})
+
+			var id string
+			var err error
+			for i := 0; i < 2; i++ {
+				id, err = sut.Forward(context.Background(), tt.input, new(testpb.Message))
+			}
+
+			assert.ErrorExists(t, err, tt.err)
+			if !tt.err {
+				assert.DeepEqual(t, id, "messageid")
+			}
+
+			if act != tt.exp {
+				t.Errorf("got %s, expected %s", act, tt.exp)
+			}
+		})
+	}
+}
+
+func TestPublisher_Republish(t *testing.T) {
+	ts := time.Date(2021, 7, 20, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		input pram.Message
+		err   bool
+	}{
+		{
+			name: "should return an error if the payload is nil",
+			input: pram.Message{
+				Metadata: pram.Metadata{ID: "id"},
+			},
+			err: true,
+		},
+		{
+			name: "should return an error if the id is empty",
+			input: pram.Message{
+				Payload: &testpb.Message{Value: "value"},
+			},
+			err: true,
+		},
+		{
+			name: "should preserve the metadata",
+			input: pram.Message{
+				Payload: &testpb.Message{Value: "value"},
+				Metadata: pram.Metadata{
+					ID:            "id",
+					Type:          "pram.test.Message",
+					CorrelationID: "correlationid",
+					Timestamp:     ts,
+					ReceiveCount:  5,
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			var in *sns.PublishInput
+			snsc := mocks.NewMockSNS(ctrl)
+			if !tt.err {
+				snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, i *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+						in = i
+						return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+					}).Times(1)
+			}
+
+			sut := pram.NewPublisher(snsc, func(o *pram.PublisherOptions) {
+				o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+					return "topic", nil
+				}
+			})
+
+			ctx := pram.ContextWithCorrelationID(context.Background(), "contextid")
+			err := sut.Republish(ctx, tt.input)
+			assert.ErrorExists(t, err, tt.err)
+			if tt.err {
+				return
+			}
+
+			act, err := pramtest.DecodeSNSPublishInput(in, new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+
+			assert.DeepEqual(t, act.ID, "id")
+			assert.DeepEqual(t, act.CorrelationID, "correlationid")
+			assert.DeepEqual(t, act.Timestamp, ts)
+			assert.DeepEqual(t, act.Payload.(*testpb.Message).Value, "value")
+		})
+	}
+}
+
+func TestPublisher_PublishCorrelationID(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		opts []func(*pram.Metadata)
+		exp  string
+	}{
+		{
+			name: "should not set the correlation id by default",
+			ctx:  context.Background(),
+			exp:  "",
+		},
+		{
+			name: "should use the context correlation id",
+			ctx:  pram.ContextWithCorrelationID(context.Background(), "context"),
+			exp:  "context",
+		},
+		{
+			name: "should prefer the explicit correlation id",
+			ctx:  pram.ContextWithCorrelationID(context.Background(), "context"),
+			opts: []func(*pram.Metadata){pram.WithCorrelationID("explicit")},
+			exp:  "explicit",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			var in *sns.PublishInput
+			snsc := mocks.NewMockSNS(ctrl)
+			snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, i *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+					in = i
+					return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+				}).Times(1)
+
+			sut := pram.NewPublisher(snsc, func(o *pram.PublisherOptions) {
+				o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+					return "topic", nil
+				}
+			})
+
+			_, err := sut.Publish(tt.ctx, new(testpb.Message), tt.opts...)
+			assert.ErrorExists(t, err, false)
+
+			m, err := pramtest.DecodeSNSPublishInput(in, new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+			assert.DeepEqual(t, m.CorrelationID, tt.exp)
+		})
+	}
+}
+
+func TestWithPublisherEncoding(t *testing.T) {
+	t.Run("should encode the message body", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var body string
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, in *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+				body = *in.Message
+				return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+			}).Times(1)
+
+		sut := pram.NewPublisher(snsc, pram.WithPublisherEncoding(base64.RawURLEncoding), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		_, err := sut.Publish(context.Background(), &testpb.Message{Value: "value"})
+		assert.ErrorExists(t, err, false)
+
+		b, err := base64.RawURLEncoding.DecodeString(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := pram.Unmarshal(b, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		if act, exp := m.Payload.(*testpb.Message).Value, "value"; act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+	})
+}
+
+func TestWithPublisherCodec(t *testing.T) {
+	t.Run("should publish text codecs without base64 encoding", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var body string
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, in *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+				body = *in.Message
+				return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+			}).Times(1)
+
+		sut := pram.NewPublisher(snsc, pram.WithPublisherCodec(pram.JSONCodec{}), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		_, err := sut.Publish(context.Background(), &testpb.Message{Value: "value"})
+		assert.ErrorExists(t, err, false)
+
+		m, err := pram.JSONCodec{}.Unmarshal([]byte(body), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		if act, exp := m.Payload.(*testpb.Message).Value, "value"; act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+	})
+}
+
+func TestWithPublisherChecksum(t *testing.T) {
+	t.Run("should include the payload checksum", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var body string
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, in *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+				body = *in.Message
+				return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+			}).Times(1)
+
+		sut := pram.NewPublisher(snsc, pram.WithPublisherChecksum(), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		_, err := sut.Publish(context.Background(), &testpb.Message{Value: "value"})
+		assert.ErrorExists(t, err, false)
+
+		b, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wm := new(prampb.Message)
+		if err = proto.Unmarshal(b, wm); err != nil {
+			t.Fatal(err)
+		}
+
+		if act := len(wm.Checksum); act != 4 {
+			t.Errorf("got %d, expected 4", act)
+		}
+
+		_, err = pram.Unmarshal(b, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestWithMessageAttribute(t *testing.T) {
+	tests := []struct {
+		name  string
+		optFn func(*pram.PublisherOptions)
+		mdFns []func(*pram.Metadata)
+		exp   map[string]snstypes.MessageAttributeValue
+	}{
+		{
+			name:  "should mirror the message type by default",
+			optFn: func(*pram.PublisherOptions) {},
+			exp: map[string]snstypes.MessageAttributeValue{
+				"pram.type": {DataType: aws.String("String"), StringValue: aws.String("pram.test.Message")},
+			},
+		},
+		{
+			name:  "should set string attributes",
+			optFn: func(*pram.PublisherOptions) {},
+			mdFns: []func(*pram.Metadata){
+				pram.WithMessageAttribute("region", "eu-west-1"),
+				pram.WithMessageAttribute("tenant", "tenant-a"),
+			},
+			exp: map[string]snstypes.MessageAttributeValue{
+				"pram.type": {DataType: aws.String("String"), StringValue: aws.String("pram.test.Message")},
+				"region":    {DataType: aws.String("String"), StringValue: aws.String("eu-west-1")},
+				"tenant":    {DataType: aws.String("String"), StringValue: aws.String("tenant-a")},
+			},
+		},
+		{
+			name: "should not set attributes if the type attribute is disabled",
+			optFn: func(o *pram.PublisherOptions) {
+				o.TypeAttribute = ""
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			var act map[string]snstypes.MessageAttributeValue
+			snsc := mocks.NewMockSNS(ctrl)
+			snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, in *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+					act = in.MessageAttributes
+					return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+				}).Times(1)
+
+			sut := pram.NewPublisher(snsc, tt.optFn, func(o *pram.PublisherOptions) {
+				o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+					return "topic", nil
+				}
+			})
+
+			_, err := sut.Publish(context.Background(), &testpb.Message{Value: "value"}, tt.mdFns...)
+			assert.ErrorExists(t, err, false)
+			assert.DeepEqual(t, act, tt.exp)
+		})
+	}
+}
+
+func TestWithMessageGroupID(t *testing.T) {
+	tests := []struct {
+		name   string
+		optFns []func(*pram.Metadata)
+		group  string
+		dedup  string
+	}{
+		{
+			name: "should not set fifo fields by default",
+		},
+		{
+			name:   "should default the deduplication id to the message id",
+			optFns: []func(*pram.Metadata){pram.WithMessageGroupID("group")},
+			group:  "group",
+		},
+		{
+			name:   "should set the deduplication id",
+			optFns: []func(*pram.Metadata){pram.WithMessageGroupID("group"), pram.WithMessageDeduplicationID("dedup")},
+			group:  "group",
+			dedup:  "dedup",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			var in *sns.PublishInput
+			snsc := mocks.NewMockSNS(ctrl)
+			snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, i *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+					in = i
+					return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+				}).Times(1)
+
+			sut := pram.NewPublisher(snsc, func(o *pram.PublisherOptions) {
+				o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+					return "topic.fifo", nil
+				}
+			})
+
+			_, err := sut.Publish(context.Background(), new(testpb.Message), tt.optFns...)
+			assert.ErrorExists(t, err, false)
+
+			if tt.group != "" && tt.dedup == "" {
+				b, err := base64.StdEncoding.DecodeString(*in.Message)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				m, err := pram.Unmarshal(b, new(testpb.Message))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				tt.dedup = m.ID
+			}
+
+			assert.DeepEqual(t, aws.ToString(in.MessageGroupId), tt.group)
+			assert.DeepEqual(t, aws.ToString(in.MessageDeduplicationId), tt.dedup)
+		})
+	}
+}
+
+func TestPublisher_DryRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		topicFn func(context.Context, proto.Message) (string, error)
+		input   proto.Message
+		err     bool
+	}{
+		{
+			name: "should return an error if the topic cannot be resolved",
+			topicFn: func(context.Context, proto.Message) (string, error) {
+				return "", errors.New("error")
+			},
+			input: new(testpb.Message),
+			err:   true,
+		},
+		{
+			name: "should return an error if the message is too large",
+			topicFn: func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			},
+			input: &testpb.Message{Value: strings.Repeat("a", 256*1024)},
+			err:   true,
+		},
+		{
+			name: "should not publish the message",
+			topicFn: func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			},
+			input: &testpb.Message{Value: "value"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			sut := pram.NewPublisher(snsc, func(o *pram.PublisherOptions) {
+				o.TopicARNFn = tt.topicFn
+			})
+
+			act, err := sut.DryRun(context.Background(), tt.input, pram.WithCorrelationID("correlationid"))
+			assert.ErrorExists(t, err, tt.err)
+
+			if err != nil {
+				return
+			}
+
+			if act.TopicARN != "topic" || act.Size < 1 {
+				t.Errorf("got %+v, expected a topic and size", act)
+			}
+
+			if act.Metadata.ID == "" || act.Metadata.Type != "pram.test.Message" || act.Metadata.CorrelationID != "correlationid" {
+				t.Errorf("got %+v, expected populated metadata", act.Metadata)
+			}
+		})
+	}
+
+	t.Run("should apply the publish middleware", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		sut := pram.NewPublisher(snsc, pram.WithPublisherMiddleware(func(next pram.PublishFunc) pram.PublishFunc {
+			return func(ctx context.Context, m proto.Message, md *pram.Metadata) error {
+				md.CorrelationID = "correlationid"
+				return next(ctx, m, md)
+			}
+		}), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		act, err := sut.DryRun(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act.Metadata.CorrelationID, "correlationid")
+	})
+
+	t.Run("should not create registry topics", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().ListTopics(gomock.Any(), gomock.Any()).Return(new(sns.ListTopicsOutput), nil).Times(1)
+
+		sut := pram.NewPublisher(snsc, pram.WithTopicRegistry(pram.NewRegistry(snsc, nil)))
+
+		_, err := sut.DryRun(context.Background(), new(testpb.Message))
+		if !errors.Is(err, pram.ErrNotFound) {
+			t.Errorf("got %v, expected %v", err, pram.ErrNotFound)
+		}
+	})
+}
+
+func TestWithPublisherMiddleware(t *testing.T) {
+	t.Run("should apply middleware before the message is marshalled", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var in *sns.PublishInput
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, i *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+				in = i
+				return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+			}).Times(1)
+
+		var calls []string
+		mw := func(name string) pram.PublishMiddleware {
+			return func(next pram.PublishFunc) pram.PublishFunc {
+				return func(ctx context.Context, m proto.Message, md *pram.Metadata) error {
+					calls = append(calls, name)
+					md.CorrelationID += name
+					return next(ctx, m, md)
+				}
+			}
+		}
+
+		sut := pram.NewPublisher(snsc, pram.WithPublisherMiddleware(mw("a"), mw("b")), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		id, err := sut.Publish(context.Background(), new(testpb.Message), pram.WithCorrelationID("id-"))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, id, "messageid")
+		assert.DeepEqual(t, calls, []string{"a", "b"})
+
+		m, err := pramtest.DecodeSNSPublishInput(in, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, m.CorrelationID, "id-ab")
+	})
+
+	t.Run("should allow middleware to short-circuit", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+
+		sut := pram.NewPublisher(snsc, pram.WithPublisherMiddleware(func(pram.PublishFunc) pram.PublishFunc {
+			return func(context.Context, proto.Message, *pram.Metadata) error {
+				return errors.New("error")
+			}
+		}), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		_, err := sut.Publish(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, true)
+	})
+}
+
+func TestWithIdempotencyStore(t *testing.T) {
+	t.Run("should update the options", func(t *testing.T) {
+		s := new(store.InMemoryStore)
+
+		o := pram.PublisherOptions{}
+		pram.WithIdempotencyStore(s)(&o)
+
+		if o.IdempotencyStore != s {
+			t.Errorf("got %v, expected %v", o.IdempotencyStore, s)
+		}
+	})
+}
+
+func TestWithIdempotencyTTL(t *testing.T) {
+	publishFn := func(p *pram.Publisher) error {
+		_, err := p.PublishIdempotent(context.Background(), "key", new(testpb.Message))
+		return err
+	}
+
+	forwardFn := func(p *pram.Publisher) error {
+		_, err := p.Forward(context.Background(), pram.Metadata{ID: "incomingid"}, new(testpb.Message))
+		return err
+	}
+
+	tests := []struct {
+		name  string
+		fn    func(*pram.Publisher) error
+		ttl   time.Duration
+		times int
+	}{
+		{
+			name:  "should publish once within the ttl",
+			fn:    publishFn,
+			ttl:   time.Minute,
+			times: 1,
+		},
+		{
+			name:  "should publish again once the ttl has elapsed",
+			fn:    publishFn,
+			ttl:   time.Millisecond,
+			times: 2,
+		},
+		{
+			name:  "should forward once within the ttl",
+			fn:    forwardFn,
+			ttl:   time.Minute,
+			times: 1,
+		},
+		{
+			name:  "should forward again once the ttl has elapsed",
+			fn:    forwardFn,
+			ttl:   time.Millisecond,
+			times: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{
+				MessageId: aws.String("messageid"),
+			}, nil).Times(tt.times)
+
+			sut := pram.NewPublisher(snsc, pram.WithIdempotencyTTL(tt.ttl), func(o *pram.PublisherOptions) {
+				o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+					return "topic", nil
+				}
+			})
+
+			for i := 0; i < 2; i++ {
+				err := tt.fn(sut)
+				assert.ErrorExists(t, err, false)
+
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestWithPublisherMetrics(t *testing.T) {
+	t.Run("should record published messages", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{
+			MessageId: aws.String("messageid"),
+		}, nil).Times(1)
+
+		m := new(metrics)
+		sut := pram.NewPublisher(snsc, pram.WithPublisherMetrics(m), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		_, err := sut.Publish(context.Background(), &testpb.Message{Value: "value"})
+		assert.ErrorExists(t, err, false)
+
+		if act, exp := m.published["pram.test.Message"], 1; act != exp {
+			t.Errorf("got %d, expected %d", act, exp)
+		}
+
+		if act := m.publishedSize["pram.test.Message"]; act < 1 {
+			t.Errorf("got %d, expected a positive size", act)
+		}
+	})
+
+	t.Run("should record publish errors", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+
+		m := new(metrics)
+		sut := pram.NewPublisher(snsc, pram.WithPublisherMetrics(m), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		_, err := sut.Publish(context.Background(), &testpb.Message{Value: "value"})
+		assert.ErrorExists(t, err, true)
+
+		assert.DeepEqual(t, m.publishErrors, map[string]int{"pram.test.Message": 1})
+		if act := m.published["pram.test.Message"]; act != 0 {
+			t.Errorf("got %d, expected 0", act)
+		}
+	})
+}
+
+func TestWithPublishRateLimit(t *testing.T) {
+	t.Run("should delay publishes over the limit", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{
+			MessageId: aws.String("messageid"),
+		}, nil).Times(2)
+
+		m := new(metrics)
+		sut := pram.NewPublisher(snsc, pram.WithPublishRateLimit(20, 1), pram.WithPublisherMetrics(m), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		st := time.Now()
+		for i := 0; i < 2; i++ {
+			_, err := sut.Publish(context.Background(), &testpb.Message{Value: "value"})
+			assert.ErrorExists(t, err, false)
+		}
+
+		if act := time.Since(st); act < 40*time.Millisecond {
+			t.Errorf("got %s, expected the second publish to be delayed", act)
+		}
+
+		if act, exp := m.throttled["pram.test.Message"], 1; act != exp {
+			t.Errorf("got %d, expected %d", act, exp)
+		}
+	})
+
+	t.Run("should return an error if the context is cancelled while waiting", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).Return(&sns.PublishOutput{
+			MessageId: aws.String("messageid"),
+		}, nil).Times(1)
+
+		sut := pram.NewPublisher(snsc, pram.WithPublishRateLimit(0.001, 1), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		_, err := sut.Publish(context.Background(), &testpb.Message{Value: "value"})
+		assert.ErrorExists(t, err, false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err = sut.Publish(ctx, &testpb.Message{Value: "value"})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, expected %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+type metrics struct {
+	mu            sync.Mutex
+	published     map[string]int
+	publishedSize map[string]int
+	publishErrors map[string]int
+	throttled     map[string]int
+	received      map[string]int
+	handled       map[string]int
+	handleErrors  map[string]int
+}
+
+func (m *metrics) IncPublished(messageType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.published == nil {
+		m.published = map[string]int{}
+	}
+	m.published[messageType]++
+}
+
+func (m *metrics) ObservePublishedSize(messageType string, size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.publishedSize == nil {
+		m.publishedSize = map[string]int{}
+	}
+	m.publishedSize[messageType] = size
+}
+
+func (m *metrics) IncPublishError(messageType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.publishErrors == nil {
+		m.publishErrors = map[string]int{}
+	}
+	m.publishErrors[messageType]++
+}
+
+func (m *metrics) IncReceived(messageType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.received == nil {
+		m.received = map[string]int{}
+	}
+	m.received[messageType]++
+}
+
+func (m *metrics) IncHandleError(messageType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.handleErrors == nil {
+		m.handleErrors = map[string]int{}
+	}
+	m.handleErrors[messageType]++
+}
+
+func (m *metrics) ObserveHandleDuration(messageType string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.handled == nil {
+		m.handled = map[string]int{}
+	}
+	m.handled[messageType]++
+}
+
+func (m *metrics) IncThrottled(messageType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.throttled == nil {
+		m.throttled = map[string]int{}
+	}
+	m.throttled[messageType]++
+}
@@ -2,12 +2,21 @@ package pram
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 
 	"github.com/stevecallear/pram/internal/aws"
 	"github.com/stevecallear/pram/internal/store"
+	"github.com/stevecallear/pram/proto/prampb"
 )
 
 type (
@@ -17,34 +26,107 @@ type (
 		GetOrSetQueueURL(ctx context.Context, queueName string, fn func() (string, error)) (string, error)
 	}
 
+	// RedisClient represents a redis client, allowing any redis library to be used with NewRedisStore
+	// Get must return false if the key does not exist, and SetNX must only set the value if the key does not exist.
+	// DelIfEqual must only delete the key if it holds the specified value, for example using a Lua script.
+	// Values must not expire if ttl is zero or less.
+	RedisClient interface {
+		Get(ctx context.Context, key string) (string, bool, error)
+		Set(ctx context.Context, key, value string, ttl time.Duration) error
+		SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+		Del(ctx context.Context, key string) error
+		DelIfEqual(ctx context.Context, key, value string) (bool, error)
+	}
+
+	invalidator interface {
+		Invalidate(ctx context.Context, key string) error
+	}
+
+	// InMemoryStore represents an in-memory store, which can also be used as an idempotency store
+	// Keys passed to Invalidate are the topic or queue name prefixed with "topic:" or "queue:" respectively.
+	InMemoryStore interface {
+		Store
+		IdempotencyStore
+		Count() (topics int, queues int)
+		Snapshot(w io.Writer) error
+		Restore(r io.Reader) error
+		Invalidate(ctx context.Context, key string) error
+	}
+
+	// InMemoryStoreOptions represents a set of in-memory store options
+	InMemoryStoreOptions struct {
+		TTL time.Duration
+	}
+
+	// RedisStore represents a redis store
+	RedisStore interface {
+		Store
+		Invalidate(ctx context.Context, key string) error
+	}
+
+	// CachedStore represents a store that caches values from a remote store in memory
+	CachedStore interface {
+		Store
+		Invalidate(ctx context.Context, key string) error
+	}
+
 	// Registry represents an infrastructure registry
 	Registry struct {
-		service *aws.Service
-		store   Store
-		topic   TopicOptions
-		queue   QueueOptions
+		service           *aws.Service
+		store             Store
+		topic             TopicOptions
+		queue             QueueOptions
+		ensureTimeout     time.Duration
+		ensureConcurrency int
+		group             singleflight.Group
+		subscriptions     sync.Map
 	}
 
 	// RegistryOptions represents a set of registry options
 	RegistryOptions struct {
-		Store Store
-		Topic TopicOptions
-		Queue QueueOptions
+		Store             Store
+		Topic             TopicOptions
+		Queue             QueueOptions
+		EnsureTimeout     time.Duration
+		EnsureConcurrency int
+		Metrics           EnsureMetrics
+		PolicyIDFn        func() string
+		LookupOnly        bool
+		SNSConcurrency    int
+		SQSConcurrency    int
 	}
 
+	// EnsureError represents the set of errors returned when ensuring multiple messages
+	EnsureError []error
+
 	// TopicOptions represents a set of topic options
 	TopicOptions struct {
-		NameFn func(proto.Message) string
+		NameFn           func(proto.Message) string
+		FIFO             bool
+		SourceAccountIDs []string
+		KMSKeyID         string
+		CreatedFn        func(topicName, topicARN string)
 	}
 
 	// QueueOptions represents a set of queue options
 	QueueOptions struct {
-		NameFn          func(proto.Message) string
-		ErrorNameFn     func(proto.Message) string
-		MaxReceiveCount int
+		NameFn                   func(proto.Message) string
+		ErrorNameFn              func(proto.Message) string
+		MaxReceiveCount          int
+		MaxReceiveCountFn        func(proto.Message) int
+		FIFO                     bool
+		FilterPolicy             map[string]interface{}
+		RawDelivery              bool
+		VisibilityTimeoutSeconds int
+		KMSKeyID                 string
+		ManagedSSE               bool
+		Attributes               map[string]string
 	}
 )
 
+// ErrNotFound is returned by a lookup only registry if a topic or queue does not exist
+var ErrNotFound = aws.ErrNotFound
+
 var defaultRegistryOptions = RegistryOptions{
 	Topic: TopicOptions{
 		NameFn: func(m proto.Message) string {
@@ -60,6 +142,7 @@ var defaultRegistryOptions = RegistryOptions{
 		},
 		MaxReceiveCount: 5,
 	},
+	EnsureConcurrency: 1,
 }
 
 // NewRegistry returns a new registry
@@ -73,60 +156,398 @@ func NewRegistry(snsc SNS, sqsc SQS, optFns ...func(*RegistryOptions)) *Registry
 		o.Store = new(store.InMemoryStore)
 	}
 
+	svc := aws.NewService(snsc, sqsc, logw)
+	if o.Metrics != nil {
+		svc.SetObserveFn(o.Metrics.ObserveEnsureDuration)
+	}
+	if o.PolicyIDFn != nil {
+		svc.SetPolicyIDFn(o.PolicyIDFn)
+	}
+	svc.SetLookupOnly(o.LookupOnly)
+	svc.SetConcurrencyLimit(o.SNSConcurrency, o.SQSConcurrency)
+
 	return &Registry{
-		service: aws.NewService(snsc, sqsc, Logf),
-		store:   o.Store,
-		topic:   o.Topic,
-		queue:   o.Queue,
+		service:           svc,
+		store:             o.Store,
+		topic:             o.Topic,
+		queue:             o.Queue,
+		ensureTimeout:     o.EnsureTimeout,
+		ensureConcurrency: o.EnsureConcurrency,
 	}
 }
 
 // TopicARN returns the topic arn for the specified message, or registers it if it does not exist
 func (r *Registry) TopicARN(ctx context.Context, m proto.Message) (string, error) {
-	tn := r.topic.NameFn(m)
-	return r.store.GetOrSetTopicARN(ctx, tn, func() (string, error) {
-		res, err := r.service.EnsureTopic(ctx, aws.EnsureTopicRequest{
-			TopicName: tn,
-		})
-		if err != nil {
-			return "", err
-		}
+	return r.topicARN(ctx, r.topicName(m))
+}
+
+// LookupTopicARN returns the topic arn for the specified message without creating or modifying the topic
+// An error wrapping ErrNotFound is returned if the topic does not exist. The store is not used, so that a topic
+// resolved by lookup is still ensured by TopicARN.
+func (r *Registry) LookupTopicARN(ctx context.Context, m proto.Message) (string, error) {
+	ctx, cancel := r.ensureContext(ctx)
+	defer cancel()
 
-		return res.TopicARN, nil
+	res, err := r.service.GetTopicARN(ctx, aws.GetTopicARNRequest{
+		TopicName: r.topicName(m),
 	})
+	if err != nil {
+		return "", err
+	}
+
+	return res.TopicARN, nil
 }
 
 // QueueURL returns the queue url for the specified message, or registers it if it does not exist
 func (r *Registry) QueueURL(ctx context.Context, m proto.Message) (string, error) {
-	tn := r.topic.NameFn(m)
-	ta, err := r.store.GetOrSetTopicARN(ctx, tn, func() (string, error) {
-		res, err := r.service.EnsureTopic(ctx, aws.EnsureTopicRequest{
-			TopicName: tn,
+	ta, err := r.topicARN(ctx, r.topicName(m))
+	if err != nil {
+		return "", err
+	}
+
+	qn := r.queueName(m)
+	return r.do("queue:"+qn, func() (string, error) {
+		return r.store.GetOrSetQueueURL(ctx, qn, func() (string, error) {
+			ctx, cancel := r.ensureContext(ctx)
+			defer cancel()
+
+			res, err := r.service.EnsureSubscription(ctx, aws.EnsureSubscriptionRequest{
+				TopicARN:                 ta,
+				QueueName:                qn,
+				ErrorQueueName:           r.errorQueueName(m),
+				MaxReceiveCount:          r.maxReceiveCount(m),
+				FIFO:                     r.queue.FIFO,
+				FilterPolicy:             r.queue.FilterPolicy,
+				RawDelivery:              r.queue.RawDelivery,
+				VisibilityTimeoutSeconds: r.queue.VisibilityTimeoutSeconds,
+				KMSKeyID:                 r.queue.KMSKeyID,
+				ManagedSSE:               r.queue.ManagedSSE,
+				Attributes:               r.queue.Attributes,
+			})
+			if err != nil {
+				return "", err
+			}
+
+			// subscription arns are retained so that they can be deleted on teardown
+			if res.SubscriptionARN != "" {
+				r.subscriptions.Store(qn, res.SubscriptionARN)
+			}
+
+			return res.QueueURL, nil
 		})
-		if err != nil {
-			return "", err
-		}
+	})
+}
+
+// ErrorQueueURL returns the error queue url for the specified message, registering the queues if they do not exist.
+// This can be used to configure alarms on the error queue depth.
+func (r *Registry) ErrorQueueURL(ctx context.Context, m proto.Message) (string, error) {
+	_, err := r.QueueURL(ctx, m)
+	if err != nil {
+		return "", err
+	}
+
+	qn := r.errorQueueName(m)
+	return r.do("queue:"+qn, func() (string, error) {
+		return r.store.GetOrSetQueueURL(ctx, qn, func() (string, error) {
+			ctx, cancel := r.ensureContext(ctx)
+			defer cancel()
+
+			res, err := r.service.GetQueueURL(ctx, aws.GetQueueURLRequest{
+				QueueName: qn,
+			})
+			if err != nil {
+				return "", err
+			}
 
-		return res.TopicARN, nil
+			return res.QueueURL, nil
+		})
 	})
+}
+
+// SubscribeEndpoint subscribes the specified endpoint to the topic for the specified message, returning the subscription arn.
+// This allows non-sqs consumers, such as lambda or https endpoints, to use the registry naming. Any policy required for the
+// topic to invoke the endpoint must be configured separately.
+func (r *Registry) SubscribeEndpoint(ctx context.Context, m proto.Message, protocol, endpoint string) (string, error) {
+	ta, err := r.TopicARN(ctx, m)
 	if err != nil {
 		return "", err
 	}
 
-	qn := r.queue.NameFn(m)
-	return r.store.GetOrSetQueueURL(ctx, qn, func() (string, error) {
-		res, err := r.service.EnsureSubscription(ctx, aws.EnsureSubscriptionRequest{
-			TopicARN:        ta,
-			QueueName:       qn,
-			ErrorQueueName:  r.queue.ErrorNameFn(m),
-			MaxReceiveCount: r.queue.MaxReceiveCount,
+	ctx, cancel := r.ensureContext(ctx)
+	defer cancel()
+
+	res, err := r.service.EnsureSubscription(ctx, aws.EnsureSubscriptionRequest{
+		TopicARN: ta,
+		Protocol: protocol,
+		Endpoint: endpoint,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return res.SubscriptionARN, nil
+}
+
+// EnsureTopics ensures that the topics for the specified messages exist, allowing infrastructure
+// to be provisioned at startup rather than on first publish
+func (r *Registry) EnsureTopics(ctx context.Context, ms ...proto.Message) error {
+	return r.ensure(ctx, ms, func(ctx context.Context, m proto.Message) error {
+		_, err := r.TopicARN(ctx, m)
+		return err
+	})
+}
+
+// EnsureQueues ensures that the topics, queues and subscriptions for the specified messages exist,
+// allowing infrastructure to be provisioned at startup rather than on first subscribe
+func (r *Registry) EnsureQueues(ctx context.Context, ms ...proto.Message) error {
+	return r.ensure(ctx, ms, func(ctx context.Context, m proto.Message) error {
+		_, err := r.QueueURL(ctx, m)
+		return err
+	})
+}
+
+func (r *Registry) ensure(ctx context.Context, ms []proto.Message, fn func(context.Context, proto.Message) error) error {
+	n := r.ensureConcurrency
+	if n < 1 {
+		n = 1
+	}
+
+	errs := make([]error, len(ms))
+	sem := make(chan struct{}, n)
+	wg := new(sync.WaitGroup)
+
+	for i, m := range ms {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, m proto.Message) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := fn(ctx, m); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", MessageName(m), err)
+			}
+		}(i, m)
+	}
+
+	wg.Wait()
+
+	var ee EnsureError
+	for _, err := range errs {
+		if err != nil {
+			ee = append(ee, err)
+		}
+	}
+
+	if len(ee) > 0 {
+		return ee
+	}
+
+	return nil
+}
+
+// Error returns the combined error messages
+func (e EnsureError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// PurgeQueue deletes all messages from the queue for the specified message
+// AWS only allows a queue to be purged once every 60 seconds, subsequent requests will
+// return an error wrapping *types.PurgeQueueInProgress
+func (r *Registry) PurgeQueue(ctx context.Context, m proto.Message) error {
+	return r.purgeQueue(ctx, r.queueName(m))
+}
+
+// PurgeErrorQueue deletes all messages from the error queue for the specified message
+// The same 60 second purge restriction applies as for PurgeQueue
+func (r *Registry) PurgeErrorQueue(ctx context.Context, m proto.Message) error {
+	return r.purgeQueue(ctx, r.errorQueueName(m))
+}
+
+func (r *Registry) purgeQueue(ctx context.Context, queueName string) error {
+	return r.service.PurgeQueue(ctx, aws.PurgeQueueRequest{
+		QueueName: queueName,
+	})
+}
+
+// Teardown deletes the topic, queues and subscription for each of the specified messages and removes them from the store.
+// Resources that do not exist are ignored. This is intended for integration tests and ephemeral environments, as deleting
+// a topic also deletes any subscriptions created by other services. Any errors are returned as an EnsureError.
+func (r *Registry) Teardown(ctx context.Context, ms ...proto.Message) error {
+	return r.ensure(ctx, ms, r.teardown)
+}
+
+func (r *Registry) teardown(ctx context.Context, m proto.Message) (err error) {
+	// the store is invalidated regardless of the outcome, as resources may have been partially deleted
+	defer func() {
+		if ierr := r.Invalidate(ctx, m); err == nil {
+			err = ierr
+		}
+	}()
+
+	qn := r.queueName(m)
+	if sa, ok := r.subscriptions.Load(qn); ok {
+		err := r.service.Unsubscribe(ctx, aws.UnsubscribeRequest{
+			SubscriptionARN: sa.(string),
+		})
+		if err != nil {
+			return err
+		}
+
+		r.subscriptions.Delete(qn)
+	}
+
+	for _, n := range []string{qn, r.errorQueueName(m)} {
+		err := r.service.DeleteQueue(ctx, aws.DeleteQueueRequest{
+			QueueName: n,
 		})
 		if err != nil {
-			return "", err
+			return err
+		}
+	}
+
+	return r.service.DeleteTopic(ctx, aws.DeleteTopicRequest{
+		TopicName: r.topicName(m),
+	})
+}
+
+// Invalidate removes the topic and queues for the specified message from the store, so that they are ensured
+// again on next use. This can be used to recover after a failure caused by infrastructure being deleted out-of-band.
+// It has no effect if the configured store does not support invalidation.
+func (r *Registry) Invalidate(ctx context.Context, m proto.Message) error {
+	s, ok := r.store.(invalidator)
+	if !ok {
+		return nil
+	}
+
+	// all keys are invalidated, with the first error returned
+	var err error
+	for _, k := range []string{"topic:" + r.topicName(m), "queue:" + r.queueName(m), "queue:" + r.errorQueueName(m)} {
+		if ierr := s.Invalidate(ctx, k); ierr != nil && err == nil {
+			err = ierr
 		}
+	}
+
+	return err
+}
+
+func (r *Registry) topicARN(ctx context.Context, topicName string) (string, error) {
+	return r.do("topic:"+topicName, func() (string, error) {
+		return r.store.GetOrSetTopicARN(ctx, topicName, func() (string, error) {
+			ctx, cancel := r.ensureContext(ctx)
+			defer cancel()
+
+			res, err := r.service.EnsureTopic(ctx, aws.EnsureTopicRequest{
+				TopicName:        topicName,
+				FIFO:             r.topic.FIFO,
+				SourceAccountIDs: r.topic.SourceAccountIDs,
+				KMSKeyID:         r.topic.KMSKeyID,
+				DetectCreated:    r.topic.CreatedFn != nil,
+			})
+			if err != nil {
+				return "", err
+			}
+
+			if res.Created {
+				r.topic.CreatedFn(topicName, res.TopicARN)
+			}
+
+			return res.TopicARN, nil
+		})
+	})
+}
+
+// fifo names are suffixed after the naming funcs are applied, ensuring that any naming func produces a valid name
+func (r *Registry) topicName(m proto.Message) string {
+	return fifoName(r.topic.NameFn(m), r.topic.FIFO)
+}
+
+func (r *Registry) queueName(m proto.Message) string {
+	return fifoName(r.queue.NameFn(m), r.queue.FIFO)
+}
+
+func (r *Registry) errorQueueName(m proto.Message) string {
+	return fifoName(r.queue.ErrorNameFn(m), r.queue.FIFO)
+}
+
+// maxReceiveCount returns the max receive count for the message type, falling back to the static count
+// if no function is configured or it returns zero
+func (r *Registry) maxReceiveCount(m proto.Message) int {
+	if r.queue.MaxReceiveCountFn != nil {
+		if n := r.queue.MaxReceiveCountFn(m); n > 0 {
+			return n
+		}
+	}
 
-		return res.QueueURL, nil
+	return r.queue.MaxReceiveCount
+}
+
+func fifoName(name string, fifo bool) string {
+	if fifo {
+		return name + fifoSuffix
+	}
+
+	return name
+}
+
+// do ensures that only one resolution is in flight for the specified key, regardless of the store
+// implementation. Concurrent callers share the result, including any error from the first caller context.
+func (r *Registry) do(key string, fn func() (string, error)) (string, error) {
+	v, err, _ := r.group.Do(key, func() (interface{}, error) {
+		return fn()
 	})
+	if err != nil {
+		return "", err
+	}
+
+	return v.(string), nil
+}
+
+func (r *Registry) ensureContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.ensureTimeout > 0 {
+		return context.WithTimeout(ctx, r.ensureTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// NewInMemoryStore returns a new in-memory store that holds at most maxSize items, evicting the least
+// recently used item once the limit is reached. Evicted topics and queues are re-ensured on next use.
+// The store is unbounded if maxSize is zero or less, which is the behaviour of the default store.
+func NewInMemoryStore(maxSize int, optFns ...func(*InMemoryStoreOptions)) InMemoryStore {
+	var o InMemoryStoreOptions
+	for _, fn := range optFns {
+		fn(&o)
+	}
+
+	return store.NewInMemoryStore(maxSize, store.WithTTL(o.TTL))
+}
+
+// WithStoreTTL configures the in-memory store to expire topics and queues after the specified duration,
+// so that they are ensured again if they have been deleted out-of-band
+func WithStoreTTL(ttl time.Duration) func(*InMemoryStoreOptions) {
+	return func(o *InMemoryStoreOptions) {
+		o.TTL = ttl
+	}
+}
+
+// NewRedisStore returns a new redis store, which retains resolved topics and queues across restarts
+// All keys are prefixed with the specified prefix, and values expire after the specified ttl, or never expire
+// if ttl is zero or less. Concurrent callers in other processes wait for the first caller to ensure a value.
+func NewRedisStore(client RedisClient, prefix string, ttl time.Duration) RedisStore {
+	return store.NewRedisStore(client, prefix, ttl)
+}
+
+// NewCachedStore returns a new store that caches values from the remote store in memory for the specified ttl,
+// avoiding a remote lookup for frequently used types. New values are written through to the remote store.
+// Values are cached indefinitely if ttl is zero or less.
+func NewCachedStore(remote Store, ttl time.Duration) CachedStore {
+	return store.Cached(remote, ttl)
 }
 
 // WithStore configures the registry to use the specified store
@@ -136,6 +557,149 @@ func WithStore(s Store) func(*RegistryOptions) {
 	}
 }
 
+// WithStartupEnsureTimeout configures the registry to bound the time taken to ensure infrastructure
+// The timeout is applied to the caller context, so the shorter of the timeout and any caller deadline applies.
+func WithStartupEnsureTimeout(d time.Duration) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.EnsureTimeout = d
+	}
+}
+
+// WithEnsureConcurrency configures the number of messages that are ensured concurrently
+// by EnsureTopics and EnsureQueues
+func WithEnsureConcurrency(n int) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.EnsureConcurrency = n
+	}
+}
+
+// WithServiceConcurrency configures the maximum number of concurrent sns and sqs calls made by the registry
+// This caps the total number of control plane calls across all message types, which avoids throttling during mass
+// startup. Calls wait for capacity, so the ensure timeout should allow for the wait. The wait is not included in
+// observed ensure durations. Zero values are unlimited.
+func WithServiceConcurrency(sns, sqs int) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.SNSConcurrency = sns
+		o.SQSConcurrency = sqs
+	}
+}
+
+// WithRegistryMetrics configures the registry to record the duration of each aws call made when ensuring
+// infrastructure, which can be used to diagnose slow cold starts caused by throttling or network issues.
+func WithRegistryMetrics(m EnsureMetrics) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Metrics = m
+	}
+}
+
+// WithTopicCreatedAlert configures the registry to call the specified func when a topic is created, rather than resolved.
+// This can be used to detect typos or message renames that publish to a new topic with no subscribers. Detection requires
+// an additional sns:GetTopicAttributes call each time a topic is ensured.
+func WithTopicCreatedAlert(fn func(topicName, topicARN string)) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Topic.CreatedFn = fn
+	}
+}
+
+// WithKMSKeyID configures the registry to encrypt created topics and queues using the specified kms key
+// The key policy must allow sns to use the key for messages to be delivered to encrypted queues, see KMSKeyPolicyStatement.
+func WithKMSKeyID(keyID string) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Topic.KMSKeyID = keyID
+		o.Queue.KMSKeyID = keyID
+	}
+}
+
+// WithManagedSSE configures the registry to encrypt created queues using sqs managed keys
+// This has no effect if a kms key is configured.
+func WithManagedSSE() func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Queue.ManagedSSE = true
+	}
+}
+
+// KMSKeyPolicyStatement returns a kms key policy statement that allows sns to deliver messages to queues encrypted
+// with the key, which should be added to the key policy. If topic arns are specified then the statement is restricted
+// to those topics.
+func KMSKeyPolicyStatement(topicARNs ...string) (string, error) {
+	return aws.KMSKeyPolicyStatement(nil, topicARNs...)
+}
+
+// WithLookupOnly configures the registry to resolve existing topics and queues without creating or modifying them
+// This allows infrastructure to be provisioned separately, with the registry only requiring sns:ListTopics and
+// sqs:GetQueueUrl permissions. An error wrapping ErrNotFound is returned if a topic or queue does not exist.
+func WithLookupOnly() func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.LookupOnly = true
+	}
+}
+
+// WithPolicyIDFn configures the registry to generate topic and queue access policy ids using the specified func
+// By default random ids are generated, so the policies differ each time infrastructure is ensured.
+func WithPolicyIDFn(fn func() string) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.PolicyIDFn = fn
+	}
+}
+
+// WithSourceAccountIDs configures the registry to permit the specified accounts to publish to created topics
+// The topic account is always permitted. This is required when publishers are in a different account to the topics.
+func WithSourceAccountIDs(ids ...string) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Topic.SourceAccountIDs = ids
+	}
+}
+
+// WithFIFO configures the registry to create fifo topics and queues, appending the .fifo suffix to all names.
+// The error queue of a fifo queue must also be fifo. Use a separate registry for messages that require ordering.
+func WithFIFO() func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Topic.FIFO = true
+		o.Queue.FIFO = true
+	}
+}
+
+// WithFilterPolicy configures the registry to apply the specified sns filter policy to created queue subscriptions
+// The policy applies to all queues created by the registry, so it is typically combined with WithMessageAttribute.
+func WithFilterPolicy(policy map[string]interface{}) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Queue.FilterPolicy = policy
+	}
+}
+
+// WithQueueVisibilityTimeout configures the registry to set the default visibility timeout of created queues
+// Subscribers override the default on each receive, see SubscriberOptions.VisibilityTimeoutSeconds, so the default
+// only applies to other consumers. The queue is updated each time it is ensured.
+func WithQueueVisibilityTimeout(seconds int) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Queue.VisibilityTimeoutSeconds = seconds
+	}
+}
+
+// WithQueueAttributes configures the registry to set the specified attributes on created queues and error queues
+// For example MessageRetentionPeriod, MaximumMessageSize or DelaySeconds. Attributes managed by the registry,
+// such as Policy and RedrivePolicy, are ignored. The queues are updated each time they are ensured.
+func WithQueueAttributes(attrs map[string]string) func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		if o.Queue.Attributes == nil {
+			o.Queue.Attributes = make(map[string]string, len(attrs))
+		}
+
+		for k, v := range attrs {
+			o.Queue.Attributes[k] = v
+		}
+	}
+}
+
+// WithRawDelivery configures the registry to enable raw message delivery for created queue subscriptions
+// Message bodies then contain the encoded payload without the sns envelope, which allows non-pram consumers to read them.
+// SNS message attributes are delivered as sqs message attributes, so must be requested using WithMessageAttributeNames.
+func WithRawDelivery() func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Queue.RawDelivery = true
+	}
+}
+
 // WithPrefixNaming configures the registry to use prefix naming to support complex message routing
 // It applies the following format, assuming a protobuf type name of package.Message:
 //  topic: stage-package-Message
@@ -154,3 +718,78 @@ func WithPrefixNaming(stage, service string) func(*RegistryOptions) {
 		}
 	}
 }
+
+// WithEnvPrefixNaming configures the registry to use prefix naming with the stage and service
+// read from the specified environment variables. An error is returned if either is empty.
+func WithEnvPrefixNaming(stageKey, serviceKey string) (func(*RegistryOptions), error) {
+	for _, k := range []string{stageKey, serviceKey} {
+		if os.Getenv(k) == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", k)
+		}
+	}
+
+	return WithPrefixNaming(os.Getenv(stageKey), os.Getenv(serviceKey)), nil
+}
+
+// WithSegmentedNaming configures the registry to prefix names with an arbitrary number of segments
+// The final segment identifies the subscribing service, so is only applied to queue names, e.g.:
+//  topic: org-team-stage-package-Message
+//  queue: org-team-stage-service-package-Message
+//  error: org-team-stage-service-package-Message_error
+// An error is returned if no segments are specified, or if any segment is empty.
+func WithSegmentedNaming(segments ...string) (func(*RegistryOptions), error) {
+	if len(segments) < 1 {
+		return nil, errors.New("no naming segments specified")
+	}
+
+	for i, s := range segments {
+		if s == "" {
+			return nil, fmt.Errorf("naming segment %d is empty", i)
+		}
+	}
+
+	qp := strings.Join(segments, "-") + "-"
+	tp := strings.Join(segments[:len(segments)-1], "-")
+	if tp != "" {
+		tp += "-"
+	}
+
+	return func(o *RegistryOptions) {
+		o.Topic.NameFn = func(m proto.Message) string {
+			return tp + MessageName(m)
+		}
+		o.Queue.NameFn = func(m proto.Message) string {
+			return qp + MessageName(m)
+		}
+		o.Queue.ErrorNameFn = func(m proto.Message) string {
+			return qp + MessageName(m) + "_error"
+		}
+	}, nil
+}
+
+// WithOptionNaming configures the registry to use the pram.topic_name and pram.queue_name message options
+// to name infrastructure, falling back to the message name if an option is not set
+func WithOptionNaming() func(*RegistryOptions) {
+	return func(o *RegistryOptions) {
+		o.Topic.NameFn = OptionNameFn(prampb.E_TopicName)
+		o.Queue.NameFn = OptionNameFn(prampb.E_QueueName)
+		o.Queue.ErrorNameFn = func(m proto.Message) string {
+			return OptionNameFn(prampb.E_QueueName)(m) + "_error"
+		}
+	}
+}
+
+// OptionNameFn returns a naming func that reads the specified string message option,
+// falling back to the message name if the option is not set
+func OptionNameFn(xt protoreflect.ExtensionType) func(proto.Message) string {
+	return func(m proto.Message) string {
+		opts := m.ProtoReflect().Descriptor().Options()
+		if proto.HasExtension(opts, xt) {
+			if n, ok := proto.GetExtension(opts, xt).(string); ok && n != "" {
+				return n
+			}
+		}
+
+		return MessageName(m)
+	}
+}
@@ -1,14 +1,21 @@
 package pram_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/golang/mock/gomock"
+	"github.com/tidwall/gjson"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/stevecallear/pram"
@@ -84,6 +91,96 @@ func TestRegistry_TopicARN(t *testing.T) {
 	}
 }
 
+func TestRegistry_LookupTopicARN(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSNSMockRecorder)
+		exp   string
+		err   error
+	}{
+		{
+			name: "should return an error if the topic does not exist",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.ListTopics(gomock.Any(), gomock.Any()).Return(new(sns.ListTopicsOutput), nil).Times(1)
+			},
+			err: pram.ErrNotFound,
+		},
+		{
+			name: "should return the existing topic arn",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.ListTopics(gomock.Any(), gomock.Any()).Return(&sns.ListTopicsOutput{
+					Topics: []snstypes.Topic{{TopicArn: aws.String(topicARN)}},
+				}, nil).Times(1)
+			},
+			exp: topicARN,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			tt.setup(snsc.EXPECT())
+
+			st := store.NewInMemoryStore(0)
+			sut := pram.NewRegistry(snsc, nil, pram.WithStore(st))
+
+			act, err := sut.LookupTopicARN(context.Background(), new(testpb.Message))
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, expected %v", err, tt.err)
+			}
+			assert.DeepEqual(t, act, tt.exp)
+
+			topics, _ := st.Count()
+			assert.DeepEqual(t, topics, 0)
+		})
+	}
+}
+
+func TestRegistry_TopicARNConcurrency(t *testing.T) {
+	t.Run("should ensure the topic once for concurrent callers", func(t *testing.T) {
+		const n = 10
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		gomock.InOrder(
+			snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(context.Context, *sns.CreateTopicInput, ...func(*sns.Options)) (*sns.CreateTopicOutput, error) {
+					time.Sleep(10 * time.Millisecond)
+					return newCreateTopicOutput(), nil
+				}).Times(1),
+			snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+		)
+
+		sut := pram.NewRegistry(snsc, nil, pram.WithStore(new(passthroughStore)))
+
+		start := make(chan struct{})
+		wg := new(sync.WaitGroup)
+		wg.Add(n)
+
+		for i := 0; i < n; i++ {
+			go func() {
+				defer wg.Done()
+				<-start
+
+				act, err := sut.TopicARN(context.Background(), new(testpb.Message))
+				assert.ErrorExists(t, err, false)
+
+				if act != topicARN {
+					t.Errorf("got %s, expected %s", act, topicARN)
+				}
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+	})
+}
+
 func TestRegistry_QueueURL(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -172,66 +269,1171 @@ func TestRegistry_QueueURL(t *testing.T) {
 	}
 }
 
-func TestWithPrefixNaming(t *testing.T) {
-	t.Run("should configure the options", func(t *testing.T) {
-		o := pram.RegistryOptions{}
-		pram.WithPrefixNaming("stage", "service")(&o)
+func TestWithRegistryMetrics(t *testing.T) {
+	t.Run("should observe the duration of each operation", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
 
-		exp := "stage-pram-test-Message"
-		act := o.Topic.NameFn(new(testpb.Message))
+		snsc := mocks.NewMockSNS(ctrl)
+		sqsc := mocks.NewMockSQS(ctrl)
 
-		if act != exp {
-			t.Errorf("got %s, expected %s", act, exp)
-		}
+		gomock.InOrder(
+			snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1),
+			snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
 
-		exp = "stage-service-pram-test-Message"
-		act = o.Queue.NameFn(new(testpb.Message))
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(true), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(true), nil).Times(1),
 
-		if act != exp {
-			t.Errorf("got %s, expected %s", act, exp)
-		}
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(false), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(false), nil).Times(1),
 
-		exp = "stage-service-pram-test-Message_error"
-		act = o.Queue.ErrorNameFn(new(testpb.Message))
+			sqsc.EXPECT().SetQueueAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
 
-		if act != exp {
-			t.Errorf("got %s, expected %s", act, exp)
-		}
+			snsc.EXPECT().Subscribe(gomock.Any(), gomock.Any()).Return(newSubscribeOutput(), nil).Times(1),
+		)
+
+		m := new(ensureMetrics)
+		sut := pram.NewRegistry(snsc, sqsc, pram.WithRegistryMetrics(m))
+
+		_, err := sut.QueueURL(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		assert.DeepEqual(t, m.operations, []string{
+			"create_topic",
+			"set_topic_attributes",
+			"create_queue",
+			"get_queue_attributes",
+			"create_queue",
+			"get_queue_attributes",
+			"set_queue_attributes",
+			"subscribe",
+		})
 	})
 }
 
-func newCreateTopicOutput() *sns.CreateTopicOutput {
-	return &sns.CreateTopicOutput{
-		TopicArn: aws.String(topicARN),
-	}
+type ensureMetrics struct {
+	operations []string
 }
 
-func newCreateQueueOutput(errorQueue bool) *sqs.CreateQueueOutput {
-	url := queueURL
-	if errorQueue {
-		url = url + "_error"
+func (m *ensureMetrics) ObserveEnsureDuration(operation string, _ time.Duration) {
+	m.operations = append(m.operations, operation)
+}
+
+func TestWithPolicyIDFn(t *testing.T) {
+	t.Run("should generate policy ids using the func", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1)
+		snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, in *sns.SetTopicAttributesInput, _ ...func(*sns.Options)) (*sns.SetTopicAttributesOutput, error) {
+				if act, exp := gjson.Get(*in.AttributeValue, "Id").Str, "policy-id"; act != exp {
+					t.Errorf("got %s, expected %s", act, exp)
+				}
+				return nil, nil
+			}).Times(1)
+
+		sut := pram.NewRegistry(snsc, nil, pram.WithPolicyIDFn(func() string {
+			return "policy-id"
+		}))
+
+		_, err := sut.TopicARN(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestWithTopicCreatedAlert(t *testing.T) {
+	tests := []struct {
+		name     string
+		policyID string
+		exp      []string
+	}{
+		{
+			name:     "should call the func for new topics",
+			policyID: "__default_policy_ID",
+			exp:      []string{messageName, topicARN},
+		},
+		{
+			name:     "should not call the func for existing topics",
+			policyID: "policyid",
+		},
 	}
 
-	return &sqs.CreateQueueOutput{
-		QueueUrl: aws.String(url),
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			gomock.InOrder(
+				snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1),
+				snsc.EXPECT().GetTopicAttributes(gomock.Any(), gomock.Any()).Return(&sns.GetTopicAttributesOutput{
+					Attributes: map[string]string{"Policy": `{"Id":"` + tt.policyID + `"}`},
+				}, nil).Times(1),
+				snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+			)
+
+			var act []string
+			sut := pram.NewRegistry(snsc, nil, pram.WithTopicCreatedAlert(func(topicName, topicARN string) {
+				act = []string{topicName, topicARN}
+			}))
+
+			_, err := sut.TopicARN(context.Background(), new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+			assert.DeepEqual(t, act, tt.exp)
+		})
 	}
 }
 
-func newGetQueueAttributesOutput(errorQueue bool) *sqs.GetQueueAttributesOutput {
-	arn := queueARN
-	if errorQueue {
-		arn = arn + "_error"
+func TestWithKMSKeyID(t *testing.T) {
+	t.Run("should encrypt the topic and queues", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		sqsc := mocks.NewMockSQS(ctrl)
+
+		gomock.InOrder(
+			snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1),
+			snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+			snsc.EXPECT().SetTopicAttributes(gomock.Any(), &sns.SetTopicAttributesInput{
+				TopicArn:       aws.String(topicARN),
+				AttributeName:  aws.String("KmsMasterKeyId"),
+				AttributeValue: aws.String("alias/key"),
+			}).Return(nil, nil).Times(1),
+
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(true), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(true), nil).Times(1),
+			sqsc.EXPECT().SetQueueAttributes(gomock.Any(), &sqs.SetQueueAttributesInput{
+				QueueUrl:   aws.String(queueURL + "_error"),
+				Attributes: map[string]string{"KmsMasterKeyId": "alias/key"},
+			}).Return(nil, nil).Times(1),
+
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(false), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(false), nil).Times(1),
+			sqsc.EXPECT().SetQueueAttributes(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, in *sqs.SetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+					if act, exp := in.Attributes["KmsMasterKeyId"], "alias/key"; act != exp {
+						t.Errorf("got %s, expected %s", act, exp)
+					}
+					return nil, nil
+				}).Times(1),
+
+			snsc.EXPECT().Subscribe(gomock.Any(), gomock.Any()).Return(newSubscribeOutput(), nil).Times(1),
+		)
+
+		sut := pram.NewRegistry(snsc, sqsc, pram.WithKMSKeyID("alias/key"))
+
+		_, err := sut.QueueURL(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestWithQueueAttributes(t *testing.T) {
+	t.Run("should set the queue attributes", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		sqsc := mocks.NewMockSQS(ctrl)
+
+		gomock.InOrder(
+			snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1),
+			snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(true), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(true), nil).Times(1),
+			sqsc.EXPECT().SetQueueAttributes(gomock.Any(), &sqs.SetQueueAttributesInput{
+				QueueUrl:   aws.String(queueURL + "_error"),
+				Attributes: map[string]string{"MessageRetentionPeriod": "1209600", "MaximumMessageSize": "1024"},
+			}).Return(nil, nil).Times(1),
+
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(false), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(false), nil).Times(1),
+			sqsc.EXPECT().SetQueueAttributes(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, in *sqs.SetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+					for k, exp := range map[string]string{"MessageRetentionPeriod": "1209600", "MaximumMessageSize": "1024"} {
+						if act := in.Attributes[k]; act != exp {
+							t.Errorf("got %s, expected %s", act, exp)
+						}
+					}
+					if act := in.Attributes["Policy"]; act == "policy" {
+						t.Errorf("got %s, expected managed policy", act)
+					}
+					return nil, nil
+				}).Times(1),
+
+			snsc.EXPECT().Subscribe(gomock.Any(), gomock.Any()).Return(newSubscribeOutput(), nil).Times(1),
+		)
+
+		sut := pram.NewRegistry(snsc, sqsc,
+			pram.WithQueueAttributes(map[string]string{"MessageRetentionPeriod": "1209600", "Policy": "policy"}),
+			pram.WithQueueAttributes(map[string]string{"MaximumMessageSize": "1024"}))
+
+		_, err := sut.QueueURL(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestRegistry_MaxReceiveCountFn(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(proto.Message) int
+		exp  int64
+	}{
+		{
+			name: "should use the message type count",
+			fn: func(m proto.Message) int {
+				if _, ok := m.(*testpb.Message); ok {
+					return 10
+				}
+				return 0
+			},
+			exp: 10,
+		},
+		{
+			name: "should fall back to the static count",
+			fn: func(proto.Message) int {
+				return 0
+			},
+			exp: 5,
+		},
 	}
 
-	return &sqs.GetQueueAttributesOutput{
-		Attributes: map[string]string{
-			"QueueArn": arn,
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			sqsc := mocks.NewMockSQS(ctrl)
+
+			gomock.InOrder(
+				snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1),
+				snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+
+				sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(true), nil).Times(1),
+				sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(true), nil).Times(1),
+
+				sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(false), nil).Times(1),
+				sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(false), nil).Times(1),
+				sqsc.EXPECT().SetQueueAttributes(gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, in *sqs.SetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+						act := gjson.Get(in.Attributes["RedrivePolicy"], "maxReceiveCount").Int()
+						if act != tt.exp {
+							t.Errorf("got %d, expected %d", act, tt.exp)
+						}
+						return nil, nil
+					}).Times(1),
+
+				snsc.EXPECT().Subscribe(gomock.Any(), gomock.Any()).Return(newSubscribeOutput(), nil).Times(1),
+			)
+
+			sut := pram.NewRegistry(snsc, sqsc, func(o *pram.RegistryOptions) {
+				o.Queue.MaxReceiveCountFn = tt.fn
+			})
+
+			_, err := sut.QueueURL(context.Background(), new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+		})
+	}
+}
+
+func TestWithLookupOnly(t *testing.T) {
+	t.Run("should resolve existing infrastructure", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		sqsc := mocks.NewMockSQS(ctrl)
+
+		gomock.InOrder(
+			snsc.EXPECT().ListTopics(gomock.Any(), gomock.Any()).Return(&sns.ListTopicsOutput{
+				Topics: []snstypes.Topic{{TopicArn: aws.String(topicARN)}},
+			}, nil).Times(1),
+			sqsc.EXPECT().GetQueueUrl(gomock.Any(), &sqs.GetQueueUrlInput{
+				QueueName: aws.String(messageName),
+			}).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL)}, nil).Times(1),
+		)
+
+		sut := pram.NewRegistry(snsc, sqsc, pram.WithLookupOnly())
+
+		act, err := sut.QueueURL(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, queueURL)
+	})
+
+	t.Run("should return an error if the topic does not exist", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().ListTopics(gomock.Any(), gomock.Any()).Return(new(sns.ListTopicsOutput), nil).Times(1)
+
+		sut := pram.NewRegistry(snsc, nil, pram.WithLookupOnly())
+
+		_, err := sut.TopicARN(context.Background(), new(testpb.Message))
+		if !errors.Is(err, pram.ErrNotFound) {
+			t.Errorf("got %v, expected %v", err, pram.ErrNotFound)
+		}
+	})
+}
+
+func TestRegistry_ErrorQueueURL(t *testing.T) {
+	errorQueueURL := queueURL + "_error"
+
+	tests := []struct {
+		name  string
+		setup func(pram.Store, *mocks.MockSQSMockRecorder)
+		exp   string
+		err   bool
+	}{
+		{
+			name: "should return an error if the queue cannot be ensured",
+			setup: func(s pram.Store, qc *mocks.MockSQSMockRecorder) {
+				s.GetOrSetTopicARN(context.Background(), messageName, func() (string, error) {
+					return topicARN, nil
+				})
+				qc.CreateQueue(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			err: true,
+		},
+		{
+			name: "should return an error if the error queue url cannot be retrieved",
+			setup: func(s pram.Store, qc *mocks.MockSQSMockRecorder) {
+				s.GetOrSetTopicARN(context.Background(), messageName, func() (string, error) {
+					return topicARN, nil
+				})
+				s.GetOrSetQueueURL(context.Background(), messageName, func() (string, error) {
+					return queueURL, nil
+				})
+				qc.GetQueueUrl(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			err: true,
+		},
+		{
+			name: "should return the error queue url",
+			setup: func(s pram.Store, qc *mocks.MockSQSMockRecorder) {
+				s.GetOrSetTopicARN(context.Background(), messageName, func() (string, error) {
+					return topicARN, nil
+				})
+				s.GetOrSetQueueURL(context.Background(), messageName, func() (string, error) {
+					return queueURL, nil
+				})
+				qc.GetQueueUrl(gomock.Any(), &sqs.GetQueueUrlInput{
+					QueueName: aws.String(messageName + "_error"),
+				}).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(errorQueueURL)}, nil).Times(1)
+			},
+			exp: errorQueueURL,
 		},
 	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			store := new(store.InMemoryStore)
+
+			tt.setup(store, sqsc.EXPECT())
+
+			sut := pram.NewRegistry(nil, sqsc, pram.WithStore(store))
+
+			act, err := sut.ErrorQueueURL(context.Background(), new(testpb.Message))
+			assert.ErrorExists(t, err, tt.err)
+
+			if act != tt.exp {
+				t.Errorf("got %s, expected %s", act, tt.exp)
+			}
+		})
+	}
 }
 
-func newSubscribeOutput() *sns.SubscribeOutput {
-	return &sns.SubscribeOutput{
-		SubscriptionArn: aws.String("arn"),
+func TestRegistry_SubscribeEndpoint(t *testing.T) {
+	const endpoint = "arn:aws:lambda:eu-west-1:111122223333:function:handler"
+
+	tests := []struct {
+		name  string
+		setup func(pram.Store, *mocks.MockSNSMockRecorder)
+		exp   string
+		err   bool
+	}{
+		{
+			name: "should return an error if the topic cannot be ensured",
+			setup: func(s pram.Store, sc *mocks.MockSNSMockRecorder) {
+				sc.CreateTopic(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			err: true,
+		},
+		{
+			name: "should return an error if the endpoint cannot be subscribed",
+			setup: func(s pram.Store, sc *mocks.MockSNSMockRecorder) {
+				s.GetOrSetTopicARN(context.Background(), messageName, func() (string, error) {
+					return topicARN, nil
+				})
+				sc.Subscribe(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			err: true,
+		},
+		{
+			name: "should subscribe the endpoint",
+			setup: func(s pram.Store, sc *mocks.MockSNSMockRecorder) {
+				s.GetOrSetTopicARN(context.Background(), messageName, func() (string, error) {
+					return topicARN, nil
+				})
+				sc.Subscribe(gomock.Any(), &sns.SubscribeInput{
+					Protocol: aws.String("lambda"),
+					TopicArn: aws.String(topicARN),
+					Endpoint: aws.String(endpoint),
+				}).Return(&sns.SubscribeOutput{SubscriptionArn: aws.String("arn")}, nil).Times(1)
+			},
+			exp: "arn",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			store := new(store.InMemoryStore)
+
+			tt.setup(store, snsc.EXPECT())
+
+			sut := pram.NewRegistry(snsc, nil, pram.WithStore(store))
+
+			act, err := sut.SubscribeEndpoint(context.Background(), new(testpb.Message), "lambda", endpoint)
+			assert.ErrorExists(t, err, tt.err)
+
+			if act != tt.exp {
+				t.Errorf("got %s, expected %s", act, tt.exp)
+			}
+		})
 	}
 }
+
+func TestRegistry_Teardown(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(*mocks.MockSNSMockRecorder, *mocks.MockSQSMockRecorder)
+		ensure bool
+		err    bool
+	}{
+		{
+			name:   "should delete the subscription, queues and topic",
+			ensure: true,
+			setup: func(nc *mocks.MockSNSMockRecorder, qc *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					nc.Unsubscribe(gomock.Any(), &sns.UnsubscribeInput{
+						SubscriptionArn: aws.String("arn"),
+					}).Return(nil, nil).Times(1),
+					qc.GetQueueUrl(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL)}, nil).Times(1),
+					qc.DeleteQueue(gomock.Any(), &sqs.DeleteQueueInput{QueueUrl: aws.String(queueURL)}).Return(nil, nil).Times(1),
+					qc.GetQueueUrl(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL + "_error")}, nil).Times(1),
+					qc.DeleteQueue(gomock.Any(), &sqs.DeleteQueueInput{QueueUrl: aws.String(queueURL + "_error")}).Return(nil, nil).Times(1),
+					nc.ListTopics(gomock.Any(), gomock.Any()).Return(&sns.ListTopicsOutput{
+						Topics: []snstypes.Topic{{TopicArn: aws.String(topicARN)}},
+					}, nil).Times(1),
+					nc.DeleteTopic(gomock.Any(), &sns.DeleteTopicInput{TopicArn: aws.String(topicARN)}).Return(nil, nil).Times(1),
+				)
+			},
+		},
+		{
+			name: "should ignore resources that have already been deleted",
+			setup: func(nc *mocks.MockSNSMockRecorder, qc *mocks.MockSQSMockRecorder) {
+				qc.GetQueueUrl(gomock.Any(), gomock.Any()).Return(nil, &types.QueueDoesNotExist{}).Times(2)
+				nc.ListTopics(gomock.Any(), gomock.Any()).Return(new(sns.ListTopicsOutput), nil).Times(1)
+			},
+		},
+		{
+			name: "should return an error if a resource cannot be deleted",
+			setup: func(nc *mocks.MockSNSMockRecorder, qc *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					qc.GetQueueUrl(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL)}, nil).Times(1),
+					qc.DeleteQueue(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1),
+				)
+			},
+			err: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			sqsc := mocks.NewMockSQS(ctrl)
+			st := store.NewInMemoryStore(0)
+
+			sut := pram.NewRegistry(snsc, sqsc, pram.WithStore(st))
+
+			if tt.ensure {
+				gomock.InOrder(
+					snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1),
+					snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+					sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(true), nil).Times(1),
+					sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(true), nil).Times(1),
+					sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(false), nil).Times(1),
+					sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(false), nil).Times(1),
+					sqsc.EXPECT().SetQueueAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+					snsc.EXPECT().Subscribe(gomock.Any(), gomock.Any()).Return(newSubscribeOutput(), nil).Times(1),
+				)
+
+				_, err := sut.QueueURL(context.Background(), new(testpb.Message))
+				assert.ErrorExists(t, err, false)
+			}
+
+			tt.setup(snsc.EXPECT(), sqsc.EXPECT())
+
+			err := sut.Teardown(context.Background(), new(testpb.Message))
+			assert.ErrorExists(t, err, tt.err)
+
+			topics, queues := st.Count()
+			assert.DeepEqual(t, []int{topics, queues}, []int{0, 0})
+		})
+	}
+}
+
+func TestRegistry_TeardownRedisStore(t *testing.T) {
+	t.Run("should remove the topic and queues from the store", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		sqsc := mocks.NewMockSQS(ctrl)
+		gomock.InOrder(
+			snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1),
+			snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(true), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(true), nil).Times(1),
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(false), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(false), nil).Times(1),
+			sqsc.EXPECT().SetQueueAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+			snsc.EXPECT().Subscribe(gomock.Any(), gomock.Any()).Return(newSubscribeOutput(), nil).Times(1),
+			snsc.EXPECT().Unsubscribe(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+			sqsc.EXPECT().GetQueueUrl(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL)}, nil).Times(1),
+			sqsc.EXPECT().DeleteQueue(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+			sqsc.EXPECT().GetQueueUrl(gomock.Any(), gomock.Any()).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL + "_error")}, nil).Times(1),
+			sqsc.EXPECT().DeleteQueue(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+			snsc.EXPECT().ListTopics(gomock.Any(), gomock.Any()).Return(&sns.ListTopicsOutput{
+				Topics: []snstypes.Topic{{TopicArn: aws.String(topicARN)}},
+			}, nil).Times(1),
+			snsc.EXPECT().DeleteTopic(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+		)
+
+		c := newRedisClient()
+		sut := pram.NewRegistry(snsc, sqsc, pram.WithStore(pram.NewRedisStore(c, "prefix:", 0)))
+
+		_, err := sut.QueueURL(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, len(c.values), 2)
+
+		err = sut.Teardown(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, c.values, map[string]string{})
+	})
+}
+
+func TestRegistry_Invalidate(t *testing.T) {
+	t.Run("should ensure the topic again once invalidated", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(2)
+		snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+
+		sut := pram.NewRegistry(snsc, nil)
+
+		for i := 0; i < 2; i++ {
+			act, err := sut.TopicARN(context.Background(), new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+			assert.DeepEqual(t, act, topicARN)
+
+			err = sut.Invalidate(context.Background(), new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+		}
+	})
+
+	t.Run("should ignore stores that do not support invalidation", func(t *testing.T) {
+		s := new(passthroughStore)
+		sut := pram.NewRegistry(nil, nil, pram.WithStore(s))
+
+		err := sut.Invalidate(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestRegistry_EnsureTopics(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSNSMockRecorder)
+		input []proto.Message
+		err   bool
+	}{
+		{
+			name:  "should return nil if no messages are specified",
+			setup: func(*mocks.MockSNSMockRecorder) {},
+		},
+		{
+			name: "should return an error if any topic cannot be ensured",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.CreateTopic(gomock.Any(), &sns.CreateTopicInput{Name: aws.String(messageName)}).
+					Return(newCreateTopicOutput(), nil).Times(1)
+				m.SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+				m.CreateTopic(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			input: []proto.Message{new(testpb.Message), new(testpb.NamedMessage)},
+			err:   true,
+		},
+		{
+			name: "should ensure each topic",
+			setup: func(m *mocks.MockSNSMockRecorder) {
+				m.CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(2)
+				m.SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+			},
+			input: []proto.Message{new(testpb.Message), new(testpb.NamedMessage)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			tt.setup(snsc.EXPECT())
+
+			sut := pram.NewRegistry(snsc, nil, pram.WithEnsureConcurrency(2))
+
+			err := sut.EnsureTopics(context.Background(), tt.input...)
+			assert.ErrorExists(t, err, tt.err)
+
+			if err != nil {
+				var ee pram.EnsureError
+				if !errors.As(err, &ee) || len(ee) != 1 {
+					t.Errorf("got %v, expected a single ensure error", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRegistry_EnsureQueues(t *testing.T) {
+	t.Run("should ensure each queue", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1)
+		snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+		snsc.EXPECT().Subscribe(gomock.Any(), gomock.Any()).Return(newSubscribeOutput(), nil).Times(1)
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		gomock.InOrder(
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(true), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(true), nil).Times(1),
+			sqsc.EXPECT().CreateQueue(gomock.Any(), gomock.Any()).Return(newCreateQueueOutput(false), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(false), nil).Times(1),
+			sqsc.EXPECT().SetQueueAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+		)
+
+		sut := pram.NewRegistry(snsc, sqsc)
+
+		err := sut.EnsureQueues(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestRegistry_PurgeQueue(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSQSMockRecorder)
+		purge func(*pram.Registry) error
+		err   bool
+	}{
+		{
+			name: "should return an error if the queue does not exist",
+			setup: func(qc *mocks.MockSQSMockRecorder) {
+				qc.GetQueueUrl(gomock.Any(), gomock.Any()).Return(nil, new(types.QueueDoesNotExist)).Times(1)
+			},
+			purge: func(r *pram.Registry) error {
+				return r.PurgeQueue(context.Background(), new(testpb.Message))
+			},
+			err: true,
+		},
+		{
+			name: "should purge the queue",
+			setup: func(qc *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					qc.GetQueueUrl(gomock.Any(), &sqs.GetQueueUrlInput{
+						QueueName: aws.String(messageName),
+					}).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL)}, nil).Times(1),
+
+					qc.PurgeQueue(gomock.Any(), &sqs.PurgeQueueInput{
+						QueueUrl: aws.String(queueURL),
+					}).Return(new(sqs.PurgeQueueOutput), nil).Times(1),
+				)
+			},
+			purge: func(r *pram.Registry) error {
+				return r.PurgeQueue(context.Background(), new(testpb.Message))
+			},
+		},
+		{
+			name: "should purge the error queue",
+			setup: func(qc *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					qc.GetQueueUrl(gomock.Any(), &sqs.GetQueueUrlInput{
+						QueueName: aws.String(messageName + "_error"),
+					}).Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(queueURL + "_error")}, nil).Times(1),
+
+					qc.PurgeQueue(gomock.Any(), &sqs.PurgeQueueInput{
+						QueueUrl: aws.String(queueURL + "_error"),
+					}).Return(new(sqs.PurgeQueueOutput), nil).Times(1),
+				)
+			},
+			purge: func(r *pram.Registry) error {
+				return r.PurgeErrorQueue(context.Background(), new(testpb.Message))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			tt.setup(sqsc.EXPECT())
+
+			sut := pram.NewRegistry(nil, sqsc)
+
+			err := tt.purge(sut)
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+}
+
+func TestNewInMemoryStore(t *testing.T) {
+	t.Run("should return a store that can be snapshot and restored", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).Return(newCreateTopicOutput(), nil).Times(1)
+		snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		var st pram.InMemoryStore = pram.NewInMemoryStore(10, pram.WithStoreTTL(time.Hour))
+
+		_, err := pram.NewRegistry(snsc, nil, pram.WithStore(st)).TopicARN(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		buf := new(bytes.Buffer)
+		err = st.Snapshot(buf)
+		assert.ErrorExists(t, err, false)
+
+		rst := pram.NewInMemoryStore(0)
+		err = rst.Restore(buf)
+		assert.ErrorExists(t, err, false)
+
+		act, err := pram.NewRegistry(nil, nil, pram.WithStore(rst)).TopicARN(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, topicARN)
+	})
+}
+
+func TestWithStartupEnsureTimeout(t *testing.T) {
+	t.Run("should update the options", func(t *testing.T) {
+		const exp = 5 * time.Second
+
+		o := pram.RegistryOptions{}
+		pram.WithStartupEnsureTimeout(exp)(&o)
+
+		if act := o.EnsureTimeout; act != exp {
+			t.Errorf("got %v, expected %v", act, exp)
+		}
+	})
+
+	t.Run("should bound the ensure duration", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().CreateTopic(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, _ *sns.CreateTopicInput, _ ...func(*sns.Options)) (*sns.CreateTopicOutput, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}).Times(1)
+
+		sut := pram.NewRegistry(snsc, nil, pram.WithStartupEnsureTimeout(10*time.Millisecond))
+
+		_, err := sut.TopicARN(context.Background(), new(testpb.Message))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, expected %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("should bound the error queue url duration", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().GetQueueUrl(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, _ *sqs.GetQueueUrlInput, _ ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}).Times(1)
+
+		s := pram.NewInMemoryStore(0)
+		s.GetOrSetTopicARN(context.Background(), messageName, func() (string, error) {
+			return topicARN, nil
+		})
+		s.GetOrSetQueueURL(context.Background(), messageName, func() (string, error) {
+			return queueURL, nil
+		})
+
+		sut := pram.NewRegistry(nil, sqsc, pram.WithStore(s), pram.WithStartupEnsureTimeout(10*time.Millisecond))
+
+		_, err := sut.ErrorQueueURL(context.Background(), new(testpb.Message))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, expected %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestWithPrefixNaming(t *testing.T) {
+	t.Run("should configure the options", func(t *testing.T) {
+		o := pram.RegistryOptions{}
+		pram.WithPrefixNaming("stage", "service")(&o)
+
+		exp := "stage-pram-test-Message"
+		act := o.Topic.NameFn(new(testpb.Message))
+
+		if act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+
+		exp = "stage-service-pram-test-Message"
+		act = o.Queue.NameFn(new(testpb.Message))
+
+		if act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+
+		exp = "stage-service-pram-test-Message_error"
+		act = o.Queue.ErrorNameFn(new(testpb.Message))
+
+		if act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+	})
+
+	t.Run("should allow empty segments", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().CreateTopic(gomock.Any(), &sns.CreateTopicInput{
+			Name: aws.String("-pram-test-Message"),
+		}).Return(newCreateTopicOutput(), nil).Times(1)
+		snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sut := pram.NewRegistry(snsc, nil, pram.WithPrefixNaming("", ""))
+
+		_, err := sut.TopicARN(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestWithEnvPrefixNaming(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		err  bool
+	}{
+		{
+			name: "should return an error if the stage is not set",
+			env:  map[string]string{"PRAM_SERVICE": "service"},
+			err:  true,
+		},
+		{
+			name: "should return an error if the service is not set",
+			env:  map[string]string{"PRAM_STAGE": "stage"},
+			err:  true,
+		},
+		{
+			name: "should configure the options",
+			env:  map[string]string{"PRAM_STAGE": "stage", "PRAM_SERVICE": "service"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			optFn, err := pram.WithEnvPrefixNaming("PRAM_STAGE", "PRAM_SERVICE")
+			assert.ErrorExists(t, err, tt.err)
+			if err != nil {
+				return
+			}
+
+			ctx := context.Background()
+			store := new(store.InMemoryStore)
+			store.GetOrSetTopicARN(ctx, "stage-pram-test-Message", func() (string, error) { return topicARN, nil })
+			store.GetOrSetQueueURL(ctx, "stage-service-pram-test-Message", func() (string, error) { return queueURL, nil })
+
+			sut := pram.NewRegistry(nil, nil, pram.WithStore(store), optFn)
+
+			act, err := sut.QueueURL(ctx, new(testpb.Message))
+			assert.ErrorExists(t, err, false)
+			assert.DeepEqual(t, act, queueURL)
+		})
+	}
+}
+
+func TestWithSegmentedNaming(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []string
+		topic    string
+		queue    string
+		error    string
+		err      bool
+	}{
+		{
+			name: "should return an error if no segments are specified",
+			err:  true,
+		},
+		{
+			name:     "should return an error if a segment is empty",
+			segments: []string{"org", "", "service"},
+			err:      true,
+		},
+		{
+			name:     "should apply a single segment to queues only",
+			segments: []string{"service"},
+			topic:    "pram-test-Message",
+			queue:    "service-pram-test-Message",
+			error:    "service-pram-test-Message_error",
+		},
+		{
+			name:     "should apply multiple segments",
+			segments: []string{"org", "team", "stage", "service"},
+			topic:    "org-team-stage-pram-test-Message",
+			queue:    "org-team-stage-service-pram-test-Message",
+			error:    "org-team-stage-service-pram-test-Message_error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			optFn, err := pram.WithSegmentedNaming(tt.segments...)
+			assert.ErrorExists(t, err, tt.err)
+			if err != nil {
+				return
+			}
+
+			o := pram.RegistryOptions{}
+			optFn(&o)
+
+			m := new(testpb.Message)
+			assert.DeepEqual(t, o.Topic.NameFn(m), tt.topic)
+			assert.DeepEqual(t, o.Queue.NameFn(m), tt.queue)
+			assert.DeepEqual(t, o.Queue.ErrorNameFn(m), tt.error)
+		})
+	}
+}
+
+func TestWithFIFO(t *testing.T) {
+	t.Run("should create fifo topics and queues", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		snsc := mocks.NewMockSNS(ctrl)
+		sqsc := mocks.NewMockSQS(ctrl)
+
+		gomock.InOrder(
+			snsc.EXPECT().CreateTopic(gomock.Any(), &sns.CreateTopicInput{
+				Name:       aws.String("dev-pram-test-Message.fifo"),
+				Attributes: map[string]string{"FifoTopic": "true"},
+			}).Return(newCreateTopicOutput(), nil).Times(1),
+			snsc.EXPECT().SetTopicAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+
+			sqsc.EXPECT().CreateQueue(gomock.Any(), &sqs.CreateQueueInput{
+				QueueName:  aws.String("dev-service-pram-test-Message_error.fifo"),
+				Attributes: map[string]string{"FifoQueue": "true"},
+			}).Return(newCreateQueueOutput(true), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(true), nil).Times(1),
+
+			sqsc.EXPECT().CreateQueue(gomock.Any(), &sqs.CreateQueueInput{
+				QueueName:  aws.String("dev-service-pram-test-Message.fifo"),
+				Attributes: map[string]string{"FifoQueue": "true"},
+			}).Return(newCreateQueueOutput(false), nil).Times(1),
+			sqsc.EXPECT().GetQueueAttributes(gomock.Any(), gomock.Any()).Return(newGetQueueAttributesOutput(false), nil).Times(1),
+
+			sqsc.EXPECT().SetQueueAttributes(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+
+			snsc.EXPECT().Subscribe(gomock.Any(), gomock.Any()).Return(newSubscribeOutput(), nil).Times(1),
+		)
+
+		sut := pram.NewRegistry(snsc, sqsc, pram.WithPrefixNaming("dev", "service"), pram.WithFIFO())
+
+		_, err := sut.QueueURL(context.Background(), new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestWithOptionNaming(t *testing.T) {
+	tests := []struct {
+		name  string
+		input proto.Message
+		topic string
+		queue string
+		error string
+	}{
+		{
+			name:  "should use the message options",
+			input: new(testpb.NamedMessage),
+			topic: "named-topic",
+			queue: "named-queue",
+			error: "named-queue_error",
+		},
+		{
+			name:  "should fall back to the message name",
+			input: new(testpb.Message),
+			topic: "pram-test-Message",
+			queue: "pram-test-Message",
+			error: "pram-test-Message_error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := pram.RegistryOptions{}
+			pram.WithOptionNaming()(&o)
+
+			if act, exp := o.Topic.NameFn(tt.input), tt.topic; act != exp {
+				t.Errorf("got %s, expected %s", act, exp)
+			}
+
+			if act, exp := o.Queue.NameFn(tt.input), tt.queue; act != exp {
+				t.Errorf("got %s, expected %s", act, exp)
+			}
+
+			if act, exp := o.Queue.ErrorNameFn(tt.input), tt.error; act != exp {
+				t.Errorf("got %s, expected %s", act, exp)
+			}
+		})
+	}
+}
+
+func newCreateTopicOutput() *sns.CreateTopicOutput {
+	return &sns.CreateTopicOutput{
+		TopicArn: aws.String(topicARN),
+	}
+}
+
+func newCreateQueueOutput(errorQueue bool) *sqs.CreateQueueOutput {
+	url := queueURL
+	if errorQueue {
+		url = url + "_error"
+	}
+
+	return &sqs.CreateQueueOutput{
+		QueueUrl: aws.String(url),
+	}
+}
+
+func newGetQueueAttributesOutput(errorQueue bool) *sqs.GetQueueAttributesOutput {
+	arn := queueARN
+	if errorQueue {
+		arn = arn + "_error"
+	}
+
+	return &sqs.GetQueueAttributesOutput{
+		Attributes: map[string]string{
+			"QueueArn": arn,
+		},
+	}
+}
+
+func newSubscribeOutput() *sns.SubscribeOutput {
+	return &sns.SubscribeOutput{
+		SubscriptionArn: aws.String("arn"),
+	}
+}
+
+type passthroughStore struct{}
+
+func (s *passthroughStore) GetOrSetTopicARN(_ context.Context, _ string, fn func() (string, error)) (string, error) {
+	return fn()
+}
+
+func (s *passthroughStore) GetOrSetQueueURL(_ context.Context, _ string, fn func() (string, error)) (string, error) {
+	return fn()
+}
+
+type redisClient struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newRedisClient() *redisClient {
+	return &redisClient{values: map[string]string{}}
+}
+
+func (c *redisClient) Get(_ context.Context, key string) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[key]
+	return v, ok, nil
+}
+
+func (c *redisClient) Set(_ context.Context, key, value string, _ time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] = value
+	return nil
+}
+
+func (c *redisClient) SetNX(_ context.Context, key, value string, _ time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.values[key]; ok {
+		return false, nil
+	}
+
+	c.values[key] = value
+	return true, nil
+}
+
+func (c *redisClient) Del(_ context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.values, key)
+	return nil
+}
+
+func (c *redisClient) DelIfEqual(_ context.Context, key, value string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if v, ok := c.values[key]; !ok || v != value {
+		return false, nil
+	}
+
+	delete(c.values, key)
+	return true, nil
+}
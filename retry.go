@@ -0,0 +1,61 @@
+package pram
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// retry invokes fn until it succeeds, returns a non-retryable error or the attempts are exhausted,
+// waiting for a random duration of up to delay * 2^attempt between attempts
+func retry(ctx context.Context, attempts int, delay time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts || i == 0; i++ {
+		if i > 0 {
+			d := backoff(delay, i)
+
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(d):
+			}
+		}
+
+		err = fn()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// backoff returns a random duration of up to delay * 2^(attempt-1)
+func backoff(delay time.Duration, attempt int) time.Duration {
+	return time.Duration(rand.Int63n(int64(delay<<uint(attempt-1)) + 1))
+}
+
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var re interface{ RetryableError() bool }
+	if errors.As(err, &re) {
+		return re.RetryableError()
+	}
+
+	var te interface{ Timeout() bool }
+	if errors.As(err, &te) && te.Timeout() {
+		return true
+	}
+
+	var he interface{ HTTPStatusCode() int }
+	if errors.As(err, &he) {
+		c := he.HTTPStatusCode()
+		return c == 429 || c >= 500
+	}
+
+	return false
+}
@@ -1,17 +1,32 @@
 package pram
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
 )
 
 type (
@@ -21,152 +36,1706 @@ type (
 		Handle(ctx context.Context, m proto.Message, md Metadata) error
 	}
 
+	// RawHandler represents a handler that receives messages of any type without unmarshalling the payload
+	// The envelope type is available in the metadata, allowing the handler to decide whether to unmarshal it.
+	RawHandler interface {
+		HandleRaw(ctx context.Context, body *anypb.Any, md Metadata) error
+	}
+
+	// MessageReleaser represents a handler that provides its own decode targets, for example from a pool
+	// Release is called once for each message returned by Message, after any retries have completed or if the
+	// message cannot be decoded. Messages that are only used to resolve the message type are released immediately.
+	// Targets are reset before decode, so Message can return reused instances.
+	MessageReleaser interface {
+		Release(m proto.Message)
+	}
+
+	// Acknowledger represents a func set that allows a handler to control message deletion
+	// Messages are deleted when the handler returns nil unless Ack, Nack or Defer have been called.
+	Acknowledger interface {
+		Ack(ctx context.Context) error
+		Nack(ctx context.Context) error
+		Defer()
+	}
+
+	// HandlerMiddleware represents a func that wraps a handler
+	HandlerMiddleware func(Handler) Handler
+
+	// ReceiveFunc represents a func that receives messages from a queue
+	ReceiveFunc func(ctx context.Context, in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error)
+
+	// ReceiveMiddleware represents a func that wraps a receive func
+	ReceiveMiddleware func(ReceiveFunc) ReceiveFunc
+
 	// Subscriber represents a subscriber
 	Subscriber struct {
-		client                   SQS
-		queueURLFn               func(context.Context, proto.Message) (string, error)
-		errorFn                  func(error)
-		maxNumberOfMessages      int
-		receiveInterval          time.Duration
-		waitTimeSeconds          int
-		visibilityTimeoutSeconds int
+		stats                               *subscriberStats
+		client                              SQS
+		queueURLFn                          func(context.Context, proto.Message) (string, error)
+		errorQueueURLFn                     func(context.Context, proto.Message) (string, error)
+		errorFn                             func(error)
+		receiveInputFn                      func(*sqs.ReceiveMessageInput)
+		receiveFn                           ReceiveFunc
+		contextFn                           func(context.Context) context.Context
+		maxNumberOfMessages                 int32
+		receiveInterval                     time.Duration
+		waitTimeSeconds                     int
+		visibilityTimeoutSeconds            int32
+		decodeErrorVisibilityTimeoutSeconds int
+		dynamicQueueURL                     bool
+		deleteRetryAttempts                 int
+		deleteRetryDelay                    time.Duration
+		encoding                            *base64.Encoding
+		codec                               Codec
+		protoJSONFallback                   bool
+		gzipDetection                       bool
+		messageAttributeNames               []string
+		receiveConcurrency                  int
+		handlers                            *handlerLimiter
+		confirmClient                       SNS
+		messagePool                         bool
+		messagePools                        sync.Map
+		shutdownTimeout                     time.Duration
+		middleware                          []HandlerMiddleware
+		receiveErrorThreshold               int
+		recoverPanics                       bool
+		receiveCount                        bool
+		deleteBatcher                       *deleteBatcher
+		deleteFlushInterval                 time.Duration
+		extendVisibility                    bool
+		handlerTimeout                      time.Duration
+		typeFailureThreshold                int
+		typeFailingFn                       func(messageType string, count int)
+		typeFailures                        map[string]int
+		typeFailuresMu                      sync.Mutex
+		maxRetries                          int
+		backoffFn                           func(attempt int) time.Duration
+		detachedDeleteTimeout               time.Duration
+		traceExtractor                      TraceExtractor
+		tracerProvider                      trace.TracerProvider
+		messagePath                         string
+		metrics                             SubscriberMetrics
 	}
 
 	// SubscriberOptions represents a set of subscriber options
 	SubscriberOptions struct {
-		QueueURLFn               func(context.Context, proto.Message) (string, error)
-		ErrorFn                  func(error)
-		MaxNumberOfMessages      int
-		ReceiveInterval          time.Duration
-		WaitTimeSeconds          int
-		VisibilityTimeoutSeconds int
+		QueueURLFn                          func(context.Context, proto.Message) (string, error)
+		ErrorQueueURLFn                     func(context.Context, proto.Message) (string, error)
+		ErrorFn                             func(error)
+		ReceiveInputFn                      func(*sqs.ReceiveMessageInput)
+		ContextFn                           func(context.Context) context.Context
+		MaxNumberOfMessages                 int
+		ReceiveInterval                     time.Duration
+		WaitTimeSeconds                     int
+		VisibilityTimeoutSeconds            int
+		DecodeErrorVisibilityTimeoutSeconds int
+		DynamicQueueURL                     bool
+		DeleteRetryAttempts                 int
+		DeleteRetryDelay                    time.Duration
+		Encoding                            *base64.Encoding
+		Codec                               Codec
+		ProtoJSONFallback                   bool
+		GzipDetection                       bool
+		MessageAttributeNames               []string
+		ReceiveConcurrency                  int
+		MaxConcurrentHandlers               int
+		ConfirmClient                       SNS
+		MessagePool                         bool
+		ShutdownTimeout                     time.Duration
+		Middleware                          []HandlerMiddleware
+		ReceiveMiddleware                   []ReceiveMiddleware
+		ReceiveErrorThreshold               int
+		RecoverPanics                       bool
+		ReceiveCount                        bool
+		DeleteBatchSize                     int
+		DeleteFlushInterval                 time.Duration
+		ExtendVisibility                    bool
+		HandlerTimeout                      time.Duration
+		TypeFailureThreshold                int
+		OnTypeFailing                       func(messageType string, count int)
+		MaxRetries                          int
+		BackoffFn                           func(attempt int) time.Duration
+		DetachedDeleteTimeout               time.Duration
+		Propagator                          propagation.TextMapPropagator
+		TraceExtractor                      TraceExtractor
+		TracerProvider                      trace.TracerProvider
+		MessagePath                         string
+		Metrics                             SubscriberMetrics
+	}
+
+	// HandlerResult represents the outcome of a handler subscription
+	HandlerResult struct {
+		Handler     Handler
+		MessageType string
+		Err         error
+	}
+
+	// PanicError represents a recovered handler panic
+	PanicError struct {
+		Value interface{}
+		Stack []byte
+	}
+
+	// SubscribeError represents the outcome of each handler when one or more subscriptions fail
+	SubscribeError []HandlerResult
+
+	// handlerGroup tracks the in-flight handlers for a subscription
+	handlerGroup struct {
+		wg sync.WaitGroup
+		n  int64
+	}
+
+	// handlerLimiter limits the number of concurrent handlers, allowing the limit to be changed at runtime
+	handlerLimiter struct {
+		mu    sync.Mutex
+		limit int
+		n     int
+		wait  chan struct{}
+	}
+
+	// detachedContext retains the values of the parent context without its cancellation
+	detachedContext struct {
+		context.Context
+	}
+
+	// acknowledger settles a single received message
+	acknowledger struct {
+		mu       sync.Mutex
+		s        *Subscriber
+		queueURL string
+		message  types.Message
+		manual   bool
+		settled  bool
+	}
+
+	// deleteBatcher buffers handled messages by queue, deleting them in batches
+	deleteBatcher struct {
+		mu      sync.Mutex
+		size    int
+		pending map[string][]types.Message
+	}
+
+	// rawHandler adapts a raw handler to a handler, using the envelope body as the message
+	rawHandler struct {
+		RawHandler
+	}
+
+	// ackKey is the context key for the message acknowledger
+	ackKey struct{}
+
+	// pooledHandler wraps a handler to decode messages into pooled targets
+	pooledHandler struct {
+		Handler
+		pool *sync.Pool
+	}
+
+	// releasingHandler wraps a handler to release decode targets once the message has been handled
+	releasingHandler struct {
+		Handler
+		releaser MessageReleaser
+	}
+
+	// targetReleaser is implemented by handler wrappers that provide decode targets which must be released
+	// once the message has been handled, including any retries
+	targetReleaser interface {
+		release(m proto.Message)
 	}
 )
 
+// ErrSkip can be returned by a handler to leave a message on the queue without it being treated as an error.
+// The message will become visible to other consumers once the visibility timeout has elapsed.
+var ErrSkip = errors.New("skip message")
+
+// sns envelope types
+const (
+	envelopeNotification             = "Notification"
+	envelopeSubscriptionConfirmation = "SubscriptionConfirmation"
+	envelopeUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+)
+
+// receiveCountAttributeName is the sqs system attribute containing the approximate receive count
+const receiveCountAttributeName = "ApproximateReceiveCount"
+
+// messageGroupIDAttributeName is the sqs system attribute containing the fifo message group id
+const messageGroupIDAttributeName = "MessageGroupId"
+
+// maxDeleteBatchSize is the maximum number of entries in an sqs delete batch
+const maxDeleteBatchSize = 10
+
+// fifoSuffix is the required suffix for fifo topic and queue names
+const fifoSuffix = ".fifo"
+
+// gzipMagic is the gzip header, which cannot be the start of a valid protobuf message
+var gzipMagic = []byte{0x1f, 0x8b}
+
 // NewSubscriber returns a new subscriber
+// It panics if the configured message path is empty, as messages could not be extracted from any envelope.
 func NewSubscriber(client SQS, optFns ...func(*SubscriberOptions)) *Subscriber {
 	opts := SubscriberOptions{
 		QueueURLFn: func(context.Context, proto.Message) (string, error) {
 			return "", errors.New("queue not found")
 		},
+		ErrorQueueURLFn: func(context.Context, proto.Message) (string, error) {
+			return "", errors.New("error queue not found")
+		},
 		ErrorFn: func(error) {
 			// discard errors by default
 		},
+		ReceiveInputFn:           func(*sqs.ReceiveMessageInput) {},
+		ContextFn:                func(ctx context.Context) context.Context { return ctx },
 		MaxNumberOfMessages:      10,
 		ReceiveInterval:          time.Second,
 		WaitTimeSeconds:          20,
 		VisibilityTimeoutSeconds: 15,
+		DeleteRetryAttempts:      3,
+		DeleteRetryDelay:         100 * time.Millisecond,
+		Encoding:                 base64.StdEncoding,
+		Codec:                    ProtoCodec{},
+		ReceiveConcurrency:       1,
+		RecoverPanics:            true,
+		DeleteFlushInterval:      time.Second,
+		MessagePath:              "Message",
+		BackoffFn: func(attempt int) time.Duration {
+			return backoff(100*time.Millisecond, attempt)
+		},
 	}
 
 	for _, fn := range optFns {
 		fn(&opts)
 	}
 
+	// receive middleware is applied in order, with the first middleware outermost
+	var rfn ReceiveFunc = func(ctx context.Context, in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+		return client.ReceiveMessage(ctx, in)
+	}
+	for i := len(opts.ReceiveMiddleware) - 1; i >= 0; i-- {
+		rfn = opts.ReceiveMiddleware[i](rfn)
+	}
+
+	var db *deleteBatcher
+	if opts.DeleteBatchSize > 1 {
+		db = &deleteBatcher{
+			size:    opts.DeleteBatchSize,
+			pending: map[string][]types.Message{},
+		}
+		if db.size > maxDeleteBatchSize {
+			db.size = maxDeleteBatchSize
+		}
+	}
+
+	if opts.Metrics == nil {
+		opts.Metrics = new(noopMetrics)
+	}
+
+	if opts.MessagePath == "" {
+		panic("pram: message path is empty")
+	}
+
+	// a trace extractor takes precedence over the propagator, which reads the pram trace context
+	te := opts.TraceExtractor
+	if te == nil && opts.Propagator != nil {
+		te = traceContextExtractor(opts.Propagator)
+	}
+
 	return &Subscriber{
-		client:                   client,
-		queueURLFn:               opts.QueueURLFn,
-		errorFn:                  opts.ErrorFn,
-		maxNumberOfMessages:      opts.MaxNumberOfMessages,
-		waitTimeSeconds:          opts.WaitTimeSeconds,
-		receiveInterval:          opts.ReceiveInterval,
-		visibilityTimeoutSeconds: opts.VisibilityTimeoutSeconds,
+		stats:                               new(subscriberStats),
+		client:                              client,
+		queueURLFn:                          opts.QueueURLFn,
+		errorQueueURLFn:                     opts.ErrorQueueURLFn,
+		errorFn:                             opts.ErrorFn,
+		receiveInputFn:                      opts.ReceiveInputFn,
+		receiveFn:                           rfn,
+		contextFn:                           opts.ContextFn,
+		maxNumberOfMessages:                 int32(opts.MaxNumberOfMessages),
+		waitTimeSeconds:                     opts.WaitTimeSeconds,
+		receiveInterval:                     opts.ReceiveInterval,
+		visibilityTimeoutSeconds:            int32(opts.VisibilityTimeoutSeconds),
+		decodeErrorVisibilityTimeoutSeconds: opts.DecodeErrorVisibilityTimeoutSeconds,
+		dynamicQueueURL:                     opts.DynamicQueueURL,
+		deleteRetryAttempts:                 opts.DeleteRetryAttempts,
+		deleteRetryDelay:                    opts.DeleteRetryDelay,
+		encoding:                            opts.Encoding,
+		codec:                               opts.Codec,
+		protoJSONFallback:                   opts.ProtoJSONFallback,
+		gzipDetection:                       opts.GzipDetection,
+		messageAttributeNames:               opts.MessageAttributeNames,
+		receiveConcurrency:                  opts.ReceiveConcurrency,
+		handlers:                            &handlerLimiter{limit: opts.MaxConcurrentHandlers},
+		confirmClient:                       opts.ConfirmClient,
+		messagePool:                         opts.MessagePool,
+		shutdownTimeout:                     opts.ShutdownTimeout,
+		middleware:                          opts.Middleware,
+		receiveErrorThreshold:               opts.ReceiveErrorThreshold,
+		recoverPanics:                       opts.RecoverPanics,
+		receiveCount:                        opts.ReceiveCount,
+		deleteBatcher:                       db,
+		deleteFlushInterval:                 opts.DeleteFlushInterval,
+		extendVisibility:                    opts.ExtendVisibility,
+		handlerTimeout:                      opts.HandlerTimeout,
+		typeFailureThreshold:                opts.TypeFailureThreshold,
+		typeFailingFn:                       opts.OnTypeFailing,
+		typeFailures:                        map[string]int{},
+		maxRetries:                          opts.MaxRetries,
+		backoffFn:                           opts.BackoffFn,
+		detachedDeleteTimeout:               opts.DetachedDeleteTimeout,
+		traceExtractor:                      te,
+		tracerProvider:                      opts.TracerProvider,
+		messagePath:                         opts.MessagePath,
+		metrics:                             opts.Metrics,
 	}
 }
 
 // Subscribe subscribes listens to messages for the specified handler
 func (s *Subscriber) Subscribe(ctx context.Context, h Handler) error {
-	q, err := s.queueURLFn(ctx, h.Message())
+	m := handlerMessage(h)
+	q, err := s.queueURLFn(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	if !s.dynamicQueueURL {
+		return s.subscribe(ctx, h, m, staticQueueURL(q))
+	}
+
+	return s.subscribe(ctx, h, m, func(ctx context.Context) (string, error) {
+		return s.queueURLFn(ctx, m)
+	})
+}
+
+// SubscribeErrorQueue listens to messages on the error queue for the specified handler
+// Messages are decoded and handled as per Subscribe, allowing failed messages to be inspected or published again.
+// Messages are deleted from the error queue once handled, so handlers should return an error to retain them.
+func (s *Subscriber) SubscribeErrorQueue(ctx context.Context, h Handler) error {
+	m := handlerMessage(h)
+	q, err := s.errorQueueURLFn(ctx, m)
 	if err != nil {
 		return err
 	}
 
+	return s.subscribe(ctx, h, m, staticQueueURL(q))
+}
+
+// SubscribeQueues listens to messages on each of the specified queues for the handler
+func (s *Subscriber) SubscribeQueues(ctx context.Context, h Handler, queueURLs ...string) error {
+	if len(queueURLs) < 1 {
+		return errors.New("no queues specified")
+	}
+
+	fns := make([]func(context.Context) (string, error), len(queueURLs))
+	for i, q := range queueURLs {
+		fns[i] = staticQueueURL(q)
+	}
+
+	return s.subscribe(ctx, h, handlerMessage(h), fns...)
+}
+
+func staticQueueURL(queueURL string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		return queueURL, nil
+	}
+}
+
+// handlerMessage returns a new instance of the handler message type, which is used to resolve queues and type names
+// The instance returned by Message is released immediately, so that handlers providing reused targets do not leak them.
+func handlerMessage(h Handler) proto.Message {
+	m := h.Message()
+	if r, ok := h.(MessageReleaser); ok {
+		defer r.Release(m)
+	}
+
+	return m.ProtoReflect().Type().New().Interface()
+}
+
+// SubscribeRaw listens to messages of any type on the specified queue for the raw handler
+// This allows a single queue to be used by generic consumers, such as event archivers. Messages encoded using
+// a json codec can only be unmarshalled if the payload type is linked into the binary.
+func (s *Subscriber) SubscribeRaw(ctx context.Context, queueURL string, h RawHandler) error {
+	return s.SubscribeQueues(ctx, rawHandler{h}, queueURL)
+}
+
+// SubscribeAll listens to messages for each of the specified handlers until the context is cancelled
+// If any subscription fails then all subscriptions are stopped and a SubscribeError is returned
+// containing the outcome of each handler. Handlers that were stopped cleanly have a nil error.
+func (s *Subscriber) SubscribeAll(ctx context.Context, hs ...Handler) error {
+	if len(hs) < 1 {
+		return errors.New("no handlers specified")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	se := make(SubscribeError, len(hs))
 	wg := new(sync.WaitGroup)
-	wg.Add(1)
 
-	go func() {
-		defer wg.Done()
+	for i, h := range hs {
+		wg.Add(1)
 
-		rt := time.NewTicker(s.receiveInterval)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-rt.C:
-				msgs, err := s.receiveMessages(ctx, q)
-				if err != nil {
-					s.errorFn(err)
-				}
+		go func(i int, h Handler) {
+			defer wg.Done()
 
-				for _, msg := range msgs {
-					wg.Add(1)
-					go func(msg types.Message) {
-						defer wg.Done()
+			err := s.Subscribe(ctx, h)
+			if err != nil {
+				cancel()
+			}
 
-						err := s.handleMessage(ctx, q, msg, h)
-						if err != nil {
-							s.errorFn(err)
-						}
-					}(msg)
-				}
+			se[i] = HandlerResult{
+				Handler:     h,
+				MessageType: messageType(handlerMessage(h)),
+				Err:         err,
 			}
-		}
-	}()
+		}(i, h)
+	}
 
 	wg.Wait()
+
+	for _, r := range se {
+		if r.Err != nil {
+			return se
+		}
+	}
+
 	return nil
 }
 
-func (s *Subscriber) receiveMessages(ctx context.Context, queueURL string) ([]types.Message, error) {
-	res, err := s.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
-		QueueUrl:            aws.String(queueURL),
-		MaxNumberOfMessages: int32(s.maxNumberOfMessages),
-		WaitTimeSeconds:     int32(s.waitTimeSeconds),
-		VisibilityTimeout:   int32(s.visibilityTimeoutSeconds),
-	})
-	if err != nil {
-		return nil, err
+// Error returns the combined error messages of the failed handlers
+func (e SubscribeError) Error() string {
+	var msgs []string
+	for _, r := range e {
+		if r.Err != nil {
+			msgs = append(msgs, r.MessageType+": "+r.Err.Error())
+		}
 	}
 
-	return res.Messages, nil
+	return strings.Join(msgs, "; ")
 }
 
-func (s *Subscriber) handleMessage(ctx context.Context, queueURL string, m types.Message, h Handler) error {
-	Logf("received %s from %s", *m.MessageId, queueURL)
+// Unwrap returns the first handler error, allowing the cause to be inspected using errors.Is and errors.As
+func (e SubscribeError) Unwrap() error {
+	for _, r := range e {
+		if r.Err != nil {
+			return r.Err
+		}
+	}
 
-	em := gjson.Get(*m.Body, "Message").Str
-	b, err := base64.StdEncoding.DecodeString(em)
-	if err != nil {
-		return err
+	return nil
+}
+
+func (s *Subscriber) subscribe(ctx context.Context, h Handler, m proto.Message, queueURLFns ...func(context.Context) (string, error)) error {
+	mt := messageType(m)
+	mr, _ := h.(MessageReleaser)
+
+	// middleware is applied in order, with the first middleware outermost
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
 	}
 
-	dm, err := Unmarshal(b, h.Message())
-	if err != nil {
-		return err
+	// pooling wraps the middleware to ensure that messages are not reset before it returns
+	if s.messagePool {
+		h = s.pooledHandler(h, m.ProtoReflect().Type())
+	} else if mr != nil {
+		h = &releasingHandler{Handler: h, releaser: mr}
 	}
 
-	err = h.Handle(ctx, dm.Payload, dm.Metadata)
-	if err != nil {
-		return err
+	// handlers use a detached context when draining, allowing received messages
+	// to be handled and deleted once the subscription context has been cancelled
+	pctx := ctx
+	if s.shutdownTimeout > 0 {
+		pctx = detachedContext{ctx}
+	}
+
+	hctx, hcancel := context.WithCancel(pctx)
+	defer hcancel()
+
+	// a fatal receive error stops all receive loops for the subscription
+	rctx, rcancel := context.WithCancel(ctx)
+	defer rcancel()
+
+	var rerr error
+	once := new(sync.Once)
+
+	stopFlush := s.startDeleteFlush(ctx)
+
+	hg := new(handlerGroup)
+	wg := new(sync.WaitGroup)
+	for _, fn := range queueURLFns {
+		for i := 0; i < s.receiveConcurrency; i++ {
+			wg.Add(1)
+
+			go func(fn func(context.Context) (string, error)) {
+				defer wg.Done()
+
+				if err := s.receive(rctx, hctx, fn, h, mt, hg); err != nil {
+					once.Do(func() {
+						rerr = err
+						rcancel()
+					})
+				}
+			}(fn)
+		}
+	}
+
+	wg.Wait()
+
+	err := s.drain(hg, hcancel)
+
+	// buffered deletes are flushed once all handlers have completed, using a detached context
+	// as the subscription context will usually have been cancelled
+	stopFlush()
+	s.flushDeletes(ctx)
+
+	if rerr != nil {
+		return rerr
 	}
 
-	_, err = s.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(queueURL),
-		ReceiptHandle: m.ReceiptHandle,
-	})
 	return err
 }
 
-// WithQueueRegistry configures the subscriber to use the specified registry
-// to resolve queues, creating them if they do not exist
-func WithQueueRegistry(r *Registry) func(*SubscriberOptions) {
-	return func(o *SubscriberOptions) {
-		o.QueueURLFn = r.QueueURL
+func (s *Subscriber) drain(hg *handlerGroup, cancel context.CancelFunc) error {
+	done := make(chan struct{})
+	go func() {
+		hg.wg.Wait()
+		close(done)
+	}()
+
+	if s.shutdownTimeout <= 0 {
+		<-done
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(s.shutdownTimeout):
+		n := atomic.LoadInt64(&hg.n)
+		cancel()
+		<-done
+
+		return fmt.Errorf("%d messages abandoned after shutdown timeout: %w", n, context.Canceled)
 	}
 }
 
-// WithErrorHandler configures the subscriber to use the specified error handler func
-func WithErrorHandler(fn func(error)) func(*SubscriberOptions) {
-	return func(o *SubscriberOptions) {
-		o.ErrorFn = fn
+func (s *Subscriber) receive(ctx, hctx context.Context, queueURLFn func(context.Context) (string, error), h Handler, messageType string, hg *handlerGroup) error {
+	rt := time.NewTicker(s.receiveInterval)
+	defer rt.Stop()
+
+	var pq, attemptID string
+	var fails int
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-rt.C:
+			q, err := queueURLFn(ctx)
+			if err != nil {
+				s.errorFn(err)
+				continue
+			}
+
+			// fifo receive attempts are retried with the same id following an error
+			// to ensure that the queue is not advanced incorrectly
+			if q != pq {
+				pq, attemptID = q, ""
+			}
+			if attemptID == "" && isFIFO(q) {
+				attemptID = uuid.NewString()
+			}
+
+			msgs, err := s.receiveMessages(ctx, q, attemptID)
+			if err != nil {
+				s.errorFn(err)
+
+				// transient errors reset the count, as only consecutive fatal errors indicate a broken subscriber
+				if ctx.Err() == nil && !isRetryable(err) {
+					fails++
+				} else {
+					fails = 0
+				}
+				if s.receiveErrorThreshold > 0 && fails >= s.receiveErrorThreshold {
+					return fmt.Errorf("%d consecutive receive errors: %w", fails, err)
+				}
+			} else {
+				attemptID = ""
+				fails = 0
+			}
+
+			atomic.AddInt64(&s.stats.received, int64(len(msgs)))
+			for _, ms := range groupMessages(msgs, isFIFO(q)) {
+				// block the receive loop while the handler limit is reached
+				// the receive context is used, as the handler context is not cancelled until in-flight handlers
+				// have drained. Messages that are not dispatched are left on the queue for redelivery.
+				if !s.acquireHandler(ctx) {
+					return nil
+				}
+
+				n := int64(len(ms))
+				hg.wg.Add(1)
+				atomic.AddInt64(&hg.n, n)
+				atomic.AddInt64(&s.stats.inFlight, n)
+
+				go func(ms []types.Message) {
+					defer hg.wg.Done()
+					defer s.releaseHandler()
+
+					s.handleMessages(hctx, q, ms, h, messageType, hg)
+				}(ms)
+			}
+		}
+	}
+}
+
+// handleMessages handles the specified messages in order, stopping at the first failure or skipped message
+// Remaining messages are left on the queue, so that they are redelivered in order once the visibility timeout has elapsed.
+func (s *Subscriber) handleMessages(ctx context.Context, queueURL string, ms []types.Message, h Handler, messageType string, hg *handlerGroup) {
+	for i, msg := range ms {
+		err := s.handleMessage(ctx, queueURL, msg, h)
+
+		// skipped messages are not treated as errors, but stop the group as the skipped message will be redelivered
+		skipped := errors.Is(err, ErrSkip)
+		if skipped {
+			err = nil
+		}
+
+		s.recordTypeResult(messageType, err)
+
+		if err != nil || skipped {
+			n := int64(len(ms) - i)
+			atomic.AddInt64(&hg.n, -n)
+			atomic.AddInt64(&s.stats.inFlight, -n)
+
+			if skipped {
+				atomic.AddInt64(&s.stats.handled, 1)
+				return
+			}
+
+			atomic.AddInt64(&s.stats.failed, 1)
+			s.errorFn(err)
+			return
+		}
+
+		atomic.AddInt64(&hg.n, -1)
+		atomic.AddInt64(&s.stats.inFlight, -1)
+		atomic.AddInt64(&s.stats.handled, 1)
+	}
+}
+
+// groupMessages returns the messages to be handled by each handler invocation
+// FIFO messages are grouped by message group id in receive order, so that each group is handled sequentially
+// while different groups are handled concurrently. Standard queue messages are handled individually.
+func groupMessages(msgs []types.Message, fifo bool) [][]types.Message {
+	gs := make([][]types.Message, 0, len(msgs))
+	if !fifo {
+		for _, m := range msgs {
+			gs = append(gs, []types.Message{m})
+		}
+		return gs
+	}
+
+	idx := map[string]int{}
+	for _, m := range msgs {
+		id := m.Attributes[messageGroupIDAttributeName]
+		i, ok := idx[id]
+		if !ok {
+			i = len(gs)
+			idx[id] = i
+			gs = append(gs, nil)
+		}
+
+		gs[i] = append(gs[i], m)
+	}
+
+	return gs
+}
+
+// recordTypeResult tracks consecutive failures for each message type, resetting the count on success
+func (s *Subscriber) recordTypeResult(messageType string, err error) {
+	if s.typeFailingFn == nil || s.typeFailureThreshold <= 0 {
+		return
+	}
+
+	s.typeFailuresMu.Lock()
+	if err == nil {
+		delete(s.typeFailures, messageType)
+		s.typeFailuresMu.Unlock()
+		return
+	}
+
+	s.typeFailures[messageType]++
+	n := s.typeFailures[messageType]
+	s.typeFailuresMu.Unlock()
+
+	if n >= s.typeFailureThreshold {
+		s.typeFailingFn(messageType, n)
+	}
+}
+
+func (s *Subscriber) pooledHandler(h Handler, mt protoreflect.MessageType) Handler {
+	// pools are shared by message type across subscriptions
+	p, _ := s.messagePools.LoadOrStore(mt.Descriptor().FullName(), &sync.Pool{
+		New: func() interface{} {
+			return mt.New().Interface()
+		},
+	})
+
+	return &pooledHandler{
+		Handler: h,
+		pool:    p.(*sync.Pool),
+	}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (h *pooledHandler) Message() proto.Message {
+	return h.pool.Get().(proto.Message)
+}
+
+func (h *pooledHandler) release(m proto.Message) {
+	proto.Reset(m)
+	h.pool.Put(m)
+}
+
+func (h *releasingHandler) release(m proto.Message) {
+	h.releaser.Release(m)
+}
+
+func (s *Subscriber) acquireHandler(ctx context.Context) bool {
+	return s.handlers.acquire(ctx)
+}
+
+func (s *Subscriber) releaseHandler() {
+	s.handlers.release()
+}
+
+// SetMaxNumberOfMessages sets the maximum number of messages requested by each receive, taking effect on the next receive
+func (s *Subscriber) SetMaxNumberOfMessages(n int) {
+	atomic.StoreInt32(&s.maxNumberOfMessages, int32(n))
+}
+
+// SetVisibilityTimeout sets the visibility timeout requested by each receive, taking effect on the next receive
+func (s *Subscriber) SetVisibilityTimeout(seconds int) {
+	atomic.StoreInt32(&s.visibilityTimeoutSeconds, int32(seconds))
+}
+
+// SetMaxConcurrentHandlers sets the maximum number of concurrent handler invocations, taking effect on the next dispatch.
+// In-flight handlers are not affected if the limit is reduced. A limit of zero or less removes the limit.
+func (s *Subscriber) SetMaxConcurrentHandlers(n int) {
+	s.handlers.setLimit(n)
+}
+
+func (s *Subscriber) visibilityTimeout() int32 {
+	return atomic.LoadInt32(&s.visibilityTimeoutSeconds)
+}
+
+func (l *handlerLimiter) acquire(ctx context.Context) bool {
+	for {
+		l.mu.Lock()
+		if l.limit <= 0 || l.n < l.limit {
+			l.n++
+			l.mu.Unlock()
+			return true
+		}
+
+		if l.wait == nil {
+			l.wait = make(chan struct{})
+		}
+		w := l.wait
+		l.mu.Unlock()
+
+		select {
+		case <-w:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (l *handlerLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.n--
+	l.notify()
+}
+
+func (l *handlerLimiter) setLimit(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = n
+	l.notify()
+}
+
+// notify wakes all waiting callers, which must be called with the lock held
+func (l *handlerLimiter) notify() {
+	if l.wait != nil {
+		close(l.wait)
+		l.wait = nil
+	}
+}
+
+func (s *Subscriber) receiveMessages(ctx context.Context, queueURL, attemptID string) ([]types.Message, error) {
+	in := &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueURL),
+		MaxNumberOfMessages: atomic.LoadInt32(&s.maxNumberOfMessages),
+		WaitTimeSeconds:     int32(s.waitTimeSeconds),
+		VisibilityTimeout:   s.visibilityTimeout(),
+	}
+	if len(s.messageAttributeNames) > 0 {
+		in.MessageAttributeNames = s.messageAttributeNames
+	}
+	if s.receiveCount {
+		in.AttributeNames = append(in.AttributeNames, receiveCountAttributeName)
+	}
+	if isFIFO(queueURL) {
+		in.AttributeNames = append(in.AttributeNames, messageGroupIDAttributeName)
+	}
+	if attemptID != "" {
+		in.ReceiveRequestAttemptId = aws.String(attemptID)
+	}
+	s.receiveInputFn(in)
+
+	res, err := s.receiveFn(ctx, in)
+	if err != nil || res == nil {
+		return nil, err
+	}
+
+	return res.Messages, nil
+}
+
+func (s *Subscriber) handleMessage(ctx context.Context, queueURL string, m types.Message, h Handler) error {
+	logw("received message", "message_id", *m.MessageId, "queue_url", queueURL)
+
+	// control messages are never passed to the handler, as they do not contain a message payload
+	// messages without a type are treated as notifications to support raw delivery
+	switch t := gjson.Get(*m.Body, "Type").Str; t {
+	case "", envelopeNotification:
+	case envelopeSubscriptionConfirmation:
+		return s.confirmSubscription(ctx, queueURL, m)
+	case envelopeUnsubscribeConfirmation:
+		logw("discarded message", "message_id", *m.MessageId, "queue_url", queueURL)
+		return s.deleteMessage(ctx, queueURL, m)
+	default:
+		return fmt.Errorf("unsupported envelope type: %s", t)
+	}
+
+	// targets are reset before decode, so that handlers can safely return reused instances
+	pm := h.Message()
+	proto.Reset(pm)
+
+	// targets are released once all handler attempts have completed, as retries reuse the decoded message
+	if r, ok := h.(targetReleaser); ok {
+		defer r.release(pm)
+	}
+
+	dm, err := s.decodeMessage(m, pm)
+	if err != nil {
+		if s.decodeErrorVisibilityTimeoutSeconds > 0 {
+			_, verr := s.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(queueURL),
+				ReceiptHandle:     m.ReceiptHandle,
+				VisibilityTimeout: int32(s.decodeErrorVisibilityTimeoutSeconds),
+			})
+			if verr != nil {
+				s.errorFn(verr)
+			}
+		}
+
+		return err
+	}
+
+	s.metrics.IncReceived(dm.Type)
+
+	a := &acknowledger{s: s, queueURL: queueURL, message: m}
+
+	stop := s.startVisibilityExtension(ctx, a)
+	err = s.handleWithRetry(ctx, h, dm, a)
+	stop()
+	if errors.Is(err, ErrSkip) {
+		logw("skipped message", "message_id", *m.MessageId, "message_type", dm.Type, "queue_url", queueURL)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if a.isManual() {
+		return nil
+	}
+
+	// the handled message is deleted regardless of cancellation, as it would otherwise be redelivered
+	if s.detachedDeleteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(detachedContext{ctx}, s.detachedDeleteTimeout)
+		defer cancel()
+	}
+
+	if s.deleteBatcher != nil {
+		s.deleteBatcher.add(ctx, s, queueURL, m)
+		return nil
+	}
+
+	return s.deleteMessage(ctx, queueURL, m)
+}
+
+// handleWithRetry retries failed handlers in-process before the message is left for redelivery, which avoids
+// consuming the redrive count for brief failures. Retries stop if the next attempt would exceed the visibility timeout.
+func (s *Subscriber) handleWithRetry(ctx context.Context, h Handler, dm Message, a *acknowledger) error {
+	var deadline time.Time
+	if vt := s.visibilityTimeout(); !s.extendVisibility && vt > 0 {
+		deadline = time.Now().Add(time.Duration(vt) * time.Second)
+	}
+
+	for i := 1; ; i++ {
+		err := s.handle(ctx, h, dm, a)
+		if err == nil || errors.Is(err, ErrSkip) || i > s.maxRetries || a.isManual() {
+			return err
+		}
+
+		d := s.backoffFn(i)
+		if !deadline.IsZero() && time.Now().Add(d).After(deadline) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+
+		logw("retrying message", "message_id", dm.ID, "message_type", dm.Type, "attempt", i)
+	}
+}
+
+func (s *Subscriber) handle(ctx context.Context, h Handler, dm Message, a Acknowledger) (err error) {
+	// metrics are recorded last, so that they include timeouts and recovered panics
+	start := time.Now()
+	defer func() {
+		s.metrics.ObserveHandleDuration(dm.Type, time.Since(start))
+		if err != nil && !errors.Is(err, ErrSkip) {
+			s.metrics.IncHandleError(dm.Type)
+		}
+	}()
+
+	// the span is ended after the handler, so that it records timeouts and recovered panics
+	if s.traceExtractor != nil {
+		var span trace.Span
+		ctx, span = startSpan(ctx, s.traceExtractor, s.tracerProvider, dm.Metadata)
+		defer func() { endSpan(span, err) }()
+	}
+
+	if s.handlerTimeout > 0 {
+		tctx, cancel := context.WithTimeout(ctx, s.handlerTimeout)
+		defer cancel()
+
+		// timed out messages are never deleted, even if the handler ignores the context and returns nil
+		defer func() {
+			if tctx.Err() == context.DeadlineExceeded && !errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("handler timed out after %s: %w", s.handlerTimeout, context.DeadlineExceeded)
+			}
+		}()
+
+		ctx = tctx
+	}
+
+	// panics are returned as errors, so the message is not deleted and will be redelivered
+	if s.recoverPanics {
+		defer func() {
+			if v := recover(); v != nil {
+				err = &PanicError{Value: v, Stack: debug.Stack()}
+			}
+		}()
+	}
+
+	// the correlation id is added before the context func, allowing it to be read or replaced
+	if dm.CorrelationID != "" {
+		ctx = ContextWithCorrelationID(ctx, dm.CorrelationID)
+	}
+
+	ctx = context.WithValue(s.contextFn(ctx), ackKey{}, a)
+	return h.Handle(ctx, dm.Payload, dm.Metadata)
+}
+
+func (h rawHandler) Message() proto.Message {
+	return new(anypb.Any)
+}
+
+func (h rawHandler) Handle(ctx context.Context, m proto.Message, md Metadata) error {
+	return h.HandleRaw(ctx, m.(*anypb.Any), md)
+}
+
+// AcknowledgerFromContext returns the acknowledger for the message being handled
+// The acknowledger is only available within the context passed to Handle, but can be retained
+// to settle the message asynchronously once the handler has returned.
+func AcknowledgerFromContext(ctx context.Context) (Acknowledger, bool) {
+	a, ok := ctx.Value(ackKey{}).(Acknowledger)
+	return a, ok
+}
+
+// Ack deletes the message from the queue
+func (a *acknowledger) Ack(ctx context.Context) error {
+	if err := a.settle(); err != nil {
+		return err
+	}
+
+	return a.s.deleteMessage(ctx, a.queueURL, a.message)
+}
+
+// Nack makes the message immediately visible to other consumers for redelivery
+func (a *acknowledger) Nack(ctx context.Context) error {
+	if err := a.settle(); err != nil {
+		return err
+	}
+
+	_, err := a.s.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(a.queueURL),
+		ReceiptHandle:     a.message.ReceiptHandle,
+		VisibilityTimeout: 0,
+	})
+	return err
+}
+
+// Defer prevents the message from being deleted when the handler returns, allowing Ack or Nack to be called later
+// The message will become visible to other consumers if it is not settled before the visibility timeout has elapsed.
+func (a *acknowledger) Defer() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.manual = true
+}
+
+func (a *acknowledger) settle() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.settled {
+		return fmt.Errorf("message %s has already been settled", aws.ToString(a.message.MessageId))
+	}
+
+	a.manual, a.settled = true, true
+	return nil
+}
+
+func (a *acknowledger) isSettled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.settled
+}
+
+func (a *acknowledger) isManual() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.manual
+}
+
+// Error returns the panic value and stack trace
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v\n%s", e.Value, e.Stack)
+}
+
+// startVisibilityExtension extends the message visibility timeout at half the configured interval until the
+// returned func is called, or the message is settled by the handler
+func (s *Subscriber) startVisibilityExtension(ctx context.Context, a *acknowledger) func() {
+	vt := s.visibilityTimeout()
+	if !s.extendVisibility || vt <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		t := time.NewTicker(time.Duration(vt) * time.Second / 2)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if a.isSettled() {
+					return
+				}
+
+				_, err := s.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(a.queueURL),
+					ReceiptHandle:     a.message.ReceiptHandle,
+					VisibilityTimeout: vt,
+				})
+				if err != nil {
+					s.errorFn(err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (s *Subscriber) confirmSubscription(ctx context.Context, queueURL string, m types.Message) error {
+	if s.confirmClient == nil {
+		logw("discarded message", "message_id", *m.MessageId, "queue_url", queueURL)
+		return s.deleteMessage(ctx, queueURL, m)
+	}
+
+	env := gjson.Parse(*m.Body)
+	arn := env.Get("TopicArn").Str
+
+	_, err := s.confirmClient.ConfirmSubscription(ctx, &sns.ConfirmSubscriptionInput{
+		TopicArn: aws.String(arn),
+		Token:    aws.String(env.Get("Token").Str),
+	})
+	if err != nil {
+		return err
+	}
+
+	logw("confirmed subscription", "topic_arn", arn, "queue_url", queueURL)
+	return s.deleteMessage(ctx, queueURL, m)
+}
+
+func (s *Subscriber) deleteMessage(ctx context.Context, queueURL string, m types.Message) error {
+	return retry(ctx, s.deleteRetryAttempts, s.deleteRetryDelay, func() error {
+		_, err := s.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(queueURL),
+			ReceiptHandle: m.ReceiptHandle,
+		})
+		return err
+	})
+}
+
+func (s *Subscriber) startDeleteFlush(ctx context.Context) func() {
+	if s.deleteBatcher == nil || s.deleteFlushInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		t := time.NewTicker(s.deleteFlushInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				s.deleteBatcher.flush(detachedContext{ctx}, s)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (s *Subscriber) flushDeletes(ctx context.Context) {
+	if s.deleteBatcher == nil {
+		return
+	}
+
+	var fctx context.Context = detachedContext{ctx}
+	if s.shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		fctx, cancel = context.WithTimeout(fctx, s.shutdownTimeout)
+		defer cancel()
+	}
+
+	s.deleteBatcher.flush(fctx, s)
+}
+
+func (s *Subscriber) deleteMessageBatch(ctx context.Context, queueURL string, ms []types.Message) {
+	in := &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(queueURL),
+		Entries:  make([]types.DeleteMessageBatchRequestEntry, len(ms)),
+	}
+
+	// entry ids only need to be unique within the batch, and messages may be received more than once
+	for i, m := range ms {
+		in.Entries[i] = types.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: m.ReceiptHandle,
+		}
+	}
+
+	var res *sqs.DeleteMessageBatchOutput
+	err := retry(ctx, s.deleteRetryAttempts, s.deleteRetryDelay, func() error {
+		var err error
+		res, err = s.client.DeleteMessageBatch(ctx, in)
+		return err
+	})
+	if err != nil {
+		ids := make([]string, len(ms))
+		for i, m := range ms {
+			ids[i] = aws.ToString(m.MessageId)
+		}
+
+		s.errorFn(fmt.Errorf("failed to delete messages %s: %w", strings.Join(ids, ", "), err))
+		return
+	}
+
+	if len(res.Failed) > 0 {
+		msgs := make([]string, len(res.Failed))
+		for i, f := range res.Failed {
+			j, _ := strconv.Atoi(aws.ToString(f.Id))
+			msgs[i] = fmt.Sprintf("%s: %s", aws.ToString(ms[j].MessageId), aws.ToString(f.Message))
+		}
+
+		s.errorFn(fmt.Errorf("failed to delete messages: %s", strings.Join(msgs, "; ")))
+	}
+
+	logw("deleted messages", "count", len(ms)-len(res.Failed), "queue_url", queueURL)
+}
+
+func (b *deleteBatcher) add(ctx context.Context, s *Subscriber, queueURL string, m types.Message) {
+	b.mu.Lock()
+
+	ms := append(b.pending[queueURL], m)
+	if len(ms) < b.size {
+		b.pending[queueURL] = ms
+		b.mu.Unlock()
+		return
+	}
+
+	delete(b.pending, queueURL)
+	b.mu.Unlock()
+
+	// the batch contains messages from other handlers, so the delete is not bound to the handler context
+	s.deleteMessageBatch(detachedContext{ctx}, queueURL, ms)
+}
+
+func (b *deleteBatcher) flush(ctx context.Context, s *Subscriber) {
+	b.mu.Lock()
+	p := b.pending
+	b.pending = map[string][]types.Message{}
+	b.mu.Unlock()
+
+	for q, ms := range p {
+		s.deleteMessageBatch(ctx, q, ms)
+	}
+}
+
+func isFIFO(queueURL string) bool {
+	return strings.HasSuffix(queueURL, fifoSuffix)
+}
+
+func (s *Subscriber) decodeMessage(m types.Message, pm proto.Message) (Message, error) {
+	env, em := parseBody(*m.Body, s.messagePath)
+
+	var dm Message
+	b, err := s.decode(em)
+	switch {
+	case err == nil:
+		dm, err = s.unmarshal(b, pm)
+	case s.protoJSONFallback:
+		dm, err = unmarshalProtoJSON(env, em, pm)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+
+	env.Get("MessageAttributes").ForEach(func(k, v gjson.Result) bool {
+		a := Attribute{DataType: v.Get("Type").Str}
+		if strings.HasPrefix(a.DataType, "Binary") {
+			a.BinaryValue, _ = base64.StdEncoding.DecodeString(v.Get("Value").Str)
+		} else {
+			a.StringValue = v.Get("Value").Str
+		}
+
+		setAttribute(&dm.Metadata, k.Str, v.Get("Value").Str, a)
+		return true
+	})
+
+	// system attributes are only present if requested on receive
+	if v, ok := m.Attributes[receiveCountAttributeName]; ok {
+		dm.ReceiveCount, _ = strconv.Atoi(v)
+	}
+
+	// sqs attributes are only present for raw delivery, and only if requested on receive
+	for k, v := range m.MessageAttributes {
+		a := Attribute{
+			DataType:    aws.ToString(v.DataType),
+			StringValue: aws.ToString(v.StringValue),
+			BinaryValue: v.BinaryValue,
+		}
+
+		h := a.StringValue
+		if a.BinaryValue != nil {
+			h = base64.StdEncoding.EncodeToString(a.BinaryValue)
+		}
+
+		setAttribute(&dm.Metadata, k, h, a)
+	}
+
+	return dm, nil
+}
+
+// parseBody returns the sns envelope and the encoded message at the specified path for the specified body
+// Bodies without an envelope message are treated as raw deliveries, in which case the envelope is empty.
+func parseBody(body, path string) (gjson.Result, string) {
+	env := gjson.Parse(body)
+	if env.IsObject() {
+		if em := env.Get(path); em.Exists() {
+			return env, em.Str
+		}
+	}
+
+	return gjson.Result{}, body
+}
+
+func setAttribute(md *Metadata, name, header string, a Attribute) {
+	if md.Headers == nil {
+		md.Headers = map[string]string{}
+	}
+	if md.Attributes == nil {
+		md.Attributes = map[string]Attribute{}
+	}
+
+	md.Headers[name] = header
+	md.Attributes[name] = a
+}
+
+func (s *Subscriber) unmarshal(b []byte, pm proto.Message) (Message, error) {
+	if s.gzipDetection && bytes.HasPrefix(b, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return Message{}, err
+		}
+		defer r.Close()
+
+		b, err = ioutil.ReadAll(r)
+		if err != nil {
+			return Message{}, err
+		}
+	}
+
+	return s.codec.Unmarshal(b, pm)
+}
+
+// decode decodes the encoded message, which is only base64 encoded if the codec does not produce text
+func (s *Subscriber) decode(em string) ([]byte, error) {
+	if _, ok := s.codec.(textCodec); ok {
+		return []byte(em), nil
+	}
+
+	return s.encoding.DecodeString(em)
+}
+
+func unmarshalProtoJSON(env gjson.Result, em string, pm proto.Message) (Message, error) {
+	err := protojson.Unmarshal([]byte(em), pm)
+	if err != nil {
+		return Message{}, err
+	}
+
+	// plain messages do not contain pram metadata, so it is populated from the sns envelope
+	ts, _ := time.Parse(time.RFC3339Nano, env.Get("Timestamp").Str)
+	return Message{
+		Payload: pm,
+		Metadata: Metadata{
+			ID:        env.Get("MessageId").Str,
+			Type:      messageType(pm),
+			Timestamp: ts,
+		},
+	}, nil
+}
+
+// WithQueueRegistry configures the subscriber to use the specified registry
+// to resolve queues, creating them if they do not exist
+func WithQueueRegistry(r *Registry) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.QueueURLFn = r.QueueURL
+		o.ErrorQueueURLFn = r.ErrorQueueURL
+	}
+}
+
+// WithErrorHandler configures the subscriber to use the specified error handler func
+func WithErrorHandler(fn func(error)) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ErrorFn = fn
+	}
+}
+
+// WithReceiveFilter configures the subscriber to apply the specified func to each receive message request.
+// The func is applied after the subscriber has set its own values, which may be overridden.
+func WithReceiveFilter(fn func(*sqs.ReceiveMessageInput)) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ReceiveInputFn = fn
+	}
+}
+
+// WithContextValues configures the subscriber to apply the specified func to the context passed to each handler.
+// This allows dependencies, such as a database pool, to be made available to handlers without using globals.
+// Message metadata is passed to the handler directly, so the func is applied to the subscriber context only.
+func WithContextValues(fn func(context.Context) context.Context) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ContextFn = fn
+	}
+}
+
+// WithDecodeErrorVisibilityTimeout configures the subscriber to extend the visibility timeout of
+// messages that cannot be decoded. This reduces the number of receives, and therefore the rate at which
+// the redrive count is consumed, while a consumer is updated to support a new message version.
+func WithDecodeErrorVisibilityTimeout(seconds int) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.DecodeErrorVisibilityTimeoutSeconds = seconds
+	}
+}
+
+// WithSubscriberCodec configures the subscriber to use the specified codec for the message envelope.
+// This must match the codec used by publishers, see WithPublisherCodec.
+func WithSubscriberCodec(c Codec) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.Codec = c
+	}
+}
+
+// WithMessagePath configures the subscriber to extract the encoded message from the envelope using the specified
+// gjson path, which defaults to Message. This allows messages to be consumed from envelopes that nest the payload
+// differently. Bodies that do not contain the path are treated as raw deliveries. NewSubscriber panics if it is empty.
+func WithMessagePath(path string) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.MessagePath = path
+	}
+}
+
+// WithSubscriberMetrics configures the subscriber to record metrics using the specified sink.
+// Each handler call is timed, including retries, and errors other than ErrSkip are counted.
+func WithSubscriberMetrics(m SubscriberMetrics) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.Metrics = m
+	}
+}
+
+// WithSubscriberTracing configures the subscriber to extract the span context from the message envelope using the
+// specified propagator, starting a consumer span named after the message type around each handler call. Handler
+// errors are recorded on the span. The global tracer provider is used unless SubscriberOptions.TracerProvider is set.
+func WithSubscriberTracing(p propagation.TextMapPropagator) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.Propagator = p
+	}
+}
+
+// WithTraceExtractor configures the subscriber to extract the span context using the specified extractor, starting
+// a consumer span around each handler call as per WithSubscriberTracing. This allows spans to be continued from
+// producers that propagate the trace context in their own attributes, see HeaderTraceExtractor.
+func WithTraceExtractor(e TraceExtractor) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.TraceExtractor = e
+	}
+}
+
+// WithSubscriberEncoding configures the subscriber to use the specified base64 encoding for message bodies.
+// This must match the encoding used by publishers, see WithPublisherEncoding.
+func WithSubscriberEncoding(enc *base64.Encoding) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.Encoding = enc
+	}
+}
+
+// WithProtoJSONFallback configures the subscriber to decode message bodies that are not base64 encoded as protojson.
+// This allows messages to be consumed from producers that publish plain protojson rather than using a publisher.
+// Message metadata is populated from the sns envelope, as plain messages do not contain pram metadata.
+func WithProtoJSONFallback() func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ProtoJSONFallback = true
+	}
+}
+
+// WithReceiveConcurrency configures the number of concurrent receive loops for each subscribed queue.
+// This can improve throughput for deep queues, and can be combined with WithMaxConcurrentHandlers
+// to limit the number of messages that are handled concurrently.
+func WithReceiveConcurrency(n int) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ReceiveConcurrency = n
+	}
+}
+
+// WithMaxConcurrentHandlers limits the number of concurrent handler invocations across all subscriptions.
+// Receive loops block once the limit is reached, so no further messages are received until a handler completes.
+func WithMaxConcurrentHandlers(n int) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.MaxConcurrentHandlers = n
+	}
+}
+
+// WithGzipDetection configures the subscriber to decompress message bodies that start with the gzip header.
+// This allows compressed and uncompressed messages to be consumed from the same queue during a rollout.
+func WithGzipDetection() func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.GzipDetection = true
+	}
+}
+
+// WithMessageAttributeNames configures the subscriber to request the specified sqs message attributes on receive.
+// Requested attributes, along with any attributes in the sns envelope, are available to handlers as typed values
+// in Metadata.Attributes. Specify "All" to request all attributes.
+func WithMessageAttributeNames(names ...string) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.MessageAttributeNames = names
+	}
+}
+
+// WithReceiveCount configures the subscriber to request the approximate receive count for each message, which
+// is available to handlers as Metadata.ReceiveCount. This allows handlers to vary behaviour on later attempts.
+// The count is approximate, and may be higher than the number of times the handler has been invoked.
+func WithReceiveCount() func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ReceiveCount = true
+	}
+}
+
+// WithSubscriptionConfirmation configures the subscriber to confirm subscriptions using the specified client
+// when a subscription confirmation message is received, which is required for cross-account subscriptions.
+// Confirmation messages are otherwise deleted without being passed to the handler.
+func WithSubscriptionConfirmation(c SNS) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ConfirmClient = c
+	}
+}
+
+// WithMessagePool configures the subscriber to decode messages into pooled targets to reduce allocations.
+// Messages are reset and returned to the pool once the handler returns, so handlers must not retain
+// the message, or any of its fields, beyond the Handle call. The handler must always return the same message type.
+func WithMessagePool() func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.MessagePool = true
+	}
+}
+
+// WithSubscriberMiddleware configures the subscriber to wrap handlers with the specified middleware
+// Middleware is applied in order, with the first middleware outermost. Errors returned by middleware
+// are sent to the error handler in the same way as handler errors.
+func WithSubscriberMiddleware(mw ...HandlerMiddleware) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.Middleware = append(o.Middleware, mw...)
+	}
+}
+
+// WithReceiveMiddleware configures the subscriber to wrap each receive with the specified middleware
+// Middleware is applied in order, with the first middleware outermost. Returning an empty output without calling
+// the next func skips the receive, which allows processing to be paused. Errors are treated as receive errors.
+func WithReceiveMiddleware(mw ...ReceiveMiddleware) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ReceiveMiddleware = append(o.ReceiveMiddleware, mw...)
+	}
+}
+
+// WithReceiveErrorThreshold configures the subscriber to stop after the specified number of consecutive
+// fatal receive errors, such as a deleted queue or revoked permissions. Subscribe returns the last error,
+// allowing the process to fail loudly rather than appearing healthy. Transient errors reset the count.
+func WithReceiveErrorThreshold(n int) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ReceiveErrorThreshold = n
+	}
+}
+
+// WithShutdownTimeout configures the subscriber to drain in-flight messages when the context is cancelled.
+// Receives stop immediately, while messages that have already been dispatched are handled and deleted
+// using a context that is only cancelled once the timeout has elapsed. Received messages that are waiting
+// for the handler limit are left on the queue. If the timeout elapses, Subscribe returns an error wrapping
+// context.Canceled with the number of abandoned messages.
+func WithShutdownTimeout(d time.Duration) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ShutdownTimeout = d
+	}
+}
+
+// WithDetachedDelete configures the subscriber to delete handled messages using a context that is not cancelled with
+// the subscription context, bounded by the specified timeout. This prevents successfully handled messages from being
+// redelivered if the context is cancelled while they are being handled, for example during a deployment.
+func WithDetachedDelete(timeout time.Duration) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.DetachedDeleteTimeout = timeout
+	}
+}
+
+// WithDeleteBatching configures the subscriber to delete handled messages in batches of up to the specified size,
+// which is limited to 10 by sqs. Pending deletes are flushed once the batch is full, after the specified interval, and
+// when Subscribe returns. The interval should be well within the visibility timeout to avoid redelivery of handled
+// messages. Failed deletes are sent to the error handler with the affected message ids.
+func WithDeleteBatching(size int, interval time.Duration) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.DeleteBatchSize = size
+		o.DeleteFlushInterval = interval
+	}
+}
+
+// WithHandlerTimeout configures the subscriber to cancel the context passed to each handler after the specified duration.
+// Timed out messages are not deleted, and the error handler receives an error wrapping context.DeadlineExceeded.
+// Handlers must respect the context, as a handler that does not return will continue to hold its concurrency slot.
+func WithHandlerTimeout(d time.Duration) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.HandlerTimeout = d
+	}
+}
+
+// WithHandlerRetry configures the subscriber to retry failed handlers up to the specified number of times before the
+// message is left for redelivery. If backoffFn is nil, a jittered exponential backoff starting at 100ms is used.
+// Retries stop if the context is cancelled or the next attempt would start after the visibility timeout has elapsed.
+func WithHandlerRetry(maxRetries int, backoffFn func(attempt int) time.Duration) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.MaxRetries = maxRetries
+		if backoffFn != nil {
+			o.BackoffFn = backoffFn
+		}
+	}
+}
+
+// WithTypeFailureAlert configures the subscriber to call the specified func for each consecutive handler failure
+// for a message type once the threshold has been reached. This surfaces a failing handler before messages are moved
+// to the error queue. The count is reset when a message of the same type is handled successfully.
+func WithTypeFailureAlert(threshold int, fn func(messageType string, count int)) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.TypeFailureThreshold = threshold
+		o.OnTypeFailing = fn
+	}
+}
+
+// WithVisibilityExtension configures the subscriber to extend the visibility timeout of each message at half the
+// configured timeout while the handler is running. This prevents messages from being redelivered while they are still
+// being handled by long running handlers. Extension stops once the handler returns, including for deferred messages.
+func WithVisibilityExtension() func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.ExtendVisibility = true
+	}
+}
+
+// WithDynamicQueueURL configures the subscriber to resolve the queue url before each receive, rather than
+// once when subscribing. This allows the queue to change without restarting the subscriber, at the cost
+// of an additional resolution per receive.
+func WithDynamicQueueURL() func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.DynamicQueueURL = true
+	}
+}
+
+// WithDeleteRetry configures the subscriber to retry transient delete errors up to the specified number of
+// attempts, with a jittered exponential delay between attempts. This reduces duplicate handling of
+// messages that were handled successfully but could not be deleted.
+func WithDeleteRetry(attempts int, delay time.Duration) func(*SubscriberOptions) {
+	return func(o *SubscriberOptions) {
+		o.DeleteRetryAttempts = attempts
+		o.DeleteRetryDelay = delay
 	}
 }
@@ -1,23 +1,33 @@
 package pram_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/golang/mock/gomock"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 
 	"github.com/stevecallear/pram"
 	"github.com/stevecallear/pram/internal/assert"
 	"github.com/stevecallear/pram/mocks"
+	"github.com/stevecallear/pram/pramtest"
 	"github.com/stevecallear/pram/proto/testpb"
 )
 
@@ -92,6 +102,18 @@ func TestSubscriber_SubscribeAsync(t *testing.T) {
 			},
 			err: true,
 		},
+		{
+			name: "should not delete skipped messages",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(msg), nil).Times(1)
+			},
+			queueFn: func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			},
+			handleFn: func(context.Context, proto.Message, pram.Metadata) error {
+				return fmt.Errorf("wrapped: %w", pram.ErrSkip)
+			},
+		},
 		{
 			name: "should handle messages",
 			setup: func(m *mocks.MockSQSMockRecorder) {
@@ -144,6 +166,292 @@ func TestSubscriber_SubscribeAsync(t *testing.T) {
 	}
 }
 
+func TestSubscriber_SubscribeQueues(t *testing.T) {
+	t.Run("should return an error if no queues are specified", func(t *testing.T) {
+		sut := pram.NewSubscriber(nil)
+
+		err := sut.SubscribeQueues(context.Background(), newHandler(nil, func() {}))
+		assert.ErrorExists(t, err, true)
+	})
+
+	t.Run("should handle messages from each queue", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		msg := &testpb.Message{Value: "value"}
+		queues := []string{"queue-a", "queue-b"}
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		for _, q := range queues {
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), receiveMessageInputForQueue(q)).Return(newReceiveMessageOutput(msg), nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), receiveMessageInputForQueue(q)).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(q),
+				ReceiptHandle: aws.String("receipthandle"),
+			}).Return(nil, nil).Times(1)
+		}
+
+		sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		wg := new(sync.WaitGroup)
+		wg.Add(len(queues))
+
+		go func() {
+			wg.Wait()
+			cancel()
+		}()
+
+		err := sut.SubscribeQueues(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			wg.Done()
+			return nil
+		}, func() {}), queues...)
+
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestSubscriber_SubscribeAll(t *testing.T) {
+	errQueueNotFound := errors.New("queue not found")
+
+	t.Run("should return an error if no handlers are specified", func(t *testing.T) {
+		sut := pram.NewSubscriber(nil)
+
+		err := sut.SubscribeAll(context.Background())
+		assert.ErrorExists(t, err, true)
+	})
+
+	t.Run("should return nil if all subscriptions stop cleanly", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+
+		sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.SubscribeAll(ctx, newHandler(nil, cancel), namedHandler{newHandler(nil, cancel)})
+		assert.ErrorExists(t, err, false)
+	})
+
+	t.Run("should stop all subscriptions and return the results if a subscription fails", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+
+		sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(_ context.Context, m proto.Message) (string, error) {
+				if _, ok := m.(*testpb.NamedMessage); ok {
+					return "", errQueueNotFound
+				}
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.SubscribeAll(ctx, newHandler(nil, cancel), namedHandler{newHandler(nil, cancel)})
+
+		var se pram.SubscribeError
+		if !errors.As(err, &se) {
+			t.Fatalf("got %v, expected a subscribe error", err)
+		}
+		if !errors.Is(err, errQueueNotFound) {
+			t.Errorf("got %v, expected %v", err, errQueueNotFound)
+		}
+		if ctx.Err() != nil {
+			t.Error("subscriptions were not stopped")
+		}
+
+		assert.DeepEqual(t, len(se), 2)
+		assert.DeepEqual(t, se[0].MessageType, "pram.test.Message")
+		assert.ErrorExists(t, se[0].Err, false)
+		assert.DeepEqual(t, se[1].MessageType, "pram.test.NamedMessage")
+		assert.ErrorExists(t, se[1].Err, true)
+	})
+}
+
+func TestSubscriber_SubscribeFIFO(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue string
+		exp   func([]string) bool
+	}{
+		{
+			name:  "should not set the attempt id for standard queues",
+			queue: "queue",
+			exp: func(ids []string) bool {
+				return ids[0] == "" && ids[1] == "" && ids[2] == ""
+			},
+		},
+		{
+			name:  "should reuse the attempt id after an error for fifo queues",
+			queue: "queue.fifo",
+			exp: func(ids []string) bool {
+				return ids[0] != "" && ids[0] == ids[1] && ids[2] != "" && ids[2] != ids[1]
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var ids []string
+			record := func(err error) func(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+				return func(_ context.Context, in *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+					ids = append(ids, aws.ToString(in.ReceiveRequestAttemptId))
+					if len(ids) > 2 {
+						cancel()
+					}
+					if err != nil {
+						return nil, err
+					}
+					return new(sqs.ReceiveMessageOutput), nil
+				}
+			}
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			gomock.InOrder(
+				sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).DoAndReturn(record(errors.New("error"))).Times(1),
+				sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).DoAndReturn(record(nil)).Times(2),
+			)
+
+			sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return tt.queue, nil
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			err := sut.Subscribe(ctx, newHandler(nil, cancel))
+			assert.ErrorExists(t, err, false)
+
+			if !tt.exp(ids) {
+				t.Errorf("unexpected attempt ids: %v", ids)
+			}
+		})
+	}
+}
+
+func TestSubscriber_SubscribeFIFOOrdering(t *testing.T) {
+	tests := []struct {
+		name    string
+		failOn  string
+		skipOn  string
+		deletes int
+		exp     []string
+	}{
+		{
+			name:    "should handle groups concurrently and messages within a group in order",
+			deletes: 3,
+			exp:     []string{"b1", "a1", "a2"},
+		},
+		{
+			name:    "should not handle subsequent messages in a group after a failure",
+			failOn:  "a1",
+			deletes: 1,
+			exp:     []string{"b1", "a1"},
+		},
+		{
+			name:    "should not handle subsequent messages in a group after a skip",
+			skipOn:  "a1",
+			deletes: 1,
+			exp:     []string{"b1", "a1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			msg := func(value, groupID string) types.Message {
+				m := newReceiveMessageOutput(&testpb.Message{Value: value}).Messages[0]
+				m.Attributes = map[string]string{"MessageGroupId": groupID}
+				return m
+			}
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, in *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+					assert.DeepEqual(t, in.AttributeNames, []types.QueueAttributeName{"MessageGroupId"})
+					return &sqs.ReceiveMessageOutput{
+						Messages: []types.Message{msg("a1", "a"), msg("b1", "b"), msg("a2", "a")},
+					}, nil
+				}).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(tt.deletes)
+
+			sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue.fifo", nil
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			var act []string
+			mu := new(sync.Mutex)
+			err := sut.Subscribe(ctx, newHandler(func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+				v := m.(*testpb.Message).Value
+				if v == "a1" {
+					time.Sleep(50 * time.Millisecond)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				act = append(act, v)
+				if len(act) == len(tt.exp) {
+					cancel()
+				}
+
+				if v == tt.failOn {
+					return errors.New("error")
+				}
+				if v == tt.skipOn {
+					return pram.ErrSkip
+				}
+				return nil
+			}, func() {}))
+
+			assert.ErrorExists(t, err, false)
+			assert.DeepEqual(t, act, tt.exp)
+		})
+	}
+}
+
 func TestWithQueueRegistry(t *testing.T) {
 	t.Run("should update the options", func(t *testing.T) {
 		r := pram.NewRegistry(nil, nil)
@@ -157,6 +465,83 @@ func TestWithQueueRegistry(t *testing.T) {
 		if act != exp {
 			t.Errorf("got %v, expected %v", act, exp)
 		}
+
+		exp = reflect.ValueOf(r.ErrorQueueURL).Pointer()
+		act = reflect.ValueOf(o.ErrorQueueURLFn).Pointer()
+
+		if act != exp {
+			t.Errorf("got %v, expected %v", act, exp)
+		}
+	})
+}
+
+func TestSubscriber_SubscribeErrorQueue(t *testing.T) {
+	t.Run("should return an error if the error queue cannot be resolved", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		sut := pram.NewSubscriber(mocks.NewMockSQS(ctrl))
+
+		err := sut.SubscribeErrorQueue(context.Background(), newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			return nil
+		}, func() {}))
+		assert.ErrorExists(t, err, true)
+	})
+
+	t.Run("should handle messages from the error queue", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		mn := pram.MessageName(new(testpb.Message))
+
+		s := pram.NewInMemoryStore(0)
+		s.GetOrSetTopicARN(ctx, mn, func() (string, error) {
+			return "topic", nil
+		})
+		s.GetOrSetQueueURL(ctx, mn, func() (string, error) {
+			return "queue", nil
+		})
+		s.GetOrSetQueueURL(ctx, "dlq-"+mn, func() (string, error) {
+			return "errorqueue", nil
+		})
+
+		r := pram.NewRegistry(mocks.NewMockSNS(ctrl), mocks.NewMockSQS(ctrl), pram.WithStore(s), func(o *pram.RegistryOptions) {
+			o.Queue.ErrorNameFn = func(m proto.Message) string {
+				return "dlq-" + pram.MessageName(m)
+			}
+		})
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, in *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+				assert.DeepEqual(t, aws.ToString(in.QueueUrl), "errorqueue")
+				return newReceiveMessageOutput(&testpb.Message{Value: "value"}), nil
+			}).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String("errorqueue"),
+			ReceiptHandle: aws.String("receipthandle"),
+		}).Return(nil, nil).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithQueueRegistry(r), func(o *pram.SubscriberOptions) {
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act string
+		err := sut.SubscribeErrorQueue(ctx, newHandler(func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+			act = m.(*testpb.Message).Value
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, "value")
 	})
 }
 
@@ -176,49 +561,2757 @@ func TestWithErrorHandler(t *testing.T) {
 	})
 }
 
-type handler struct {
-	handleFn func(context.Context, proto.Message, pram.Metadata) error
-	cancel   context.CancelFunc
+func TestSubscriber_SubscribeHeaders(t *testing.T) {
+	t.Run("should read message attributes from the envelope", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		enc, err := pram.Marshal(&testpb.Message{Value: "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := `{
+  "Type" : "Notification",
+  "MessageId" : "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+  "TopicArn" : "arn:aws:sns:eu-west-1:111122223333:pram-test-Message",
+  "Message" : "` + base64.StdEncoding.EncodeToString(enc) + `",
+  "Timestamp" : "2021-07-20T12:00:00.000Z",
+  "SignatureVersion" : "1",
+  "Signature" : "EXAMPLE",
+  "SigningCertURL" : "EXAMPLE",
+  "UnsubscribeURL" : "EXAMPLE",
+  "MessageAttributes" : {
+    "tenant" : {"Type":"String","Value":"tenant-a"},
+    "priority" : {"Type":"Number","Value":"1"},
+    "checksum" : {"Type":"Binary","Value":"AQID"}
+  }
+}`
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+			Messages: []types.Message{
+				{
+					MessageId:     aws.String("messageid"),
+					Body:          aws.String(body),
+					ReceiptHandle: aws.String("receipthandle"),
+				},
+			},
+		}, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act pram.Metadata
+		err = sut.Subscribe(ctx, newHandler(func(_ context.Context, _ proto.Message, md pram.Metadata) error {
+			act = md
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act.Headers, map[string]string{
+			"tenant":   "tenant-a",
+			"priority": "1",
+			"checksum": "AQID",
+		})
+		assert.DeepEqual(t, act.Attributes, map[string]pram.Attribute{
+			"tenant":   {DataType: "String", StringValue: "tenant-a"},
+			"priority": {DataType: "Number", StringValue: "1"},
+			"checksum": {DataType: "Binary", BinaryValue: []byte{1, 2, 3}},
+		})
+	})
 }
 
-func newHandler(handleFn func(context.Context, proto.Message, pram.Metadata) error, cancel context.CancelFunc) *handler {
-	return &handler{
-		handleFn: handleFn,
-		cancel:   cancel,
-	}
+func TestWithMessageAttributeNames(t *testing.T) {
+	t.Run("should request and read sqs message attributes", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		out := newReceiveMessageOutput(new(testpb.Message))
+		out.Messages[0].MessageAttributes = map[string]types.MessageAttributeValue{
+			"priority": {DataType: aws.String("Number.int"), StringValue: aws.String("2")},
+			"checksum": {DataType: aws.String("Binary"), BinaryValue: []byte{1, 2, 3}},
+		}
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String("queue"),
+			MaxNumberOfMessages:   10,
+			VisibilityTimeout:     15,
+			MessageAttributeNames: []string{"All"},
+		}).Return(out, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithMessageAttributeNames("All"), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act pram.Metadata
+		err := sut.Subscribe(ctx, newHandler(func(_ context.Context, _ proto.Message, md pram.Metadata) error {
+			act = md
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+
+		n, err := act.Attributes["priority"].Number()
+		assert.ErrorExists(t, err, false)
+
+		if n != 2 {
+			t.Errorf("got %v, expected 2", n)
+		}
+
+		assert.DeepEqual(t, act.Attributes["checksum"].BinaryValue, []byte{1, 2, 3})
+	})
 }
 
-func (h *handler) Message() proto.Message {
-	return new(testpb.Message)
+func TestWithReceiveCount(t *testing.T) {
+	t.Run("should request and read the receive count", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		out := newReceiveMessageOutput(new(testpb.Message))
+		out.Messages[0].Attributes = map[string]string{
+			"ApproximateReceiveCount": "3",
+		}
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String("queue"),
+			MaxNumberOfMessages: 10,
+			VisibilityTimeout:   15,
+			AttributeNames:      []types.QueueAttributeName{"ApproximateReceiveCount"},
+		}).Return(out, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithReceiveCount(), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act pram.Metadata
+		err := sut.Subscribe(ctx, newHandler(func(_ context.Context, _ proto.Message, md pram.Metadata) error {
+			act = md
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+
+		if act.ReceiveCount != 3 {
+			t.Errorf("got %d, expected 3", act.ReceiveCount)
+		}
+	})
 }
 
-func (h *handler) Handle(ctx context.Context, m proto.Message, md pram.Metadata) error {
-	defer h.cancel()
-	return h.handleFn(ctx, m, md)
+func TestWithReceiveFilter(t *testing.T) {
+	t.Run("should apply the func to the receive request", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), &sqs.ReceiveMessageInput{
+			QueueUrl:                aws.String("queue"),
+			MaxNumberOfMessages:     1,
+			ReceiveRequestAttemptId: aws.String("attemptid"),
+			VisibilityTimeout:       15,
+		}).DoAndReturn(func(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+			cancel()
+			return new(sqs.ReceiveMessageOutput), nil
+		}).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithReceiveFilter(func(in *sqs.ReceiveMessageInput) {
+			in.MaxNumberOfMessages = 1
+			in.ReceiveRequestAttemptId = aws.String("attemptid")
+		}), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.Subscribe(ctx, newHandler(nil, cancel))
+		assert.ErrorExists(t, err, false)
+	})
 }
 
-func newReceiveMessageOutput(m proto.Message) *sqs.ReceiveMessageOutput {
-	enc, err := pram.Marshal(m)
-	if err != nil {
-		panic(err)
-	}
+func TestWithContextValues(t *testing.T) {
+	t.Run("should apply the func to the handler context", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
 
-	bm := map[string]string{
-		"Message": base64.StdEncoding.EncodeToString(enc),
-	}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
-	bb, err := json.Marshal(bm)
-	if err != nil {
-		panic(err)
-	}
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
 
-	return &sqs.ReceiveMessageOutput{
-		Messages: []types.Message{
-			{
-				MessageId:     aws.String("messageid"),
-				Body:          aws.String(string(bb)),
-				ReceiptHandle: aws.String("receipthandle"),
-			},
-		},
-	}
+		type key struct{}
+		const exp = "value"
+
+		sut := pram.NewSubscriber(sqsc, pram.WithContextValues(func(ctx context.Context) context.Context {
+			return context.WithValue(ctx, key{}, exp)
+		}), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act interface{}
+		err := sut.Subscribe(ctx, newHandler(func(ctx context.Context, _ proto.Message, _ pram.Metadata) error {
+			act = ctx.Value(key{})
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, exp)
+	})
+}
+
+func TestWithDecodeErrorVisibilityTimeout(t *testing.T) {
+	t.Run("should extend the visibility timeout on decode errors", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		gomock.InOrder(
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+				Messages: []types.Message{
+					{
+						MessageId:     aws.String("messageid"),
+						Body:          aws.String("{\"Message\":\"invalid\"}"),
+						ReceiptHandle: aws.String("receipthandle"),
+					},
+				},
+			}, nil).Times(1),
+
+			sqsc.EXPECT().ChangeMessageVisibility(gomock.Any(), &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String("queue"),
+				ReceiptHandle:     aws.String("receipthandle"),
+				VisibilityTimeout: 3600,
+			}).Return(nil, nil).Times(1),
+		)
+
+		var err error
+		sut := pram.NewSubscriber(sqsc, pram.WithDecodeErrorVisibilityTimeout(3600), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(e error) {
+				err = e
+				cancel()
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		serr := sut.Subscribe(ctx, newHandler(nil, cancel))
+		assert.ErrorExists(t, serr, false)
+		assert.ErrorExists(t, err, true)
+	})
+}
+
+func TestWithSubscriberEncoding(t *testing.T) {
+	t.Run("should decode the message body", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		enc, err := pram.Marshal(&testpb.Message{Value: "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+			Messages: []types.Message{
+				{
+					MessageId:     aws.String("messageid"),
+					Body:          aws.String(`{"Message":"` + base64.RawURLEncoding.EncodeToString(enc) + `"}`),
+					ReceiptHandle: aws.String("receipthandle"),
+				},
+			},
+		}, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithSubscriberEncoding(base64.RawURLEncoding), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act string
+		err = sut.Subscribe(ctx, newHandler(func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+			act = m.(*testpb.Message).Value
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+
+		if exp := "value"; act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+	})
+}
+
+func TestWithSubscriberCodec(t *testing.T) {
+	t.Run("should decode text codecs without base64 decoding", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		enc, err := pram.JSONCodec{}.Marshal(pram.Message{Payload: &testpb.Message{Value: "value"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+			Messages: []types.Message{
+				{
+					MessageId:     aws.String("messageid"),
+					Body:          aws.String(string(enc)),
+					ReceiptHandle: aws.String("receipthandle"),
+				},
+			},
+		}, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithSubscriberCodec(pram.JSONCodec{}), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act string
+		err = sut.Subscribe(ctx, newHandler(func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+			act = m.(*testpb.Message).Value
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+
+		if exp := "value"; act != exp {
+			t.Errorf("got %s, expected %s", act, exp)
+		}
+	})
+}
+
+func TestCorrelationIDPropagation(t *testing.T) {
+	t.Run("should propagate the correlation id from publish to subscribe", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var bodies []string
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, in *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+				bodies = append(bodies, *in.Message)
+				return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+			}).Times(2)
+
+		p := pram.NewPublisher(snsc, func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		_, err := p.Publish(pram.ContextWithCorrelationID(ctx, "correlationid"), &testpb.Message{Value: "value"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+			Messages: []types.Message{
+				{
+					MessageId:     aws.String("messageid"),
+					Body:          aws.String(`{"Message":"` + bodies[0] + `"}`),
+					ReceiptHandle: aws.String("receipthandle"),
+				},
+			},
+		}, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act string
+		err = sut.Subscribe(ctx, newHandler(func(ctx context.Context, _ proto.Message, _ pram.Metadata) error {
+			act, _ = pram.CorrelationIDFromContext(ctx)
+			_, err := p.Publish(ctx, &testpb.Message{Value: "chained"})
+			return err
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, "correlationid")
+
+		m, err := pramtest.DecodeSNSPublishInput(&sns.PublishInput{Message: aws.String(bodies[1])}, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, m.CorrelationID, "correlationid")
+	})
+}
+
+func TestSubscriber_SubscribeRaw(t *testing.T) {
+	t.Run("should pass the envelope body to the handler", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String("queue"),
+			MaxNumberOfMessages: 10,
+			VisibilityTimeout:   15,
+		}).Return(newReceiveMessageOutput(&testpb.Message{Value: "value"}), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act testpb.Message
+		var mt string
+		err := sut.SubscribeRaw(ctx, "queue", rawHandlerFunc(func(_ context.Context, body *anypb.Any, md pram.Metadata) error {
+			defer cancel()
+			mt = md.Type
+			return body.UnmarshalTo(&act)
+		}))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, mt, "pram.test.Message")
+		assert.DeepEqual(t, act.Value, "value")
+	})
+}
+
+func TestSubscriber_RawDelivery(t *testing.T) {
+	enc, err := pram.Marshal(&testpb.Message{Value: "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "should decode enveloped bodies",
+			body: `{"Type":"Notification","Message":"` + base64.StdEncoding.EncodeToString(enc) + `"}`,
+		},
+		{
+			name: "should decode raw bodies",
+			body: base64.StdEncoding.EncodeToString(enc),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+				Messages: []types.Message{
+					{
+						MessageId:     aws.String("messageid"),
+						Body:          aws.String(tt.body),
+						ReceiptHandle: aws.String("receipthandle"),
+					},
+				},
+			}, nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+			sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(err error) {
+					t.Error(err)
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			var act string
+			err := sut.Subscribe(ctx, newHandler(func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+				act = m.(*testpb.Message).Value
+				return nil
+			}, cancel))
+
+			assert.ErrorExists(t, err, false)
+
+			if exp := "value"; act != exp {
+				t.Errorf("got %s, expected %s", act, exp)
+			}
+		})
+	}
+}
+
+func TestWithMessagePath(t *testing.T) {
+	t.Run("should panic if the path is empty", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		defer func() {
+			if recover() == nil {
+				t.Error("got nil, expected panic")
+			}
+		}()
+
+		pram.NewSubscriber(mocks.NewMockSQS(ctrl), pram.WithMessagePath(""))
+	})
+
+	t.Run("should extract the message from the path", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		enc, err := pram.Marshal(&testpb.Message{Value: "value"})
+		assert.ErrorExists(t, err, false)
+
+		bb, err := json.Marshal(map[string]interface{}{
+			"detail": map[string]string{
+				"body": base64.StdEncoding.EncodeToString(enc),
+			},
+		})
+		assert.ErrorExists(t, err, false)
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+			Messages: []types.Message{
+				{
+					MessageId:     aws.String("messageid"),
+					Body:          aws.String(string(bb)),
+					ReceiptHandle: aws.String("receipthandle"),
+				},
+			},
+		}, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithMessagePath("detail.body"), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var act string
+		err = sut.Subscribe(ctx, newHandler(func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+			act = m.(*testpb.Message).Value
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, act, "value")
+	})
+}
+
+func TestWithSubscriberMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		errors map[string]int
+	}{
+		{
+			name: "should record handled messages",
+		},
+		{
+			name:   "should record handler errors",
+			err:    errors.New("error"),
+			errors: map[string]int{"pram.test.Message": 1},
+		},
+		{
+			name: "should not record skipped messages as errors",
+			err:  pram.ErrSkip,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+			m := new(metrics)
+			sut := pram.NewSubscriber(sqsc, pram.WithSubscriberMetrics(m), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				return tt.err
+			}, cancel))
+			assert.ErrorExists(t, err, false)
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+
+			assert.DeepEqual(t, m.received, map[string]int{"pram.test.Message": 1})
+			assert.DeepEqual(t, m.handled, map[string]int{"pram.test.Message": 1})
+			assert.DeepEqual(t, m.handleErrors, tt.errors)
+		})
+	}
+}
+
+func TestWithProtoJSONFallback(t *testing.T) {
+	body := `{
+  "Type" : "Notification",
+  "MessageId" : "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+  "Message" : "{\"value\":\"value\"}",
+  "Timestamp" : "2021-07-20T12:00:00.000Z"
+}`
+
+	tests := []struct {
+		name  string
+		optFn func(*pram.SubscriberOptions)
+		exp   pram.Metadata
+		err   bool
+	}{
+		{
+			name:  "should return an error if the fallback is not enabled",
+			optFn: func(*pram.SubscriberOptions) {},
+			err:   true,
+		},
+		{
+			name:  "should decode plain protojson messages",
+			optFn: pram.WithProtoJSONFallback(),
+			exp: pram.Metadata{
+				ID:        "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+				Type:      "pram.test.Message",
+				Timestamp: time.Date(2021, 7, 20, 12, 0, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+				Messages: []types.Message{
+					{
+						MessageId:     aws.String("messageid"),
+						Body:          aws.String(body),
+						ReceiptHandle: aws.String("receipthandle"),
+					},
+				},
+			}, nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+			var err error
+			sut := pram.NewSubscriber(sqsc, tt.optFn, func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(e error) {
+					err = e
+					cancel()
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			var act pram.Metadata
+			serr := sut.Subscribe(ctx, newHandler(func(_ context.Context, m proto.Message, md pram.Metadata) error {
+				if v := m.(*testpb.Message).Value; v != "value" {
+					t.Errorf("got %s, expected value", v)
+				}
+				act = md
+				return nil
+			}, cancel))
+			if err == nil {
+				err = serr
+			}
+
+			assert.ErrorExists(t, err, tt.err)
+			assert.DeepEqual(t, act, tt.exp)
+		})
+	}
+}
+
+func TestWithReceiveConcurrency(t *testing.T) {
+	t.Run("should receive concurrently", func(t *testing.T) {
+		const n = 3
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var calls int32
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, _ *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+				// each receive blocks until all loops are receiving
+				if atomic.AddInt32(&calls, 1) == n {
+					cancel()
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+					t.Error("receives were not concurrent")
+					cancel()
+				}
+
+				return nil, ctx.Err()
+			}).MinTimes(n)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithReceiveConcurrency(n), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.Subscribe(ctx, newHandler(nil, cancel))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestWithMaxConcurrentHandlers(t *testing.T) {
+	t.Run("should limit concurrent handlers", func(t *testing.T) {
+		const n = 5
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		out := newReceiveMessageOutput(new(testpb.Message))
+		for i := 1; i < n; i++ {
+			out.Messages = append(out.Messages, out.Messages[0])
+		}
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(out, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(n)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithMaxConcurrentHandlers(2), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var cur, max, handled int32
+		err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			c := atomic.AddInt32(&cur, 1)
+			defer atomic.AddInt32(&cur, -1)
+
+			for {
+				m := atomic.LoadInt32(&max)
+				if c <= m || atomic.CompareAndSwapInt32(&max, m, c) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}, func() {
+			if atomic.AddInt32(&handled, 1) == n {
+				cancel()
+			}
+		}))
+
+		assert.ErrorExists(t, err, false)
+
+		if act := atomic.LoadInt32(&max); act != 2 {
+			t.Errorf("got %d, expected 2", act)
+		}
+	})
+
+	t.Run("should block the receive loop while the handler limit is reached", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		out := newReceiveMessageOutput(new(testpb.Message))
+		out.Messages = append(out.Messages, out.Messages[0])
+
+		var receives int32
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+				if atomic.AddInt32(&receives, 1) == 1 {
+					return out, nil
+				}
+				return new(sqs.ReceiveMessageOutput), nil
+			}).MinTimes(1)
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithMaxConcurrentHandlers(1), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		release := make(chan struct{})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			if act := atomic.LoadInt32(&receives); act != 1 {
+				t.Errorf("got %d receives, expected 1", act)
+			}
+			close(release)
+		}()
+
+		var started, handled int32
+		err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			if act := atomic.AddInt32(&started, 1); act == 1 {
+				<-release
+			}
+			return nil
+		}, func() {
+			if atomic.AddInt32(&handled, 1) == 2 {
+				cancel()
+			}
+		}))
+
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestSubscriber_SetMaxConcurrentHandlers(t *testing.T) {
+	t.Run("should apply the limit to the next dispatch", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		out := newReceiveMessageOutput(new(testpb.Message))
+		out.Messages = append(out.Messages, out.Messages[0])
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(out, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithMaxConcurrentHandlers(1), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		started := make(chan struct{}, 2)
+		release := make(chan struct{})
+
+		go func() {
+			<-started
+			select {
+			case <-started:
+				t.Error("got a second handler, expected the limit to be applied")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			sut.SetMaxConcurrentHandlers(2)
+			<-started
+			close(release)
+		}()
+
+		var handled int32
+		err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		}, func() {
+			if atomic.AddInt32(&handled, 1) == 2 {
+				cancel()
+			}
+		}))
+
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestSubscriber_SetMaxNumberOfMessages(t *testing.T) {
+	t.Run("should apply the values to the next receive", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var sut *pram.Subscriber
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		gomock.InOrder(
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), &sqs.ReceiveMessageInput{
+				QueueUrl:            aws.String("queue"),
+				MaxNumberOfMessages: 10,
+				VisibilityTimeout:   15,
+			}).DoAndReturn(func(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+				sut.SetMaxNumberOfMessages(5)
+				sut.SetVisibilityTimeout(60)
+				return new(sqs.ReceiveMessageOutput), nil
+			}).Times(1),
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), &sqs.ReceiveMessageInput{
+				QueueUrl:            aws.String("queue"),
+				MaxNumberOfMessages: 5,
+				VisibilityTimeout:   60,
+			}).DoAndReturn(func(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+				cancel()
+				return new(sqs.ReceiveMessageOutput), nil
+			}).Times(1),
+		)
+
+		sut = pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestWithGzipDetection(t *testing.T) {
+	tests := []struct {
+		name  string
+		optFn func(*pram.SubscriberOptions)
+		err   bool
+	}{
+		{
+			name:  "should return an error if detection is not enabled",
+			optFn: func(*pram.SubscriberOptions) {},
+			err:   true,
+		},
+		{
+			name:  "should decompress gzip messages",
+			optFn: pram.WithGzipDetection(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			enc, err := pram.Marshal(&testpb.Message{Value: "value"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := new(bytes.Buffer)
+			zw := gzip.NewWriter(buf)
+			zw.Write(enc)
+			zw.Close()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+				Messages: []types.Message{
+					{
+						MessageId:     aws.String("messageid"),
+						Body:          aws.String(`{"Message":"` + base64.StdEncoding.EncodeToString(buf.Bytes()) + `"}`),
+						ReceiptHandle: aws.String("receipthandle"),
+					},
+				},
+			}, nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+			sut := pram.NewSubscriber(sqsc, tt.optFn, func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(e error) {
+					err = e
+					cancel()
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			serr := sut.Subscribe(ctx, newHandler(func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+				if act, exp := m.(*testpb.Message).Value, "value"; act != exp {
+					t.Errorf("got %s, expected %s", act, exp)
+				}
+				return nil
+			}, cancel))
+			if err == nil {
+				err = serr
+			}
+
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+}
+
+func TestWithSubscriptionConfirmation(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		confirm bool
+		setup   func(*mocks.MockSNS)
+		err     bool
+	}{
+		{
+			name:    "should confirm subscriptions",
+			body:    `{"Type":"SubscriptionConfirmation","TopicArn":"topicarn","Token":"token"}`,
+			confirm: true,
+			setup: func(m *mocks.MockSNS) {
+				m.EXPECT().ConfirmSubscription(gomock.Any(), &sns.ConfirmSubscriptionInput{
+					TopicArn: aws.String("topicarn"),
+					Token:    aws.String("token"),
+				}).Return(new(sns.ConfirmSubscriptionOutput), nil).Times(1)
+			},
+		},
+		{
+			name:  "should discard subscription confirmations if not configured",
+			body:  `{"Type":"SubscriptionConfirmation","TopicArn":"topicarn","Token":"token"}`,
+			setup: func(m *mocks.MockSNS) {},
+		},
+		{
+			name:  "should discard unsubscribe confirmations",
+			body:  `{"Type":"UnsubscribeConfirmation","TopicArn":"topicarn","Token":"token"}`,
+			setup: func(m *mocks.MockSNS) {},
+		},
+		{
+			name:  "should return an error if the envelope type is not supported",
+			body:  `{"Type":"Unknown"}`,
+			setup: func(m *mocks.MockSNS) {},
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			snsc := mocks.NewMockSNS(ctrl)
+			tt.setup(snsc)
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+				Messages: []types.Message{
+					{
+						MessageId:     aws.String("messageid"),
+						Body:          aws.String(tt.body),
+						ReceiptHandle: aws.String("receipthandle"),
+					},
+				},
+			}, nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			if !tt.err {
+				sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).DoAndReturn(func(context.Context, *sqs.DeleteMessageInput, ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+					cancel()
+					return nil, nil
+				}).Times(1)
+			}
+
+			var err error
+			optFns := []func(*pram.SubscriberOptions){func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(e error) {
+					err = e
+					cancel()
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			}}
+			if tt.confirm {
+				optFns = append(optFns, pram.WithSubscriptionConfirmation(snsc))
+			}
+
+			sut := pram.NewSubscriber(sqsc, optFns...)
+
+			serr := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				t.Error("handler called")
+				return nil
+			}, cancel))
+
+			assert.ErrorExists(t, serr, false)
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+}
+
+func TestWithMessagePool(t *testing.T) {
+	t.Run("should reset messages once handled", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		gomock.InOrder(
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(&testpb.Message{Value: "a"}), nil).Times(1),
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(&testpb.Message{Value: "b"}), nil).Times(1),
+		)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithMessagePool(), pram.WithMaxConcurrentHandlers(1), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var msgs []*testpb.Message
+		var vals []string
+		err := sut.Subscribe(ctx, newHandler(func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+			tm := m.(*testpb.Message)
+			msgs = append(msgs, tm)
+			vals = append(vals, tm.Value)
+			if len(vals) == 2 {
+				cancel()
+			}
+			return nil
+		}, func() {}))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, vals, []string{"a", "b"})
+		for _, m := range msgs {
+			assert.DeepEqual(t, m.Value, "")
+		}
+	})
+
+	t.Run("should not reset messages between retries", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(&testpb.Message{Value: "value"}), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		backoffFn := func(int) time.Duration { return time.Millisecond }
+		sut := pram.NewSubscriber(sqsc, pram.WithMessagePool(), pram.WithHandlerRetry(2, backoffFn), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var msg *testpb.Message
+		var vals []string
+		err := sut.Subscribe(ctx, newHandler(func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+			msg = m.(*testpb.Message)
+			vals = append(vals, msg.Value)
+			if len(vals) < 3 {
+				return errors.New("error")
+			}
+
+			cancel()
+			return nil
+		}, func() {}))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, vals, []string{"value", "value", "value"})
+		assert.DeepEqual(t, msg.Value, "")
+	})
+}
+
+func TestSubscriber_MessageReleaser(t *testing.T) {
+	t.Run("should release reused messages once handled", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		gomock.InOrder(
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(&testpb.Message{Value: "a"}), nil).Times(1),
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(&testpb.Message{}), nil).Times(1),
+		)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithMaxConcurrentHandlers(1), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		h := &releasingHandler{msg: new(testpb.Message)}
+		h.handleFn = func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+			if m != h.msg {
+				t.Errorf("got %p, expected %p", m, h.msg)
+			}
+
+			h.vals = append(h.vals, m.(*testpb.Message).Value)
+			if len(h.vals) == 2 {
+				cancel()
+			}
+			return nil
+		}
+
+		err := sut.Subscribe(ctx, h)
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, h.vals, []string{"a", ""})
+		assert.DeepEqual(t, h.acquired, 3) // type resolution and two decode targets
+		assert.DeepEqual(t, h.released, 3)
+	})
+
+	t.Run("should release messages once retries have completed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(&testpb.Message{Value: "a"}), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		backoffFn := func(int) time.Duration { return time.Millisecond }
+		sut := pram.NewSubscriber(sqsc, pram.WithHandlerRetry(2, backoffFn), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		h := &releasingHandler{msg: new(testpb.Message)}
+		h.handleFn = func(_ context.Context, m proto.Message, _ pram.Metadata) error {
+			h.vals = append(h.vals, m.(*testpb.Message).Value)
+			if h.released >= h.acquired {
+				t.Error("got released message, expected it to be retained")
+			}
+			if len(h.vals) < 3 {
+				return errors.New("error")
+			}
+
+			cancel()
+			return nil
+		}
+
+		err := sut.Subscribe(ctx, h)
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, h.vals, []string{"a", "a", "a"})
+		assert.DeepEqual(t, h.acquired, 2)
+		assert.DeepEqual(t, h.released, 2)
+	})
+
+	t.Run("should release messages that cannot be decoded", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(&sqs.ReceiveMessageOutput{
+			Messages: []types.Message{
+				{
+					MessageId:     aws.String("messageid"),
+					Body:          aws.String("{\"Message\":\"invalid\"}"),
+					ReceiptHandle: aws.String("receipthandle"),
+				},
+			},
+		}, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+
+		var err error
+		sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(e error) {
+				err = e
+				cancel()
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		h := &releasingHandler{msg: new(testpb.Message)}
+		h.handleFn = func(context.Context, proto.Message, pram.Metadata) error {
+			t.Error("handler called")
+			return nil
+		}
+
+		serr := sut.Subscribe(ctx, h)
+
+		assert.ErrorExists(t, serr, false)
+		assert.ErrorExists(t, err, true)
+		assert.DeepEqual(t, h.acquired, 2)
+		assert.DeepEqual(t, h.released, 2)
+	})
+
+	t.Run("should release messages used to resolve dynamic queue urls", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		receives := 0
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+				if receives++; receives == 3 {
+					cancel()
+				}
+				return new(sqs.ReceiveMessageOutput), nil
+			}).MinTimes(3)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithDynamicQueueURL(), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		h := &releasingHandler{msg: new(testpb.Message)}
+		h.handleFn = func(context.Context, proto.Message, pram.Metadata) error {
+			t.Error("handler called")
+			return nil
+		}
+
+		err := sut.Subscribe(ctx, h)
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, h.acquired, 1)
+		assert.DeepEqual(t, h.released, 1)
+	})
+}
+
+type releasingHandler struct {
+	msg      *testpb.Message
+	handleFn func(context.Context, proto.Message, pram.Metadata) error
+	vals     []string
+	acquired int
+	released int
+}
+
+func (h *releasingHandler) Message() proto.Message {
+	h.acquired++
+	return h.msg
+}
+
+func (h *releasingHandler) Handle(ctx context.Context, m proto.Message, md pram.Metadata) error {
+	return h.handleFn(ctx, m, md)
+}
+
+func (h *releasingHandler) Release(proto.Message) {
+	h.released++
+}
+
+func BenchmarkSubscriber_Subscribe(b *testing.B) {
+	tests := []struct {
+		name   string
+		optFns []func(*pram.SubscriberOptions)
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:   "message pool",
+			optFns: []func(*pram.SubscriberOptions){pram.WithMessagePool()},
+		},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := &benchmarkSQS{
+				out:    newReceiveMessageOutput(&testpb.Message{Value: "value"}),
+				n:      b.N,
+				cancel: cancel,
+			}
+
+			optFns := append([]func(*pram.SubscriberOptions){func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ReceiveInterval = time.Nanosecond
+				o.WaitTimeSeconds = 0
+			}}, tt.optFns...)
+
+			sut := pram.NewSubscriber(sqsc, optFns...)
+			h := newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				return nil
+			}, func() {})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			if err := sut.Subscribe(ctx, h); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWithSubscriberMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		middleware func(*[]string) []pram.HandlerMiddleware
+		handleErr  error
+		exp        []string
+		err        bool
+	}{
+		{
+			name: "should apply middleware in order",
+			middleware: func(rec *[]string) []pram.HandlerMiddleware {
+				return []pram.HandlerMiddleware{
+					recordingMiddleware("a", rec, nil),
+					recordingMiddleware("b", rec, nil),
+				}
+			},
+			exp: []string{"a:before", "b:before", "handle", "b:after", "a:after"},
+		},
+		{
+			name: "should apply middleware if the handler fails",
+			middleware: func(rec *[]string) []pram.HandlerMiddleware {
+				return []pram.HandlerMiddleware{
+					recordingMiddleware("a", rec, nil),
+				}
+			},
+			handleErr: errors.New("error"),
+			exp:       []string{"a:before", "handle", "a:after"},
+			err:       true,
+		},
+		{
+			name: "should allow middleware to short-circuit",
+			middleware: func(rec *[]string) []pram.HandlerMiddleware {
+				return []pram.HandlerMiddleware{
+					recordingMiddleware("a", rec, nil),
+					recordingMiddleware("b", rec, errors.New("error")),
+				}
+			},
+			exp: []string{"a:before", "b:before", "a:after"},
+			err: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			if !tt.err {
+				sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+			}
+
+			var rec []string
+			var err error
+			sut := pram.NewSubscriber(sqsc, pram.WithSubscriberMiddleware(tt.middleware(&rec)...), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(e error) {
+					err = e
+					cancel()
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			h := newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				rec = append(rec, "handle")
+				return tt.handleErr
+			}, func() {})
+
+			serr := sut.Subscribe(ctx, cancelHandler{h, cancel})
+
+			assert.ErrorExists(t, serr, false)
+			assert.ErrorExists(t, err, tt.err)
+			assert.DeepEqual(t, rec, tt.exp)
+		})
+	}
+}
+
+func TestWithReceiveMiddleware(t *testing.T) {
+	t.Run("should apply middleware in order", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(&testpb.Message{Value: "value"}), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		var rec []string
+		mw := func(name string) pram.ReceiveMiddleware {
+			return func(next pram.ReceiveFunc) pram.ReceiveFunc {
+				return func(ctx context.Context, in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+					rec = append(rec, name)
+					return next(ctx, in)
+				}
+			}
+		}
+
+		sut := pram.NewSubscriber(sqsc, pram.WithReceiveMiddleware(mw("a"), mw("b")), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, rec[:2], []string{"a", "b"})
+	})
+
+	t.Run("should skip receives", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(&testpb.Message{Value: "value"}), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+
+		var skipped int
+		sut := pram.NewSubscriber(sqsc, pram.WithReceiveMiddleware(func(next pram.ReceiveFunc) pram.ReceiveFunc {
+			return func(ctx context.Context, in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+				if skipped < 2 {
+					skipped++
+					return new(sqs.ReceiveMessageOutput), nil
+				}
+				return next(ctx, in)
+			}
+		}), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			return nil
+		}, cancel))
+
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, skipped, 2)
+	})
+}
+
+func TestWithReceiveErrorThreshold(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSQSMockRecorder)
+	}{
+		{
+			name: "should return an error after consecutive fatal errors",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.ReceiveMessage(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(3)
+			},
+		},
+		{
+			name: "should reset the count following a transient error",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					m.ReceiveMessage(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(2),
+					m.ReceiveMessage(gomock.Any(), gomock.Any()).Return(nil, retryableError{}).Times(1),
+					m.ReceiveMessage(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(3),
+				)
+			},
+		},
+		{
+			name: "should reset the count following a successful receive",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					m.ReceiveMessage(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(2),
+					m.ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).Times(1),
+					m.ReceiveMessage(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(3),
+				)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			tt.setup(sqsc.EXPECT())
+
+			sut := pram.NewSubscriber(sqsc, pram.WithReceiveErrorThreshold(3), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ReceiveInterval = time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			err := sut.Subscribe(ctx, newHandler(nil, cancel))
+			assert.ErrorExists(t, err, true)
+
+			if ctx.Err() != nil {
+				t.Error("subscribe did not return before the context was cancelled")
+			}
+		})
+	}
+}
+
+func TestAcknowledgerFromContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(*mocks.MockSQSMockRecorder)
+		handleFn func(context.Context) error
+	}{
+		{
+			name: "should delete the message if the acknowledger is not used",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.DeleteMessage(gomock.Any(), gomock.Any()).Return(new(sqs.DeleteMessageOutput), nil).Times(1)
+			},
+			handleFn: func(context.Context) error {
+				return nil
+			},
+		},
+		{
+			name: "should delete the message on ack",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.DeleteMessage(gomock.Any(), &sqs.DeleteMessageInput{
+					QueueUrl:      aws.String("queue"),
+					ReceiptHandle: aws.String("receipthandle"),
+				}).Return(new(sqs.DeleteMessageOutput), nil).Times(1)
+			},
+			handleFn: func(ctx context.Context) error {
+				a, _ := pram.AcknowledgerFromContext(ctx)
+				return a.Ack(ctx)
+			},
+		},
+		{
+			name: "should reset the visibility timeout on nack",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.ChangeMessageVisibility(gomock.Any(), &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String("queue"),
+					ReceiptHandle:     aws.String("receipthandle"),
+					VisibilityTimeout: 0,
+				}).Return(new(sqs.ChangeMessageVisibilityOutput), nil).Times(1)
+			},
+			handleFn: func(ctx context.Context) error {
+				a, _ := pram.AcknowledgerFromContext(ctx)
+				return a.Nack(ctx)
+			},
+		},
+		{
+			name:  "should not delete deferred messages",
+			setup: func(m *mocks.MockSQSMockRecorder) {},
+			handleFn: func(ctx context.Context) error {
+				a, _ := pram.AcknowledgerFromContext(ctx)
+				a.Defer()
+				return nil
+			},
+		},
+		{
+			name: "should return an error if the message has already been settled",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.DeleteMessage(gomock.Any(), gomock.Any()).Return(new(sqs.DeleteMessageOutput), nil).Times(1)
+			},
+			handleFn: func(ctx context.Context) error {
+				a, _ := pram.AcknowledgerFromContext(ctx)
+				if err := a.Ack(ctx); err != nil {
+					return err
+				}
+
+				if err := a.Nack(ctx); err == nil {
+					return errors.New("expected an error")
+				}
+
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			tt.setup(sqsc.EXPECT())
+
+			sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(err error) {
+					t.Error(err)
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			err := sut.Subscribe(ctx, newHandler(func(ctx context.Context, _ proto.Message, _ pram.Metadata) error {
+				return tt.handleFn(ctx)
+			}, cancel))
+
+			assert.ErrorExists(t, err, false)
+		})
+	}
+}
+
+func TestSubscriber_SubscribePanic(t *testing.T) {
+	t.Run("should recover handler panics without deleting the message", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+
+		var err error
+		sut := pram.NewSubscriber(sqsc, func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(e error) {
+				err = e
+				cancel()
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		serr := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+			panic("panic")
+		}, func() {}))
+		assert.ErrorExists(t, serr, false)
+
+		var pe *pram.PanicError
+		if !errors.As(err, &pe) {
+			t.Fatalf("got %v, expected a panic error", err)
+		}
+
+		assert.DeepEqual(t, pe.Value, "panic")
+		if len(pe.Stack) == 0 {
+			t.Error("got an empty stack, expected a stack trace")
+		}
+	})
+}
+
+func TestWithShutdownTimeout(t *testing.T) {
+	t.Run("should drain in-flight messages", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+		sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, _ *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+				return nil, ctx.Err()
+			}).Times(1)
+
+		sut := pram.NewSubscriber(sqsc, pram.WithShutdownTimeout(time.Second), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.Subscribe(ctx, newHandler(func(hctx context.Context, _ proto.Message, _ pram.Metadata) error {
+			cancel()
+			time.Sleep(20 * time.Millisecond)
+			return hctx.Err()
+		}, func() {}))
+
+		assert.ErrorExists(t, err, false)
+	})
+
+	t.Run("should return an error if the timeout elapses", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+
+		sut := pram.NewSubscriber(sqsc, pram.WithShutdownTimeout(10*time.Millisecond), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.Subscribe(ctx, newHandler(func(hctx context.Context, _ proto.Message, _ pram.Metadata) error {
+			cancel()
+			<-hctx.Done()
+			return hctx.Err()
+		}, func() {}))
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, expected %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("should not dispatch messages that exceed the handler limit", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		out := newReceiveMessageOutput(new(testpb.Message))
+		out.Messages = append(out.Messages, out.Messages[0])
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(out, nil).Times(1)
+		sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+
+		sut := pram.NewSubscriber(sqsc, pram.WithShutdownTimeout(50*time.Millisecond), pram.WithMaxConcurrentHandlers(1), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				return "queue", nil
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		var n int32
+		errc := make(chan error, 1)
+		go func() {
+			errc <- sut.Subscribe(ctx, newHandler(func(hctx context.Context, _ proto.Message, _ pram.Metadata) error {
+				atomic.AddInt32(&n, 1)
+				cancel()
+				<-hctx.Done()
+				return hctx.Err()
+			}, func() {}))
+		}()
+
+		select {
+		case err := <-errc:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, expected %v", err, context.Canceled)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("subscribe did not return")
+		}
+
+		assert.DeepEqual(t, atomic.LoadInt32(&n), int32(1))
+	})
+}
+
+func TestWithHandlerTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(*mocks.MockSQSMockRecorder)
+		handleFn func(context.Context, proto.Message, pram.Metadata) error
+		err      bool
+	}{
+		{
+			name: "should delete messages that are handled within the timeout",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+			},
+			handleFn: func(context.Context, proto.Message, pram.Metadata) error {
+				return nil
+			},
+		},
+		{
+			name:  "should cancel the handler context after the timeout",
+			setup: func(*mocks.MockSQSMockRecorder) {},
+			handleFn: func(ctx context.Context, _ proto.Message, _ pram.Metadata) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			err: true,
+		},
+		{
+			name:  "should not delete the message if the handler ignores the timeout",
+			setup: func(*mocks.MockSQSMockRecorder) {},
+			handleFn: func(context.Context, proto.Message, pram.Metadata) error {
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			},
+			err: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			tt.setup(sqsc.EXPECT())
+
+			var err error
+			sut := pram.NewSubscriber(sqsc, pram.WithHandlerTimeout(20*time.Millisecond), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(e error) {
+					err = e
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			serr := sut.Subscribe(ctx, newHandler(tt.handleFn, cancel))
+			assert.ErrorExists(t, serr, false)
+			assert.ErrorExists(t, err, tt.err)
+
+			if tt.err && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got %v, expected %v", err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
+
+func TestWithHandlerRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(*mocks.MockSQSMockRecorder)
+		backoff  time.Duration
+		results  []error
+		attempts []int
+		err      bool
+	}{
+		{
+			name: "should retry failed handlers",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+			},
+			backoff:  time.Millisecond,
+			results:  []error{errors.New("error"), nil},
+			attempts: []int{1},
+		},
+		{
+			name:     "should return the error once the retries are exhausted",
+			setup:    func(*mocks.MockSQSMockRecorder) {},
+			backoff:  time.Millisecond,
+			results:  []error{errors.New("error"), errors.New("error"), errors.New("error")},
+			attempts: []int{1, 2},
+			err:      true,
+		},
+		{
+			name:     "should not retry beyond the visibility timeout",
+			setup:    func(*mocks.MockSQSMockRecorder) {},
+			backoff:  2 * time.Second,
+			results:  []error{errors.New("error")},
+			attempts: []int{1},
+			err:      true,
+		},
+		{
+			name:    "should not retry skipped messages",
+			setup:   func(*mocks.MockSQSMockRecorder) {},
+			backoff: time.Millisecond,
+			results: []error{pram.ErrSkip},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			tt.setup(sqsc.EXPECT())
+
+			var attempts []int
+			backoffFn := func(n int) time.Duration {
+				attempts = append(attempts, n)
+				return tt.backoff
+			}
+
+			var err error
+			sut := pram.NewSubscriber(sqsc, pram.WithHandlerRetry(2, backoffFn), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(e error) {
+					err = e
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+				o.VisibilityTimeoutSeconds = 1
+			})
+
+			var i int
+			serr := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				err := tt.results[i]
+				if i++; i == len(tt.results) {
+					cancel()
+				}
+				return err
+			}, func() {}))
+
+			assert.ErrorExists(t, serr, false)
+			assert.ErrorExists(t, err, tt.err)
+			assert.DeepEqual(t, attempts, tt.attempts)
+
+			if i != len(tt.results) {
+				t.Errorf("got %d attempts, expected %d", i, len(tt.results))
+			}
+		})
+	}
+}
+
+func TestWithTypeFailureAlert(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []error
+		exp     []int
+	}{
+		{
+			name:    "should not alert below the threshold",
+			results: []error{errors.New("error")},
+		},
+		{
+			name:    "should alert for each failure once the threshold is reached",
+			results: []error{errors.New("error"), errors.New("error"), errors.New("error")},
+			exp:     []int{2, 3},
+		},
+		{
+			name:    "should reset the count on success",
+			results: []error{errors.New("error"), nil, errors.New("error"), errors.New("error")},
+			exp:     []int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(len(tt.results))
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+			var act []int
+			sut := pram.NewSubscriber(sqsc, pram.WithTypeFailureAlert(2, func(mt string, n int) {
+				if mt != "pram.test.Message" {
+					t.Errorf("got %s, expected pram.test.Message", mt)
+				}
+				act = append(act, n)
+			}), pram.WithMaxConcurrentHandlers(1), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			var i int32
+			err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				return tt.results[atomic.LoadInt32(&i)]
+			}, func() {
+				if int(atomic.AddInt32(&i, 1)) == len(tt.results) {
+					cancel()
+				}
+			}))
+
+			assert.ErrorExists(t, err, false)
+			assert.DeepEqual(t, act, tt.exp)
+		})
+	}
+}
+
+func TestWithVisibilityExtension(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(*mocks.MockSQSMockRecorder)
+		duration time.Duration
+	}{
+		{
+			name:     "should not extend the visibility timeout for short handlers",
+			setup:    func(*mocks.MockSQSMockRecorder) {},
+			duration: 0,
+		},
+		{
+			name: "should extend the visibility timeout while the handler is running",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.ChangeMessageVisibility(gomock.Any(), &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String("queue"),
+					ReceiptHandle:     aws.String("receipthandle"),
+					VisibilityTimeout: 1,
+				}).Return(new(sqs.ChangeMessageVisibilityOutput), nil).MinTimes(1)
+			},
+			duration: 1200 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+			tt.setup(sqsc.EXPECT())
+
+			sut := pram.NewSubscriber(sqsc, pram.WithVisibilityExtension(), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(err error) {
+					t.Error(err)
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+				o.VisibilityTimeoutSeconds = 1
+			})
+
+			err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				time.Sleep(tt.duration)
+				return nil
+			}, cancel))
+
+			assert.ErrorExists(t, err, false)
+		})
+	}
+}
+
+func TestWithDynamicQueueURL(t *testing.T) {
+	t.Run("should resolve the queue url for each receive", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sqsc := mocks.NewMockSQS(ctrl)
+		gomock.InOrder(
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), receiveMessageInputForQueue("queue-a")).Return(new(sqs.ReceiveMessageOutput), nil).Times(1),
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), receiveMessageInputForQueue("queue-b")).DoAndReturn(func(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+				cancel()
+				return new(sqs.ReceiveMessageOutput), nil
+			}).Times(1),
+		)
+
+		queues := []string{"queue-a", "queue-a", "queue-b"}
+		sut := pram.NewSubscriber(sqsc, pram.WithDynamicQueueURL(), func(o *pram.SubscriberOptions) {
+			o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+				q := queues[0]
+				if len(queues) > 1 {
+					queues = queues[1:]
+				}
+				return q, nil
+			}
+			o.ErrorFn = func(err error) {
+				t.Error(err)
+			}
+			o.ReceiveInterval = 10 * time.Millisecond
+			o.WaitTimeSeconds = 0
+		})
+
+		err := sut.Subscribe(ctx, newHandler(nil, cancel))
+		assert.ErrorExists(t, err, false)
+	})
+}
+
+func TestWithDeleteRetry(t *testing.T) {
+	msg := &testpb.Message{Value: "value"}
+
+	tests := []struct {
+		name  string
+		setup func(*mocks.MockSQSMockRecorder)
+		err   bool
+	}{
+		{
+			name: "should not retry non-retryable errors",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, errors.New("error")).Times(1)
+			},
+			err: true,
+		},
+		{
+			name: "should return an error if the attempts are exhausted",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				m.DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, retryableError{}).Times(3)
+			},
+			err: true,
+		},
+		{
+			name: "should retry retryable errors",
+			setup: func(m *mocks.MockSQSMockRecorder) {
+				gomock.InOrder(
+					m.DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, retryableError{}).Times(2),
+					m.DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1),
+				)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(msg), nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			tt.setup(sqsc.EXPECT())
+
+			var err error
+			sut := pram.NewSubscriber(sqsc, pram.WithDeleteRetry(3, time.Millisecond), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(e error) {
+					err = e
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			serr := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				return nil
+			}, func() {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}))
+
+			assert.ErrorExists(t, serr, false)
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+}
+
+func TestWithDeleteBatching(t *testing.T) {
+	tests := []struct {
+		name      string
+		messages  int
+		size      int
+		interval  time.Duration
+		handleFor int
+		setup     func(*mocks.MockSQSMockRecorder, context.CancelFunc)
+		err       bool
+	}{
+		{
+			name:      "should delete messages when the batch is full",
+			messages:  2,
+			size:      2,
+			interval:  time.Hour,
+			handleFor: 2,
+			setup: func(m *mocks.MockSQSMockRecorder, _ context.CancelFunc) {
+				m.DeleteMessageBatch(gomock.Any(), deleteMessageBatchInputOfLen(2)).Return(new(sqs.DeleteMessageBatchOutput), nil).Times(1)
+			},
+		},
+		{
+			name:     "should delete messages after the flush interval",
+			messages: 1,
+			size:     10,
+			interval: 10 * time.Millisecond,
+			setup: func(m *mocks.MockSQSMockRecorder, cancel context.CancelFunc) {
+				m.DeleteMessageBatch(gomock.Any(), &sqs.DeleteMessageBatchInput{
+					QueueUrl: aws.String("queue"),
+					Entries: []types.DeleteMessageBatchRequestEntry{
+						{Id: aws.String("0"), ReceiptHandle: aws.String("receipthandle0")},
+					},
+				}).
+					DoAndReturn(func(context.Context, *sqs.DeleteMessageBatchInput, ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+						cancel()
+						return new(sqs.DeleteMessageBatchOutput), nil
+					}).Times(1)
+			},
+		},
+		{
+			name:      "should flush pending deletes on shutdown",
+			messages:  3,
+			size:      10,
+			interval:  time.Hour,
+			handleFor: 3,
+			setup: func(m *mocks.MockSQSMockRecorder, _ context.CancelFunc) {
+				m.DeleteMessageBatch(gomock.Any(), deleteMessageBatchInputOfLen(3)).
+					DoAndReturn(func(ctx context.Context, _ *sqs.DeleteMessageBatchInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+						return new(sqs.DeleteMessageBatchOutput), ctx.Err()
+					}).Times(1)
+			},
+		},
+		{
+			name:      "should report failed deletes",
+			messages:  1,
+			size:      10,
+			interval:  time.Hour,
+			handleFor: 1,
+			setup: func(m *mocks.MockSQSMockRecorder, _ context.CancelFunc) {
+				m.DeleteMessageBatch(gomock.Any(), gomock.Any()).Return(&sqs.DeleteMessageBatchOutput{
+					Failed: []types.BatchResultErrorEntry{
+						{Id: aws.String("0"), Code: aws.String("ReceiptHandleIsInvalid"), Message: aws.String("error")},
+					},
+				}, nil).Times(1)
+			},
+			err: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			out := new(sqs.ReceiveMessageOutput)
+			for i := 0; i < tt.messages; i++ {
+				m := newReceiveMessageOutput(new(testpb.Message)).Messages[0]
+				m.MessageId = aws.String("messageid" + strconv.Itoa(i))
+				m.ReceiptHandle = aws.String("receipthandle" + strconv.Itoa(i))
+				out.Messages = append(out.Messages, m)
+			}
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(out, nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			tt.setup(sqsc.EXPECT(), cancel)
+
+			var mu sync.Mutex
+			var errs []error
+			sut := pram.NewSubscriber(sqsc, pram.WithDeleteBatching(tt.size, tt.interval), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(err error) {
+					mu.Lock()
+					defer mu.Unlock()
+					errs = append(errs, err)
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			var n int32
+			err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				return nil
+			}, func() {
+				if tt.handleFor > 0 && int(atomic.AddInt32(&n, 1)) == tt.handleFor {
+					cancel()
+				}
+			}))
+
+			assert.ErrorExists(t, err, false)
+
+			if act := len(errs) > 0; act != tt.err {
+				t.Errorf("got %v, expected %v", errs, tt.err)
+			}
+			if tt.err && !strings.Contains(errs[0].Error(), "messageid0") {
+				t.Errorf("got %v, expected the failed message id", errs[0])
+			}
+		})
+	}
+}
+
+func TestWithDetachedDelete(t *testing.T) {
+	tests := []struct {
+		name  string
+		optFn func(*pram.SubscriberOptions)
+		err   bool
+	}{
+		{
+			name:  "should delete with the subscription context by default",
+			optFn: func(*pram.SubscriberOptions) {},
+			err:   true,
+		},
+		{
+			name:  "should delete with a detached context",
+			optFn: pram.WithDetachedDelete(time.Second),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(newReceiveMessageOutput(new(testpb.Message)), nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, _ *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+					return new(sqs.DeleteMessageOutput), ctx.Err()
+				}).Times(1)
+
+			var err error
+			sut := pram.NewSubscriber(sqsc, tt.optFn, func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.ErrorFn = func(e error) {
+					err = e
+				}
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			// the handler cancels the subscription context before the message is deleted
+			serr := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				return nil
+			}, cancel))
+
+			assert.ErrorExists(t, serr, false)
+			assert.ErrorExists(t, err, tt.err)
+		})
+	}
+}
+
+type rawHandlerFunc func(context.Context, *anypb.Any, pram.Metadata) error
+
+func (fn rawHandlerFunc) HandleRaw(ctx context.Context, body *anypb.Any, md pram.Metadata) error {
+	return fn(ctx, body, md)
+}
+
+type handler struct {
+	handleFn func(context.Context, proto.Message, pram.Metadata) error
+	cancel   context.CancelFunc
+}
+
+func newHandler(handleFn func(context.Context, proto.Message, pram.Metadata) error, cancel context.CancelFunc) *handler {
+	return &handler{
+		handleFn: handleFn,
+		cancel:   cancel,
+	}
+}
+
+func (h *handler) Message() proto.Message {
+	return new(testpb.Message)
+}
+
+func (h *handler) Handle(ctx context.Context, m proto.Message, md pram.Metadata) error {
+	defer h.cancel()
+	return h.handleFn(ctx, m, md)
+}
+
+func recordingMiddleware(name string, rec *[]string, err error) pram.HandlerMiddleware {
+	return func(h pram.Handler) pram.Handler {
+		return &recordingHandler{Handler: h, name: name, rec: rec, err: err}
+	}
+}
+
+type recordingHandler struct {
+	pram.Handler
+	name string
+	rec  *[]string
+	err  error
+}
+
+func (h *recordingHandler) Handle(ctx context.Context, m proto.Message, md pram.Metadata) error {
+	*h.rec = append(*h.rec, h.name+":before")
+	if h.err != nil {
+		return h.err
+	}
+
+	defer func() {
+		*h.rec = append(*h.rec, h.name+":after")
+	}()
+
+	return h.Handler.Handle(ctx, m, md)
+}
+
+type cancelHandler struct {
+	pram.Handler
+	cancel context.CancelFunc
+}
+
+func (h cancelHandler) Handle(ctx context.Context, m proto.Message, md pram.Metadata) error {
+	defer h.cancel()
+	return h.Handler.Handle(ctx, m, md)
+}
+
+type namedHandler struct {
+	*handler
+}
+
+func (h namedHandler) Message() proto.Message {
+	return new(testpb.NamedMessage)
+}
+
+type receiveMessageInputForQueue string
+
+func (m receiveMessageInputForQueue) Matches(x interface{}) bool {
+	in, ok := x.(*sqs.ReceiveMessageInput)
+	return ok && aws.ToString(in.QueueUrl) == string(m)
+}
+
+func (m receiveMessageInputForQueue) String() string {
+	return "receive message input for " + string(m)
+}
+
+type deleteMessageBatchInputOfLen int
+
+func (m deleteMessageBatchInputOfLen) Matches(x interface{}) bool {
+	in, ok := x.(*sqs.DeleteMessageBatchInput)
+	return ok && len(in.Entries) == int(m)
+}
+
+func (m deleteMessageBatchInputOfLen) String() string {
+	return fmt.Sprintf("has %d entries", int(m))
+}
+
+func newReceiveMessageOutput(m proto.Message, optFns ...func(*pram.Metadata)) *sqs.ReceiveMessageOutput {
+	enc, err := pram.Marshal(m, optFns...)
+	if err != nil {
+		panic(err)
+	}
+
+	bm := map[string]string{
+		"Message": base64.StdEncoding.EncodeToString(enc),
+	}
+
+	bb, err := json.Marshal(bm)
+	if err != nil {
+		panic(err)
+	}
+
+	return &sqs.ReceiveMessageOutput{
+		Messages: []types.Message{
+			{
+				MessageId:     aws.String("messageid"),
+				Body:          aws.String(string(bb)),
+				ReceiptHandle: aws.String("receipthandle"),
+			},
+		},
+	}
+}
+
+// benchmarkSQS returns the same output for each receive until n messages have been received
+type benchmarkSQS struct {
+	pram.SQS
+	out    *sqs.ReceiveMessageOutput
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *benchmarkSQS) ReceiveMessage(context.Context, *sqs.ReceiveMessageInput, ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	if c.n < 1 {
+		c.cancel()
+		return new(sqs.ReceiveMessageOutput), nil
+	}
+
+	c.n -= len(c.out.Messages)
+	return c.out, nil
+}
+
+func (c *benchmarkSQS) DeleteMessage(context.Context, *sqs.DeleteMessageInput, ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	return new(sqs.DeleteMessageOutput), nil
+}
+
+type retryableError struct{}
+
+func (retryableError) Error() string {
+	return "retryable"
+}
+
+func (retryableError) RetryableError() bool {
+	return true
 }
@@ -0,0 +1,94 @@
+package pram
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name used for subscriber spans
+const tracerName = "github.com/stevecallear/pram"
+
+// TraceExtractor represents a function that extracts the span context from received message metadata into ctx
+// Extractors allow spans to be continued from producers that use their own attribute conventions.
+type TraceExtractor func(ctx context.Context, md Metadata) context.Context
+
+// HeaderTraceExtractor returns a trace extractor that extracts the span context from the message headers using
+// the specified propagator. This allows the trace context to be read from attributes set by non-pram producers.
+func HeaderTraceExtractor(p propagation.TextMapPropagator) TraceExtractor {
+	return func(ctx context.Context, md Metadata) context.Context {
+		return p.Extract(ctx, traceCarrier(md.Headers))
+	}
+}
+
+// traceContextExtractor returns a trace extractor that extracts the span context from the message envelope
+func traceContextExtractor(p propagation.TextMapPropagator) TraceExtractor {
+	return func(ctx context.Context, md Metadata) context.Context {
+		return p.Extract(ctx, traceCarrier(md.TraceContext))
+	}
+}
+
+// traceCarrier adapts the metadata trace context to a text map carrier
+type traceCarrier map[string]string
+
+// Get returns the value for the specified key
+func (c traceCarrier) Get(key string) string {
+	return c[key]
+}
+
+// Set sets the value for the specified key
+func (c traceCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// Keys returns the carrier keys
+func (c traceCarrier) Keys() []string {
+	ks := make([]string, 0, len(c))
+	for k := range c {
+		ks = append(ks, k)
+	}
+
+	return ks
+}
+
+// injectTraceContext injects the span context from ctx into the message metadata
+func injectTraceContext(ctx context.Context, p propagation.TextMapPropagator, md *Metadata) {
+	c := traceCarrier{}
+	p.Inject(ctx, c)
+
+	if len(c) > 0 {
+		md.TraceContext = c
+	}
+}
+
+// startSpan extracts the span context from the message metadata and starts a consumer span named after the message type
+func startSpan(ctx context.Context, e TraceExtractor, tp trace.TracerProvider, md Metadata) (context.Context, trace.Span) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	ctx = e(ctx, md)
+	return tp.Tracer(tracerName).Start(ctx, md.Type,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "aws_sqs"),
+			attribute.String("messaging.message_id", md.ID),
+		),
+	)
+}
+
+// endSpan records the handler error, if any, and ends the span
+// Skipped messages are not recorded as errors, as skips are intentional rather than failures.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrSkip) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,274 @@
+package pram_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/golang/mock/gomock"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/stevecallear/pram"
+	"github.com/stevecallear/pram/internal/assert"
+	"github.com/stevecallear/pram/mocks"
+	"github.com/stevecallear/pram/pramtest"
+	"github.com/stevecallear/pram/proto/testpb"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestMarshalUnmarshalTraceContext(t *testing.T) {
+	t.Run("should retain the trace context", func(t *testing.T) {
+		b, err := pram.Marshal(new(testpb.Message), func(md *pram.Metadata) {
+			md.TraceContext = map[string]string{"traceparent": traceparent}
+		})
+		assert.ErrorExists(t, err, false)
+
+		m, err := pram.Unmarshal(b, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, m.TraceContext, map[string]string{"traceparent": traceparent})
+	})
+}
+
+func TestWithPublisherTracing(t *testing.T) {
+	t.Run("should inject the span context", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		var in *sns.PublishInput
+		snsc := mocks.NewMockSNS(ctrl)
+		snsc.EXPECT().Publish(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, i *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+				in = i
+				return &sns.PublishOutput{MessageId: aws.String("messageid")}, nil
+			}).Times(1)
+
+		sut := pram.NewPublisher(snsc, pram.WithPublisherTracing(testPropagator{}), func(o *pram.PublisherOptions) {
+			o.TopicARNFn = func(context.Context, proto.Message) (string, error) {
+				return "topic", nil
+			}
+		})
+
+		ctx := context.WithValue(context.Background(), traceparentKey{}, traceparent)
+		_, err := sut.Publish(ctx, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+
+		m, err := pramtest.DecodeSNSPublishInput(in, new(testpb.Message))
+		assert.ErrorExists(t, err, false)
+		assert.DeepEqual(t, m.TraceContext, map[string]string{"traceparent": traceparent})
+	})
+}
+
+func TestWithSubscriberTracing(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		exp  testSpan
+	}{
+		{
+			name: "should start a child span named after the message type",
+			exp: testSpan{
+				name:   "pram.test.Message",
+				parent: traceparent,
+			},
+		},
+		{
+			name: "should record handler errors",
+			err:  errors.New("error"),
+			exp: testSpan{
+				name:   "pram.test.Message",
+				parent: traceparent,
+				errs:   []error{errors.New("error")},
+				status: codes.Error,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			out := newReceiveMessageOutput(new(testpb.Message), func(md *pram.Metadata) {
+				md.TraceContext = map[string]string{"traceparent": traceparent}
+			})
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(out, nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+			tp := new(testTracerProvider)
+			sut := pram.NewSubscriber(sqsc, pram.WithSubscriberTracing(testPropagator{}), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.TracerProvider = tp
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				return tt.err
+			}, cancel))
+			assert.ErrorExists(t, err, false)
+
+			if len(tp.spans) != 1 {
+				t.Fatalf("got %d spans, expected 1", len(tp.spans))
+			}
+
+			act := tp.spans[0]
+			act.Span = nil
+			assert.DeepEqual(t, *act, tt.exp)
+		})
+	}
+}
+
+func TestWithTraceExtractor(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		ext     pram.TraceExtractor
+		exp     testSpan
+	}{
+		{
+			name:    "should use the custom extractor",
+			headers: map[string]string{"X-Amzn-Trace-Id": traceparent},
+			ext: func(ctx context.Context, md pram.Metadata) context.Context {
+				return context.WithValue(ctx, traceparentKey{}, md.Headers["X-Amzn-Trace-Id"])
+			},
+			exp: testSpan{
+				name:   "pram.test.Message",
+				parent: traceparent,
+			},
+		},
+		{
+			name:    "should extract the span context from the headers",
+			headers: map[string]string{"traceparent": traceparent},
+			ext:     pram.HeaderTraceExtractor(testPropagator{}),
+			exp: testSpan{
+				name:   "pram.test.Message",
+				parent: traceparent,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			out := newReceiveMessageOutput(new(testpb.Message))
+			out.Messages[0].MessageAttributes = map[string]types.MessageAttributeValue{}
+			for k, v := range tt.headers {
+				out.Messages[0].MessageAttributes[k] = types.MessageAttributeValue{
+					DataType:    aws.String("String"),
+					StringValue: aws.String(v),
+				}
+			}
+
+			sqsc := mocks.NewMockSQS(ctrl)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(out, nil).Times(1)
+			sqsc.EXPECT().ReceiveMessage(gomock.Any(), gomock.Any()).Return(new(sqs.ReceiveMessageOutput), nil).AnyTimes()
+			sqsc.EXPECT().DeleteMessage(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+			tp := new(testTracerProvider)
+			sut := pram.NewSubscriber(sqsc, pram.WithTraceExtractor(tt.ext), func(o *pram.SubscriberOptions) {
+				o.QueueURLFn = func(context.Context, proto.Message) (string, error) {
+					return "queue", nil
+				}
+				o.TracerProvider = tp
+				o.ReceiveInterval = 10 * time.Millisecond
+				o.WaitTimeSeconds = 0
+			})
+
+			err := sut.Subscribe(ctx, newHandler(func(context.Context, proto.Message, pram.Metadata) error {
+				return nil
+			}, cancel))
+			assert.ErrorExists(t, err, false)
+
+			if len(tp.spans) != 1 {
+				t.Fatalf("got %d spans, expected 1", len(tp.spans))
+			}
+
+			act := tp.spans[0]
+			act.Span = nil
+			assert.DeepEqual(t, *act, tt.exp)
+		})
+	}
+}
+
+type (
+	traceparentKey struct{}
+
+	// testPropagator propagates the traceparent context value without parsing it
+	testPropagator struct{}
+
+	testTracerProvider struct {
+		spans []*testSpan
+	}
+
+	testSpan struct {
+		trace.Span
+		name   string
+		parent string
+		errs   []error
+		status codes.Code
+	}
+)
+
+func (testPropagator) Inject(ctx context.Context, c propagation.TextMapCarrier) {
+	if v, ok := ctx.Value(traceparentKey{}).(string); ok {
+		c.Set("traceparent", v)
+	}
+}
+
+func (testPropagator) Extract(ctx context.Context, c propagation.TextMapCarrier) context.Context {
+	if v := c.Get("traceparent"); v != "" {
+		return context.WithValue(ctx, traceparentKey{}, v)
+	}
+
+	return ctx
+}
+
+func (testPropagator) Fields() []string {
+	return []string{"traceparent"}
+}
+
+func (p *testTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return p
+}
+
+func (p *testTracerProvider) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	parent, _ := ctx.Value(traceparentKey{}).(string)
+	s := &testSpan{
+		Span:   trace.SpanFromContext(ctx),
+		name:   name,
+		parent: parent,
+	}
+
+	p.spans = append(p.spans, s)
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+func (s *testSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.errs = append(s.errs, err)
+}
+
+func (s *testSpan) SetStatus(c codes.Code, _ string) {
+	s.status = c
+}